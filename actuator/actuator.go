@@ -0,0 +1,204 @@
+// Package actuator provides the single layer through which gke-preemptible-sniper mutates Kubernetes and Google Cloud.
+// The live Actuator forwards every call to the Kubernetes and Google Cloud clients, the dry-run Actuator only logs and counts what would have happened.
+package actuator
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/torbendury/gke-preemptible-sniper/gcloud"
+	"github.com/torbendury/gke-preemptible-sniper/k8s"
+	"github.com/torbendury/gke-preemptible-sniper/stats"
+	v1 "k8s.io/api/core/v1"
+)
+
+// Actuator performs all mutating calls of the sniper.
+type Actuator interface {
+	// SetNodeAnnotation sets an annotation on a node.
+	SetNodeAnnotation(ctx context.Context, nodeName, key, value string) error
+	// PlannedAnnotation returns an annotation which was set through the Actuator but is not visible in the cluster.
+	PlannedAnnotation(nodeName, key string) (string, bool)
+	// CordonNode marks a node as unschedulable.
+	CordonNode(ctx context.Context, nodeName string) error
+	// DrainNode evicts all evictable pods from a node and returns the removed ones as namespace/name.
+	DrainNode(ctx context.Context, nodeName string) ([]string, error)
+	// DeleteNode deletes a node object from Kubernetes.
+	DeleteNode(ctx context.Context, nodeName string) error
+	// DeleteInstance deletes a Compute Engine instance.
+	DeleteInstance(ctx context.Context, projectID, zone, instanceName string) error
+	// DeleteInstanceViaGroup deletes a Compute Engine instance through its managed instance group.
+	DeleteInstanceViaGroup(ctx context.Context, projectID, zone, groupName, instanceName string) error
+	// RecreateInstanceViaGroup recreates a Compute Engine instance through its managed instance group.
+	RecreateInstanceViaGroup(ctx context.Context, projectID, zone, groupName, instanceName string) error
+	// ResizeInstanceGroup sets the target size of a managed instance group.
+	ResizeInstanceGroup(ctx context.Context, projectID, zone, groupName string, size int32) error
+}
+
+// KubernetesAPI is the part of the Kubernetes client used by the Actuators.
+type KubernetesAPI interface {
+	SetNodeAnnotation(ctx context.Context, nodeName, key, value string) error
+	CordonNode(ctx context.Context, nodeName string) error
+	DrainNode(ctx context.Context, nodeName string) ([]string, error)
+	DeleteNode(ctx context.Context, nodeName string) error
+	GetEvictablePods(ctx context.Context, nodeName string) ([]v1.Pod, error)
+}
+
+var _ KubernetesAPI = (*k8s.Client)(nil)
+
+// New returns a dry-run Actuator if dryRun is set, a live Actuator otherwise.
+func New(kubernetesClient KubernetesAPI, googleClient gcloud.InstanceAPI, logger *slog.Logger, dryRun bool) Actuator {
+	if dryRun {
+		stats.DryRun.Set(1)
+		return NewDryRun(kubernetesClient, logger)
+	}
+	stats.DryRun.Set(0)
+	return NewLive(kubernetesClient, googleClient)
+}
+
+// Live forwards all calls to the Kubernetes and Google Cloud clients.
+type Live struct {
+	kubernetesClient KubernetesAPI
+	googleClient     gcloud.InstanceAPI
+}
+
+// NewLive creates a new Live Actuator.
+func NewLive(kubernetesClient KubernetesAPI, googleClient gcloud.InstanceAPI) *Live {
+	return &Live{kubernetesClient: kubernetesClient, googleClient: googleClient}
+}
+
+func (l *Live) SetNodeAnnotation(ctx context.Context, nodeName, key, value string) error {
+	return l.kubernetesClient.SetNodeAnnotation(ctx, nodeName, key, value)
+}
+
+// PlannedAnnotation always reports no annotation, since the live Actuator writes annotations to the cluster directly.
+func (l *Live) PlannedAnnotation(nodeName, key string) (string, bool) {
+	return "", false
+}
+
+func (l *Live) CordonNode(ctx context.Context, nodeName string) error {
+	return l.kubernetesClient.CordonNode(ctx, nodeName)
+}
+
+func (l *Live) DrainNode(ctx context.Context, nodeName string) ([]string, error) {
+	return l.kubernetesClient.DrainNode(ctx, nodeName)
+}
+
+func (l *Live) DeleteNode(ctx context.Context, nodeName string) error {
+	return l.kubernetesClient.DeleteNode(ctx, nodeName)
+}
+
+func (l *Live) DeleteInstance(ctx context.Context, projectID, zone, instanceName string) error {
+	return l.googleClient.DeleteInstance(ctx, projectID, zone, instanceName)
+}
+
+func (l *Live) DeleteInstanceViaGroup(ctx context.Context, projectID, zone, groupName, instanceName string) error {
+	return l.googleClient.DeleteInstanceViaGroup(ctx, projectID, zone, groupName, instanceName)
+}
+
+func (l *Live) RecreateInstanceViaGroup(ctx context.Context, projectID, zone, groupName, instanceName string) error {
+	return l.googleClient.RecreateInstanceViaGroup(ctx, projectID, zone, groupName, instanceName)
+}
+
+func (l *Live) ResizeInstanceGroup(ctx context.Context, projectID, zone, groupName string, size int32) error {
+	return l.googleClient.ResizeInstanceGroup(ctx, projectID, zone, groupName, size)
+}
+
+// DryRun never mutates anything. It logs the calls it receives and keeps annotations in memory,
+// so that schedules stay stable between two checks.
+type DryRun struct {
+	kubernetesClient KubernetesAPI
+	logger           *slog.Logger
+
+	mu          sync.Mutex
+	annotations map[string]map[string]string
+}
+
+// NewDryRun creates a new DryRun Actuator. The Kubernetes client is only used for reading.
+func NewDryRun(kubernetesClient KubernetesAPI, logger *slog.Logger) *DryRun {
+	return &DryRun{
+		kubernetesClient: kubernetesClient,
+		logger:           logger,
+		annotations:      make(map[string]map[string]string),
+	}
+}
+
+func (d *DryRun) SetNodeAnnotation(ctx context.Context, nodeName, key, value string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.annotations[nodeName] == nil {
+		d.annotations[nodeName] = make(map[string]string)
+	}
+	d.annotations[nodeName][key] = value
+
+	d.logger.Info("dry-run: would annotate node", "node", nodeName, "key", key, "value", value)
+	stats.DryRunActions.WithLabelValues("annotate").Inc()
+	return nil
+}
+
+func (d *DryRun) PlannedAnnotation(nodeName, key string) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	value, exists := d.annotations[nodeName][key]
+	return value, exists
+}
+
+func (d *DryRun) CordonNode(ctx context.Context, nodeName string) error {
+	d.logger.Info("dry-run: would cordon node", "node", nodeName)
+	stats.DryRunActions.WithLabelValues("cordon").Inc()
+	return nil
+}
+
+// DrainNode lists and returns the pods which would be evicted from the node.
+func (d *DryRun) DrainNode(ctx context.Context, nodeName string) ([]string, error) {
+	pods, err := d.kubernetesClient.GetEvictablePods(ctx, nodeName)
+	if err != nil {
+		return nil, err
+	}
+
+	var podNames []string
+	for _, pod := range pods {
+		podNames = append(podNames, pod.Namespace+"/"+pod.Name)
+	}
+
+	d.logger.Info("dry-run: would drain node", "node", nodeName, "pods", podNames)
+	stats.DryRunActions.WithLabelValues("drain").Inc()
+	return podNames, nil
+}
+
+// DeleteNode forgets all planned annotations of the node, so that it gets a new schedule as if it was replaced.
+func (d *DryRun) DeleteNode(ctx context.Context, nodeName string) error {
+	d.mu.Lock()
+	delete(d.annotations, nodeName)
+	d.mu.Unlock()
+
+	d.logger.Info("dry-run: would delete node", "node", nodeName)
+	stats.DryRunActions.WithLabelValues("delete_node").Inc()
+	return nil
+}
+
+func (d *DryRun) DeleteInstance(ctx context.Context, projectID, zone, instanceName string) error {
+	d.logger.Info("dry-run: would delete instance", "instance", instanceName, "zone", zone, "project", projectID)
+	stats.DryRunActions.WithLabelValues("delete_instance").Inc()
+	return nil
+}
+
+func (d *DryRun) DeleteInstanceViaGroup(ctx context.Context, projectID, zone, groupName, instanceName string) error {
+	d.logger.Info("dry-run: would delete instance via group", "instance", instanceName, "group", groupName, "zone", zone, "project", projectID)
+	stats.DryRunActions.WithLabelValues("delete_instance_via_group").Inc()
+	return nil
+}
+
+func (d *DryRun) RecreateInstanceViaGroup(ctx context.Context, projectID, zone, groupName, instanceName string) error {
+	d.logger.Info("dry-run: would recreate instance via group", "instance", instanceName, "group", groupName, "zone", zone, "project", projectID)
+	stats.DryRunActions.WithLabelValues("recreate_instance_via_group").Inc()
+	return nil
+}
+
+func (d *DryRun) ResizeInstanceGroup(ctx context.Context, projectID, zone, groupName string, size int32) error {
+	d.logger.Info("dry-run: would resize instance group", "group", groupName, "size", size, "zone", zone, "project", projectID)
+	stats.DryRunActions.WithLabelValues("resize_instance_group").Inc()
+	return nil
+}
@@ -0,0 +1,134 @@
+package actuator
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+
+	computepb "cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/torbendury/gke-preemptible-sniper/gcloud"
+	"github.com/torbendury/gke-preemptible-sniper/k8s"
+	"google.golang.org/protobuf/proto"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestDryRunDoesNotMutate(t *testing.T) {
+	clientset := testclient.NewSimpleClientset(
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "default"},
+			Spec:       v1.PodSpec{NodeName: "node1"},
+		},
+	)
+	clientset.ClearActions()
+
+	dryRun := NewDryRun(k8s.NewClientForClientset(clientset), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	ctx := context.TODO()
+
+	if err := dryRun.SetNodeAnnotation(ctx, "node1", "key", "value"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := dryRun.CordonNode(ctx, "node1"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err := dryRun.DrainNode(ctx, "node1"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := dryRun.DeleteNode(ctx, "node1"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := dryRun.DeleteInstance(ctx, "project", "zone", "node1"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := dryRun.DeleteInstanceViaGroup(ctx, "project", "zone", "group", "node1"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := dryRun.RecreateInstanceViaGroup(ctx, "project", "zone", "group", "node1"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := dryRun.ResizeInstanceGroup(ctx, "project", "zone", "group", 3); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() != "get" && action.GetVerb() != "list" {
+			t.Fatalf("expected only read actions, got %s %s", action.GetVerb(), action.GetResource().Resource)
+		}
+	}
+
+	node, err := clientset.CoreV1().Nodes().Get(ctx, "node1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected node to still exist, got %v", err)
+	}
+	if node.Spec.Unschedulable || len(node.Annotations) != 0 {
+		t.Fatalf("expected node to be untouched, got %v", node)
+	}
+}
+
+func TestLiveMutates(t *testing.T) {
+	clientset := testclient.NewSimpleClientset(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}})
+	googleClient := gcloud.NewFakeInstanceAPI()
+	googleClient.AddInstance("project", "zone", &computepb.Instance{Name: proto.String("node1")})
+
+	live := NewLive(k8s.NewClientForClientset(clientset), googleClient)
+	ctx := context.TODO()
+
+	if err := live.SetNodeAnnotation(ctx, "node1", "key", "value"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, planned := live.PlannedAnnotation("node1", "key"); planned {
+		t.Fatalf("expected no planned annotation in live mode")
+	}
+	if err := live.CordonNode(ctx, "node1"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	node, err := clientset.CoreV1().Nodes().Get(ctx, "node1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !node.Spec.Unschedulable || node.Annotations["key"] != "value" {
+		t.Fatalf("expected node to be annotated and cordoned, got %v", node)
+	}
+
+	if _, err := live.DrainNode(ctx, "node1"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := live.DeleteNode(ctx, "node1"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := live.DeleteInstance(ctx, "project", "zone", "node1"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if _, err := clientset.CoreV1().Nodes().Get(ctx, "node1", metav1.GetOptions{}); err == nil {
+		t.Fatalf("expected node to be deleted")
+	}
+	if _, exists := googleClient.Instance("project", "zone", "node1"); exists {
+		t.Fatalf("expected instance to be deleted")
+	}
+}
+
+func TestDryRunPlannedAnnotation(t *testing.T) {
+	dryRun := NewDryRun(k8s.NewClientForClientset(testclient.NewSimpleClientset()), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	ctx := context.TODO()
+
+	if _, planned := dryRun.PlannedAnnotation("node1", "key"); planned {
+		t.Fatalf("expected no planned annotation")
+	}
+
+	dryRun.SetNodeAnnotation(ctx, "node1", "key", "value")
+	value, planned := dryRun.PlannedAnnotation("node1", "key")
+	if !planned || value != "value" {
+		t.Fatalf("expected planned annotation value, got %v", value)
+	}
+
+	// deleting the node simulates its replacement, which has no schedule yet
+	dryRun.DeleteNode(ctx, "node1")
+	if _, planned := dryRun.PlannedAnnotation("node1", "key"); planned {
+		t.Fatalf("expected planned annotation to be forgotten")
+	}
+}
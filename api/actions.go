@@ -0,0 +1,199 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/torbendury/gke-preemptible-sniper/sniper"
+)
+
+const (
+	MAX_EXEMPT_DURATION = 7 * 24 * time.Hour // longest exemption an operator can request
+	MAX_REQUEST_BYTES   = 1 << 16            // maximum size of a request body
+)
+
+// Operator executes the operator actions.
+type Operator interface {
+	SnipeNow(ctx context.Context, nodeName string) (time.Time, error)
+	Reschedule(ctx context.Context, nodeName string, t time.Time) (time.Time, error)
+	RescheduleAll(ctx context.Context, notBefore time.Time) (map[string]time.Time, error)
+	Exempt(ctx context.Context, nodeName string, duration time.Duration) (time.Time, error)
+}
+
+var _ Operator = (*sniper.Sniper)(nil)
+
+// RescheduleRequest is the body of POST /api/v1/nodes/{node}/reschedule. Without time, a random allowed time is planned.
+type RescheduleRequest struct {
+	Time time.Time `json:"time,omitzero"`
+}
+
+// RescheduleAllRequest is the body of POST /api/v1/reschedule.
+type RescheduleAllRequest struct {
+	NotBefore time.Time `json:"notBefore"`
+}
+
+// ExemptRequest is the body of POST /api/v1/nodes/{node}/exempt, e.g. {"duration": "4h"}.
+type ExemptRequest struct {
+	Duration string `json:"duration"`
+}
+
+// ActionResponse is the response of all successful and partly successful operator actions.
+type ActionResponse struct {
+	Node        string               `json:"node,omitempty"`
+	Scheduled   *time.Time           `json:"scheduled,omitempty"`
+	ExemptUntil *time.Time           `json:"exemptUntil,omitempty"`
+	Rescheduled map[string]time.Time `json:"rescheduled,omitempty"`
+	Error       string               `json:"error,omitempty"` // only set with status 207, for the part which failed
+}
+
+// actions registers the operator actions. They require the bearer token and every request is audit logged.
+func actions(mux *http.ServeMux, operator Operator, token string, logger *slog.Logger) {
+	a := &actionHandler{operator: operator, token: token, logger: logger.With("audit", true)}
+	mux.HandleFunc("POST /api/v1/nodes/{node}/snipe", a.handle("snipe", a.snipe))
+	mux.HandleFunc("POST /api/v1/nodes/{node}/reschedule", a.handle("reschedule", a.reschedule))
+	mux.HandleFunc("POST /api/v1/nodes/{node}/exempt", a.handle("exempt", a.exempt))
+	mux.HandleFunc("POST /api/v1/reschedule", a.handle("reschedule-all", a.rescheduleAll))
+}
+
+type actionHandler struct {
+	operator Operator
+	token    string
+	logger   *slog.Logger
+}
+
+// action executes an operator action and returns its response or an error with its HTTP status.
+// With status 207, the action partly failed and the response describes what was changed nonetheless.
+type action func(r *http.Request) (ActionResponse, int, error)
+
+func (a *actionHandler) handle(name string, fn action) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		loginfo := []any{"action", name, "node", r.PathValue("node"), "remoteAddr", r.RemoteAddr, "userAgent", r.UserAgent()}
+
+		if status, err := a.authorize(r); err != nil {
+			a.logger.Warn("operator action denied", append(loginfo, "error", err)...)
+			if status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			writeJSON(w, status, ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, MAX_REQUEST_BYTES)
+		resp, status, err := fn(r)
+		switch {
+		case err != nil && status == http.StatusMultiStatus:
+			a.logger.Error("operator action partly failed", append(loginfo, "status", status, "error", err, "rescheduled", resp.Rescheduled)...)
+			resp.Error = err.Error()
+			writeJSON(w, status, resp)
+		case err != nil:
+			a.logger.Error("operator action failed", append(loginfo, "status", status, "error", err)...)
+			writeJSON(w, status, ErrorResponse{Error: err.Error()})
+		default:
+			a.logger.Info("operator action", append(loginfo, "scheduled", resp.Scheduled, "exemptUntil", resp.ExemptUntil, "rescheduled", resp.Rescheduled)...)
+			writeJSON(w, http.StatusOK, resp)
+		}
+	}
+}
+
+// authorize checks the bearer token of the request. Without configured token, all operator actions are disabled.
+func (a *actionHandler) authorize(r *http.Request) (int, error) {
+	if a.token == "" {
+		return http.StatusForbidden, errors.New("operator actions are disabled, no API token is configured")
+	}
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+		return http.StatusUnauthorized, errors.New("missing or invalid bearer token")
+	}
+	return http.StatusOK, nil
+}
+
+func (a *actionHandler) snipe(r *http.Request) (ActionResponse, int, error) {
+	t, err := a.operator.SnipeNow(r.Context(), r.PathValue("node"))
+	if err != nil {
+		return ActionResponse{}, status(err), err
+	}
+	return ActionResponse{Node: r.PathValue("node"), Scheduled: &t}, http.StatusOK, nil
+}
+
+func (a *actionHandler) reschedule(r *http.Request) (ActionResponse, int, error) {
+	var req RescheduleRequest
+	if err := decode(r, &req, true); err != nil {
+		return ActionResponse{}, http.StatusBadRequest, err
+	}
+	t, err := a.operator.Reschedule(r.Context(), r.PathValue("node"), req.Time)
+	if err != nil {
+		return ActionResponse{}, status(err), err
+	}
+	return ActionResponse{Node: r.PathValue("node"), Scheduled: &t}, http.StatusOK, nil
+}
+
+func (a *actionHandler) exempt(r *http.Request) (ActionResponse, int, error) {
+	var req ExemptRequest
+	if err := decode(r, &req, false); err != nil {
+		return ActionResponse{}, http.StatusBadRequest, err
+	}
+	duration, err := time.ParseDuration(req.Duration)
+	if err != nil || duration <= 0 || duration > MAX_EXEMPT_DURATION {
+		return ActionResponse{}, http.StatusBadRequest, fmt.Errorf("duration must be positive and at most %s, got %q", MAX_EXEMPT_DURATION, req.Duration)
+	}
+	until, err := a.operator.Exempt(r.Context(), r.PathValue("node"), duration)
+	if err != nil {
+		return ActionResponse{}, status(err), err
+	}
+	return ActionResponse{Node: r.PathValue("node"), ExemptUntil: &until}, http.StatusOK, nil
+}
+
+func (a *actionHandler) rescheduleAll(r *http.Request) (ActionResponse, int, error) {
+	var req RescheduleAllRequest
+	if err := decode(r, &req, false); err != nil {
+		return ActionResponse{}, http.StatusBadRequest, err
+	}
+	if req.NotBefore.IsZero() {
+		return ActionResponse{}, http.StatusBadRequest, errors.New("notBefore is required")
+	}
+	rescheduled, err := a.operator.RescheduleAll(r.Context(), req.NotBefore)
+	if err != nil && len(rescheduled) > 0 {
+		// the operator needs to know which snipes were moved before the others failed
+		return ActionResponse{Rescheduled: rescheduled}, http.StatusMultiStatus, err
+	}
+	if err != nil {
+		return ActionResponse{}, http.StatusInternalServerError, err
+	}
+	return ActionResponse{Rescheduled: rescheduled}, http.StatusOK, nil
+}
+
+// decode decodes the JSON body of the request. Unknown fields are errors. An empty body is only allowed if optional is set.
+func decode(r *http.Request, v any, optional bool) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if errors.Is(err, io.EOF) && optional {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+	return nil
+}
+
+// status returns the HTTP status for an error of an operator action.
+func status(err error) int {
+	switch {
+	case errors.Is(err, sniper.ErrNodeNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, sniper.ErrNotEligible):
+		return http.StatusConflict
+	case errors.Is(err, sniper.ErrInvalidTime):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
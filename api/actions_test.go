@@ -0,0 +1,177 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/torbendury/gke-preemptible-sniper/sniper"
+)
+
+var scheduled = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// fakeOperator knows node1 only, node2 is not eligible.
+type fakeOperator struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (o *fakeOperator) call(action, nodeName string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.calls = append(o.calls, action+" "+nodeName)
+	switch nodeName {
+	case "node1", "":
+		return nil
+	case "node2":
+		return fmt.Errorf("%w: not preemptible", sniper.ErrNotEligible)
+	default:
+		return fmt.Errorf("%w: %s", sniper.ErrNodeNotFound, nodeName)
+	}
+}
+
+func (o *fakeOperator) SnipeNow(ctx context.Context, nodeName string) (time.Time, error) {
+	return scheduled, o.call("snipe", nodeName)
+}
+
+func (o *fakeOperator) Reschedule(ctx context.Context, nodeName string, t time.Time) (time.Time, error) {
+	if t.IsZero() {
+		t = scheduled
+	}
+	err := o.call("reschedule "+t.Format(time.RFC3339), nodeName)
+	if err == nil && t.Before(scheduled) {
+		return time.Time{}, fmt.Errorf("%w: not in the future", sniper.ErrInvalidTime)
+	}
+	return t, err
+}
+
+func (o *fakeOperator) RescheduleAll(ctx context.Context, notBefore time.Time) (map[string]time.Time, error) {
+	return map[string]time.Time{"node1": notBefore.Add(time.Hour)}, o.call("reschedule-all "+notBefore.Format(time.RFC3339), "")
+}
+
+func (o *fakeOperator) Exempt(ctx context.Context, nodeName string, duration time.Duration) (time.Time, error) {
+	return time.Now().Add(duration), o.call("exempt", nodeName)
+}
+
+func TestActions(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		token  string
+		body   string
+		status int
+		call   string
+	}{
+		{name: "snipe", path: "/api/v1/nodes/node1/snipe", token: testToken, status: http.StatusOK, call: "snipe node1"},
+		{name: "missing token", path: "/api/v1/nodes/node1/snipe", status: http.StatusUnauthorized},
+		{name: "wrong token", path: "/api/v1/nodes/node1/snipe", token: "guess", status: http.StatusUnauthorized},
+		{name: "unknown node", path: "/api/v1/nodes/node9/snipe", token: testToken, status: http.StatusNotFound, call: "snipe node9"},
+		{name: "not eligible", path: "/api/v1/nodes/node2/snipe", token: testToken, status: http.StatusConflict, call: "snipe node2"},
+		{name: "reschedule at random", path: "/api/v1/nodes/node1/reschedule", token: testToken, status: http.StatusOK, call: "reschedule 2024-06-01T12:00:00Z node1"},
+		{name: "reschedule at time", path: "/api/v1/nodes/node1/reschedule", token: testToken, body: `{"time": "2024-06-02T08:00:00Z"}`, status: http.StatusOK, call: "reschedule 2024-06-02T08:00:00Z node1"},
+		{name: "reschedule into the past", path: "/api/v1/nodes/node1/reschedule", token: testToken, body: `{"time": "2024-05-01T08:00:00Z"}`, status: http.StatusBadRequest, call: "reschedule 2024-05-01T08:00:00Z node1"},
+		{name: "reschedule with unknown field", path: "/api/v1/nodes/node1/reschedule", token: testToken, body: `{"when": "tomorrow"}`, status: http.StatusBadRequest},
+		{name: "reschedule all", path: "/api/v1/reschedule", token: testToken, body: `{"notBefore": "2024-06-02T00:00:00Z"}`, status: http.StatusOK, call: "reschedule-all 2024-06-02T00:00:00Z "},
+		{name: "reschedule all without time", path: "/api/v1/reschedule", token: testToken, body: `{}`, status: http.StatusBadRequest},
+		{name: "exempt", path: "/api/v1/nodes/node1/exempt", token: testToken, body: `{"duration": "4h"}`, status: http.StatusOK, call: "exempt node1"},
+		{name: "exempt without duration", path: "/api/v1/nodes/node1/exempt", token: testToken, status: http.StatusBadRequest},
+		{name: "exempt too long", path: "/api/v1/nodes/node1/exempt", token: testToken, body: `{"duration": "1000h"}`, status: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		operator := &fakeOperator{}
+		var logs bytes.Buffer
+		handler := NewHandler(fakeNodes{}, fakeHistory{}, operator, testToken, slog.New(slog.NewJSONHandler(&logs, nil)))
+
+		req := httptest.NewRequest(http.MethodPost, test.path, strings.NewReader(test.body))
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d: %s", test.name, test.status, rec.Code, rec.Body)
+		}
+		if got := strings.Join(operator.calls, ","); got != test.call {
+			t.Errorf("%s: expected call %q, got %q", test.name, test.call, got)
+		}
+
+		// every request is audit logged, including denied ones
+		var entry map[string]any
+		if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+			t.Fatalf("%s: expected one audit log entry, got %q", test.name, logs.String())
+		}
+		if entry["audit"] != true || entry["action"] == "" || entry["remoteAddr"] == "" {
+			t.Errorf("%s: unexpected audit log entry %v", test.name, entry)
+		}
+	}
+}
+
+func TestActionsDisabledWithoutToken(t *testing.T) {
+	operator := &fakeOperator{}
+	handler := NewHandler(fakeNodes{}, fakeHistory{}, operator, "", slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil)))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/nodes/node1/snipe", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden || len(operator.calls) != 0 {
+		t.Fatalf("expected operator actions to be disabled, got %d and calls %v", rec.Code, operator.calls)
+	}
+}
+
+// failingOperator moves the snipes of the provided nodes, but fails for all others.
+type failingOperator struct {
+	fakeOperator
+	moved []string
+}
+
+func (o *failingOperator) RescheduleAll(ctx context.Context, notBefore time.Time) (map[string]time.Time, error) {
+	rescheduled := make(map[string]time.Time)
+	for _, nodeName := range o.moved {
+		rescheduled[nodeName] = notBefore.Add(time.Hour)
+	}
+	return rescheduled, errors.New("node node3: patch failed")
+}
+
+func TestRescheduleAllReportsPartialResults(t *testing.T) {
+	tests := []struct {
+		name   string
+		moved  []string
+		status int
+	}{
+		{name: "partly failed", moved: []string{"node1", "node2"}, status: http.StatusMultiStatus},
+		{name: "failed", status: http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		operator := &failingOperator{moved: test.moved}
+		handler := NewHandler(fakeNodes{}, fakeHistory{}, operator, testToken, slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil)))
+
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/reschedule", strings.NewReader(`{"notBefore": "2024-06-02T00:00:00Z"}`))
+		req.Header.Set("Authorization", "Bearer "+testToken)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d: %s", test.name, test.status, rec.Code, rec.Body)
+		}
+		var resp ActionResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: expected JSON, got %v", test.name, err)
+		}
+		if resp.Error != "node node3: patch failed" || len(resp.Rescheduled) != len(test.moved) {
+			t.Errorf("%s: expected the moved nodes together with the error, got %+v", test.name, resp)
+		}
+	}
+}
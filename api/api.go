@@ -0,0 +1,76 @@
+// Package api provides a JSON API on the state of gke-preemptible-sniper, e.g. for dashboards and chat bots.
+// Reading is open to everyone who can reach the HTTP server, operator actions which change the schedule of nodes require a bearer token.
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/torbendury/gke-preemptible-sniper/history"
+	"github.com/torbendury/gke-preemptible-sniper/sniper"
+)
+
+const (
+	DEFAULT_HISTORY_LIMIT = 100 // number of snipes returned by the history endpoint if no limit is requested
+	MAX_HISTORY_LIMIT     = history.MAX_ENTRIES
+)
+
+// Nodes provides the state of all nodes.
+type Nodes interface {
+	NodeStatuses() []sniper.NodeStatus
+}
+
+// History provides the recent snipes, oldest first.
+type History interface {
+	Entries() []history.Entry
+}
+
+// NodesResponse is the response of GET /api/v1/nodes.
+type NodesResponse struct {
+	Nodes []sniper.NodeStatus `json:"nodes"`
+}
+
+// HistoryResponse is the response of GET /api/v1/history.
+type HistoryResponse struct {
+	Snipes []history.Entry `json:"snipes"` // newest first
+}
+
+// ErrorResponse is the response of all failed requests.
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// NewHandler returns the handler of all API endpoints below /api/v1/. Without token, the operator actions are disabled.
+func NewHandler(nodes Nodes, snipes History, operator Operator, token string, logger *slog.Logger) http.Handler {
+	mux := http.NewServeMux()
+	actions(mux, operator, token, logger)
+	mux.HandleFunc("GET /api/v1/nodes", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, NodesResponse{Nodes: nodes.NodeStatuses()})
+	})
+	mux.HandleFunc("GET /api/v1/history", func(w http.ResponseWriter, r *http.Request) {
+		limit := DEFAULT_HISTORY_LIMIT
+		if value := r.URL.Query().Get("limit"); value != "" {
+			var err error
+			limit, err = strconv.Atoi(value)
+			if err != nil || limit < 1 || limit > MAX_HISTORY_LIMIT {
+				writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("limit must be a number between 1 and %d", MAX_HISTORY_LIMIT)})
+				return
+			}
+		}
+
+		entries := append([]history.Entry{}, snipes.Entries()...)
+		slices.Reverse(entries)
+		writeJSON(w, http.StatusOK, HistoryResponse{Snipes: entries[:min(limit, len(entries))]})
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
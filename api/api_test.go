@@ -0,0 +1,114 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/torbendury/gke-preemptible-sniper/history"
+	"github.com/torbendury/gke-preemptible-sniper/sniper"
+)
+
+type fakeNodes []sniper.NodeStatus
+
+func (n fakeNodes) NodeStatuses() []sniper.NodeStatus { return n }
+
+type fakeHistory []history.Entry
+
+func (h fakeHistory) Entries() []history.Entry { return h }
+
+const testToken = "secret"
+
+func newTestHandler(nodes Nodes, snipes History, operator Operator) http.Handler {
+	return NewHandler(nodes, snipes, operator, testToken, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func TestNodes(t *testing.T) {
+	scheduled := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	nodes := fakeNodes{
+		{Name: "node1", NodePool: "pool", Zone: "zone", Eligible: true, Scheduled: &scheduled, Phase: sniper.PHASE_SCHEDULED},
+		{Name: "node2", NodePool: "critical", Zone: "zone", ExcludedReason: "node pool critical", Phase: sniper.PHASE_INELIGIBLE},
+	}
+	server := httptest.NewServer(newTestHandler(nodes, fakeHistory{}, nil))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/v1/nodes")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected response %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var body NodesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(body.Nodes) != 2 || !body.Nodes[0].Scheduled.Equal(scheduled) || body.Nodes[1].ExcludedReason != "node pool critical" {
+		t.Fatalf("unexpected nodes %+v", body.Nodes)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	var snipes fakeHistory
+	for i := range 3 {
+		snipes = append(snipes, history.Entry{Node: fmt.Sprintf("node%d", i), Result: "succeeded"})
+	}
+	server := httptest.NewServer(newTestHandler(fakeNodes{}, snipes, nil))
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		want   []string
+	}{
+		{name: "newest first", path: "/api/v1/history", status: http.StatusOK, want: []string{"node2", "node1", "node0"}},
+		{name: "limit", path: "/api/v1/history?limit=2", status: http.StatusOK, want: []string{"node2", "node1"}},
+		{name: "invalid limit", path: "/api/v1/history?limit=zero", status: http.StatusBadRequest},
+		{name: "limit too large", path: fmt.Sprintf("/api/v1/history?limit=%d", MAX_HISTORY_LIMIT+1), status: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		resp, err := http.Get(server.URL + test.path)
+		if err != nil {
+			t.Fatalf("%s: expected no error, got %v", test.name, err)
+		}
+		var body HistoryResponse
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: expected no error, got %v", test.name, err)
+		}
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, resp.StatusCode)
+			continue
+		}
+		var got []string
+		for _, snipe := range body.Snipes {
+			got = append(got, snipe.Node)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	server := httptest.NewServer(newTestHandler(fakeNodes{}, fakeHistory{}, nil))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/api/v1/nodes", "application/json", nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected status %d, got %d", http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+}
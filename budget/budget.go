@@ -0,0 +1,93 @@
+// Package budget provides a concurrency-safe error budget over a sliding time window.
+// Errors are accounted per class, so that transient API errors and fatal configuration errors can exhaust separate budgets.
+package budget
+
+import (
+	"sync"
+	"time"
+)
+
+// Class is the class of an error.
+type Class int
+
+const (
+	// Transient errors are expected to go away on their own, e.g. timeouts or unavailable APIs.
+	Transient Class = iota
+	// Fatal errors need an operator to fix the configuration or permissions of the sniper.
+	Fatal
+)
+
+// Classes contains all classes of errors.
+var Classes = []Class{Transient, Fatal}
+
+func (c Class) String() string {
+	switch c {
+	case Transient:
+		return "transient"
+	case Fatal:
+		return "fatal"
+	default:
+		return "unknown"
+	}
+}
+
+// Budget counts the errors of every class which happened within the window.
+// A class is exhausted once the number of its errors in the window reaches its limit.
+type Budget struct {
+	window time.Duration
+	limits map[Class]int
+	now    func() time.Time
+
+	mu     sync.Mutex
+	errors map[Class][]time.Time // times of the errors within the window, oldest first
+}
+
+// New creates a Budget with the provided window and limits per class. Classes without limit are never exhausted.
+func New(window time.Duration, limits map[Class]int, now func() time.Time) *Budget {
+	return &Budget{
+		window: window,
+		limits: limits,
+		now:    now,
+		errors: make(map[Class][]time.Time),
+	}
+}
+
+// Record records an error of the provided class.
+func (b *Budget) Record(class Class) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.errors[class] = append(b.prune(class), b.now())
+}
+
+// Count returns the number of errors of the provided class within the window.
+func (b *Budget) Count(class Class) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.prune(class))
+}
+
+// Remaining returns how many more errors of the provided class fit into the budget, or -1 if the class has no limit.
+func (b *Budget) Remaining(class Class) int {
+	limit, limited := b.limits[class]
+	if !limited {
+		return -1
+	}
+	return max(limit-b.Count(class), 0)
+}
+
+// Exhausted checks whether the budget of the provided class is used up.
+func (b *Budget) Exhausted(class Class) bool {
+	return b.Remaining(class) == 0
+}
+
+// prune removes the errors of the provided class which left the window and returns the remaining ones. b.mu must be held.
+func (b *Budget) prune(class Class) []time.Time {
+	cutoff := b.now().Add(-b.window)
+	errors := b.errors[class]
+	i := 0
+	for i < len(errors) && !errors[i].After(cutoff) {
+		i++
+	}
+	b.errors[class] = errors[i:]
+	return b.errors[class]
+}
@@ -0,0 +1,74 @@
+package budget
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBudget(t *testing.T) {
+	now := time.Now()
+	b := New(time.Minute, map[Class]int{Transient: 3, Fatal: 1}, func() time.Time { return now })
+
+	tests := []struct {
+		name      string
+		record    []Class
+		advance   time.Duration
+		transient int
+		fatal     int
+	}{
+		{name: "empty", transient: 3, fatal: 1},
+		{name: "one transient", record: []Class{Transient}, transient: 2, fatal: 1},
+		{name: "classes are separate", record: []Class{Fatal}, transient: 2, fatal: 0},
+		{name: "exhausted", record: []Class{Transient, Transient, Transient}, transient: 0, fatal: 0},
+		{name: "window slides", advance: 2 * time.Minute, transient: 3, fatal: 1},
+	}
+
+	for _, test := range tests {
+		now = now.Add(test.advance)
+		for _, class := range test.record {
+			b.Record(class)
+		}
+		if remaining := b.Remaining(Transient); remaining != test.transient {
+			t.Errorf("%s: expected %d transient errors remaining, got %d", test.name, test.transient, remaining)
+		}
+		if remaining := b.Remaining(Fatal); remaining != test.fatal {
+			t.Errorf("%s: expected %d fatal errors remaining, got %d", test.name, test.fatal, remaining)
+		}
+		if b.Exhausted(Transient) != (test.transient == 0) {
+			t.Errorf("%s: expected transient exhausted = %v", test.name, test.transient == 0)
+		}
+	}
+}
+
+func TestBudgetWithoutLimit(t *testing.T) {
+	b := New(time.Minute, map[Class]int{}, time.Now)
+	b.Record(Fatal)
+	if b.Remaining(Fatal) != -1 || b.Exhausted(Fatal) {
+		t.Fatalf("expected class without limit never to be exhausted")
+	}
+	if b.Count(Fatal) != 1 {
+		t.Fatalf("expected 1 fatal error, got %d", b.Count(Fatal))
+	}
+}
+
+func TestBudgetConcurrentRecords(t *testing.T) {
+	b := New(time.Hour, map[Class]int{Transient: 1000}, time.Now)
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				b.Record(Transient)
+				b.Exhausted(Transient)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if b.Count(Transient) != 500 {
+		t.Fatalf("expected 500 transient errors, got %d", b.Count(Transient))
+	}
+}
@@ -0,0 +1,154 @@
+// Package cloudevent emits the lifecycle of snipes as CloudEvents over HTTP to a sink, e.g. a broker which routes them to other systems.
+// Like the webhooks of package notify, events are queued and sent in the background, so that a slow sink never delays a snipe.
+package cloudevent
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+	"github.com/google/uuid"
+	"github.com/torbendury/gke-preemptible-sniper/notify"
+	"github.com/torbendury/gke-preemptible-sniper/stats"
+)
+
+const (
+	TYPE_PREFIX = "com.github.torbendury.gke-preemptible-sniper.node." // followed by the type of the notify.Event
+	SOURCE      = "gke-preemptible-sniper"                             // followed by the name of the cluster
+	SINK_NAME   = "cloudevents"                                        // webhook label of the notification metrics
+
+	MODE_BINARY     = "binary"     // attributes in HTTP headers, data in the body
+	MODE_STRUCTURED = "structured" // attributes and data together in a JSON body
+
+	QUEUE_SIZE      = notify.QUEUE_SIZE
+	MAX_ATTEMPTS    = notify.MAX_ATTEMPTS
+	RETRY_BACKOFF   = notify.RETRY_BACKOFF
+	REQUEST_TIMEOUT = notify.REQUEST_TIMEOUT
+)
+
+// EVENT_TYPES are the types of notify.Event which are emitted, all of them by default.
+var EVENT_TYPES = []string{notify.EVENT_SCHEDULED, notify.EVENT_CORDONED, notify.EVENT_DRAINED, notify.EVENT_DELETED, notify.EVENT_FAILED}
+
+// Sink is the receiver of the CloudEvents. Without URL, nothing is emitted.
+type Sink struct {
+	URL    string
+	Mode   string   // one of the MODE_* constants
+	Events []string // types of notify.Event which are emitted
+}
+
+// Data is the data of every CloudEvent, encoded as JSON.
+type Data struct {
+	Cluster   string    `json:"cluster"`
+	Node      string    `json:"node"`
+	NodePool  string    `json:"nodePool"`
+	Zone      string    `json:"zone"`
+	Instance  string    `json:"instance,omitempty"`
+	Scheduled time.Time `json:"scheduled,omitzero"` // planned snipe time
+	Started   time.Time `json:"started,omitzero"`   // start of the snipe
+	Pods      []string  `json:"pods,omitempty"`     // pods evicted from the node as namespace/name
+	Message   string    `json:"message,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Emitter sends events as CloudEvents to a sink.
+type Emitter struct {
+	sink    Sink
+	client  cloudevents.Client
+	backoff time.Duration
+	logger  *slog.Logger
+	events  chan notify.Event
+}
+
+// New creates an Emitter for the sink. Events are sent once Run was started.
+func New(sink Sink, logger *slog.Logger) (*Emitter, error) {
+	client, err := cloudevents.NewClientHTTP(cehttp.WithClient(http.Client{Timeout: REQUEST_TIMEOUT}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CloudEvents client: %w", err)
+	}
+	return &Emitter{
+		sink:    sink,
+		client:  client,
+		backoff: RETRY_BACKOFF,
+		logger:  logger,
+		events:  make(chan notify.Event, QUEUE_SIZE),
+	}, nil
+}
+
+// Notify queues the event if its type is emitted. It never blocks, if the queue is full, the event is dropped.
+func (e *Emitter) Notify(event notify.Event) {
+	if !slices.Contains(e.sink.Events, event.Type) {
+		return
+	}
+	select {
+	case e.events <- event:
+	default:
+		e.logger.Warn("CloudEvents queue is full, dropping event", "type", event.Type, "node", event.Node)
+		stats.Notifications.WithLabelValues(SINK_NAME, stats.NOTIFICATION_DROPPED).Inc()
+	}
+}
+
+// Run sends the queued events until the context is done.
+func (e *Emitter) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-e.events:
+			err := e.send(ctx, event)
+			if err != nil {
+				e.logger.Error("failed to send CloudEvent", "type", event.Type, "node", event.Node, "error", err)
+			}
+			stats.Notifications.WithLabelValues(SINK_NAME, stats.Result(err)).Inc()
+		}
+	}
+}
+
+// send delivers the event to the sink. Network errors, rate limits and server errors are retried with exponential backoff.
+func (e *Emitter) send(ctx context.Context, event notify.Event) error {
+	ce, err := NewEvent(event)
+	if err != nil {
+		return err
+	}
+	ctx = cloudevents.ContextWithTarget(ctx, e.sink.URL)
+	ctx = cloudevents.ContextWithRetriesExponentialBackoff(ctx, e.backoff, MAX_ATTEMPTS-1)
+	if e.sink.Mode == MODE_STRUCTURED {
+		ctx = cloudevents.WithEncodingStructured(ctx)
+	} else {
+		ctx = cloudevents.WithEncodingBinary(ctx)
+	}
+	if result := e.client.Send(ctx, ce); !cloudevents.IsACK(result) {
+		return result
+	}
+	return nil
+}
+
+// NewEvent converts the event into a CloudEvent. Its subject is the name of the node.
+func NewEvent(event notify.Event) (cloudevents.Event, error) {
+	ce := cloudevents.NewEvent()
+	ce.SetID(uuid.NewString())
+	ce.SetType(TYPE_PREFIX + event.Type)
+	ce.SetSource(SOURCE + "/" + event.Cluster)
+	ce.SetSubject(event.Node)
+	ce.SetTime(event.Time)
+	err := ce.SetData(cloudevents.ApplicationJSON, Data{
+		Cluster:   event.Cluster,
+		Node:      event.Node,
+		NodePool:  event.NodePool,
+		Zone:      event.Zone,
+		Instance:  event.Instance,
+		Scheduled: event.Scheduled,
+		Started:   event.Started,
+		Pods:      event.Pods,
+		Message:   event.Message,
+		Error:     event.Error,
+	})
+	if err != nil {
+		return cloudevents.Event{}, fmt.Errorf("failed to encode CloudEvent data: %w", err)
+	}
+	return ce, ce.Validate()
+}
@@ -0,0 +1,157 @@
+package cloudevent
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/torbendury/gke-preemptible-sniper/notify"
+	"github.com/torbendury/gke-preemptible-sniper/stats"
+)
+
+func newTestEmitter(t *testing.T, sink Sink) *Emitter {
+	e, err := New(sink, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	e.backoff = time.Millisecond
+	return e
+}
+
+func testEvent(eventType string) notify.Event {
+	return notify.Event{
+		Type:      eventType,
+		Time:      time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC),
+		Cluster:   "cluster",
+		Node:      "node1",
+		NodePool:  "pool",
+		Zone:      "zone",
+		Instance:  "instance1",
+		Scheduled: time.Date(2024, 6, 1, 11, 0, 0, 0, time.UTC),
+		Started:   time.Date(2024, 6, 1, 11, 59, 0, 0, time.UTC),
+		Pods:      []string{"default/pod1", "default/pod2"},
+	}
+}
+
+// sink responds with the provided status codes in turn, the last one repeatedly, and decodes every request as CloudEvent.
+type sink struct {
+	server   *httptest.Server
+	requests atomic.Int32
+	events   chan *cloudevents.Event
+	ctypes   chan string
+}
+
+func newSink(t *testing.T, statuses ...int) *sink {
+	s := &sink{events: make(chan *cloudevents.Event, 10), ctypes: make(chan string, 10)}
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := int(s.requests.Add(1)) - 1
+		event, err := cloudevents.NewEventFromHTTPRequest(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(statuses[min(i, len(statuses)-1)])
+		s.events <- event
+		s.ctypes <- r.Header.Get("Content-Type")
+	}))
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+func TestEmitterModes(t *testing.T) {
+	tests := []struct {
+		mode        string
+		contentType string
+	}{
+		{mode: MODE_BINARY, contentType: cloudevents.ApplicationJSON},
+		{mode: MODE_STRUCTURED, contentType: cloudevents.ApplicationCloudEventsJSON},
+	}
+
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			s := newSink(t, http.StatusAccepted)
+			e := newTestEmitter(t, Sink{URL: s.server.URL, Mode: test.mode, Events: EVENT_TYPES})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go e.Run(ctx)
+
+			e.Notify(testEvent(notify.EVENT_STARTED)) // not a CloudEvent type
+			e.Notify(testEvent(notify.EVENT_DRAINED))
+
+			var event *cloudevents.Event
+			select {
+			case event = <-s.events:
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected a CloudEvent")
+			}
+			if contentType := <-s.ctypes; !strings.HasPrefix(contentType, test.contentType) {
+				t.Errorf("expected content type %s, got %s", test.contentType, contentType)
+			}
+			if event.Type() != "com.github.torbendury.gke-preemptible-sniper.node.drained" || event.Source() != "gke-preemptible-sniper/cluster" || event.Subject() != "node1" || event.ID() == "" {
+				t.Errorf("unexpected attributes %s", event)
+			}
+			var data Data
+			if err := event.DataAs(&data); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if data.Instance != "instance1" || data.NodePool != "pool" || data.Zone != "zone" || !data.Started.Equal(testEvent("").Started) || !slices.Equal(data.Pods, []string{"default/pod1", "default/pod2"}) {
+				t.Errorf("unexpected data %+v", data)
+			}
+			if got := s.requests.Load(); got != 1 {
+				t.Errorf("expected 1 request, got %d", got)
+			}
+		})
+	}
+}
+
+func TestEmitterRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		requests int32
+		wantErr  bool
+	}{
+		{name: "success", statuses: []int{http.StatusOK}, requests: 1},
+		{name: "unavailable sink is retried", statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK}, requests: 3},
+		{name: "rejected events are not retried", statuses: []int{http.StatusBadRequest}, requests: 1, wantErr: true},
+		{name: "attempts are limited", statuses: []int{http.StatusServiceUnavailable}, requests: MAX_ATTEMPTS, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newSink(t, test.statuses...)
+			e := newTestEmitter(t, Sink{URL: s.server.URL, Mode: MODE_BINARY, Events: EVENT_TYPES})
+
+			err := e.send(context.TODO(), testEvent(notify.EVENT_FAILED))
+			if (err != nil) != test.wantErr {
+				t.Errorf("expected error %v, got %v", test.wantErr, err)
+			}
+			if got := s.requests.Load(); got != test.requests {
+				t.Errorf("expected %d requests, got %d", test.requests, got)
+			}
+		})
+	}
+}
+
+func TestEmitterDropsWhenQueueIsFull(t *testing.T) {
+	e := newTestEmitter(t, Sink{URL: "http://localhost", Events: []string{notify.EVENT_FAILED}})
+	dropped := testutil.ToFloat64(stats.Notifications.WithLabelValues(SINK_NAME, stats.NOTIFICATION_DROPPED))
+
+	// nothing is sent without Run, so the queue fills up
+	for range QUEUE_SIZE + 2 {
+		e.Notify(testEvent(notify.EVENT_FAILED))
+	}
+	e.Notify(testEvent(notify.EVENT_SCHEDULED)) // not emitted at all
+	if got := testutil.ToFloat64(stats.Notifications.WithLabelValues(SINK_NAME, stats.NOTIFICATION_DROPPED)) - dropped; got != 2 {
+		t.Fatalf("expected 2 dropped events, got %v", got)
+	}
+}
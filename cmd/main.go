@@ -2,127 +2,106 @@ package main
 
 import (
 	"context"
-	"errors"
-	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
-	"strconv"
-	"strings"
-	"sync"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/torbendury/gke-preemptible-sniper/api"
+	"github.com/torbendury/gke-preemptible-sniper/cloudevent"
+	"github.com/torbendury/gke-preemptible-sniper/config"
+	"github.com/torbendury/gke-preemptible-sniper/dashboard"
 	"github.com/torbendury/gke-preemptible-sniper/gcloud"
+	"github.com/torbendury/gke-preemptible-sniper/history"
 	"github.com/torbendury/gke-preemptible-sniper/k8s"
+	"github.com/torbendury/gke-preemptible-sniper/notify"
+	"github.com/torbendury/gke-preemptible-sniper/policy"
+	"github.com/torbendury/gke-preemptible-sniper/sniper"
 	"github.com/torbendury/gke-preemptible-sniper/stats"
-	"github.com/torbendury/gke-preemptible-sniper/timing"
-)
-
-var (
-	allowedTimes     timing.TimeSlots // allowed times for node delete scheduling
-	blockedTimes     timing.TimeSlots // blocked times for node delete scheduling
-	checkInterval    int              // interval in seconds for checking nodes
-	googleClient     *gcloud.Client   // Google Cloud client
-	healthy          bool             // health status
-	kubernetesClient *k8s.Client      // Kubernetes client
-	logger           *slog.Logger     // logger
-	nodeDrainTimeout int              // timeout in seconds for draining a node
-	projectID        string           // Google Cloud project ID
-	ready            bool             // readiness status
-	errorBudget      int              // error budget. If exceeded, the sniper will stop and try to recover
+	"github.com/torbendury/gke-preemptible-sniper/tracing"
+	"k8s.io/client-go/dynamic"
 )
 
 const (
-	DEFAULT_CHECK_INTERVAL = 300 // used if env CHECK_INTERVAL_SECONDS is not set or malformed
-	MIN_CHECK_INTERVAL     = 60  // minimum check interval in seconds that makes sense
-
-	ERROR_BUDGET_EXCEEDED_SLEEP = 10 * time.Second
-	INITIAL_ERROR_BUDGET        = 10
-	MAX_ERROR_BUDGET            = 10 // maximum error budget before being reset
-	MIN_ERROR_BUDGET            = 1
-
-	DEFAULT_NODE_DRAIN_TIMEOUT = 180              // used if env NODE_DRAIN_TIMEOUT_SECONDS is not set or malformed
-	MIN_NODE_DRAIN_TIMEOUT     = 45               // minimum node drain timeout in seconds that makes sense
-	NODE_DRAIN_SLEEP           = 10 * time.Second // sleep time after draining a node
-
 	STATS_UPDATE_INTERVAL = 2 * time.Minute
+	HISTORY_LOAD_TIMEOUT  = 30 * time.Second
+	TRACING_FLUSH_TIMEOUT = 10 * time.Second
 )
 
-func init() {
+func main() {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
 
-	healthy = true
-	ready = true
-	restoreErrorBudget()
-	logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
-	var err error
+	// tracing is a no-op unless configured by the OTEL_* environment variables
+	shutdownTracing, err := tracing.Setup(context.Background(), os.Getenv)
+	if !ok(err, logger, "failed to set up tracing") {
+		os.Exit(17)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), TRACING_FLUSH_TIMEOUT)
+		defer cancel()
+		ok(shutdownTracing(ctx), logger, "failed to flush traces")
+	}()
 
-	kubernetesClient, err = k8s.NewClient(nil)
+	restConfig, err := k8s.NewRestConfig()
+	if !ok(err, logger, "failed to load Kubernetes config") {
+		os.Exit(1)
+	}
+	kubernetesClient, err := k8s.NewClient(restConfig)
 	if !ok(err, logger, "failed to create Kubernetes client") {
 		os.Exit(1)
 	}
+	defer kubernetesClient.Shutdown()
 
-	googleClient, err = gcloud.NewClient(context.Background())
+	googleClient, err := gcloud.NewClient(context.Background())
 	if !ok(err, logger, "failed to create Google Cloud client") {
 		os.Exit(2)
 	}
-
-	projectID, err = gcloud.GetProjectID()
-	if !ok(err, logger, "failed to get project ID") {
-		os.Exit(3)
-	}
-
-	allowedHours := os.Getenv("ALLOWED_HOURS")
-	if allowedHours == "" {
-		logger.Error("ALLOWED_HOURS environment variable is required")
-		os.Exit(4)
-	}
-	allowedTimes, err = timing.ParseTimeSlots(strings.Split(allowedHours, ","))
-	if !ok(err, logger, "failed to parse ALLOWED_HOURS") {
-		os.Exit(5)
-	}
-
-	blockedHours := os.Getenv("BLOCKED_HOURS")
-	if blockedHours != "" {
-		blockedTimes, err = timing.ParseTimeSlots(strings.Split(blockedHours, ","))
-		if !ok(err, logger, "failed to parse BLOCKED_HOURS") {
-			os.Exit(6)
+	defer googleClient.Close()
+
+	// the configuration file is optional, without it all settings are read from the environment
+	configFile := os.Getenv("CONFIG_FILE")
+	cfg := loadConfig(configFile, logger)
+	configWatcher := config.NewWatcher(configFile, os.Getenv, cfg, logger)
+
+	var policies sniper.Policies
+	var policyWatcher *policy.Watcher
+	if cfg.SniperPolicies {
+		dynamicClient, err := dynamic.NewForConfig(restConfig)
+		if !ok(err, logger, "failed to create dynamic Kubernetes client") {
+			googleClient.Close()
+			os.Exit(1)
 		}
+		policyWatcher = policy.NewWatcher(dynamicClient, cfg.CheckInterval, logger)
+		policies = policyWatcher
 	}
 
-	checkIntervalStr := os.Getenv("CHECK_INTERVAL_SECONDS")
-	if checkIntervalStr == "" {
-		checkInterval = DEFAULT_CHECK_INTERVAL
-	} else {
-		checkInterval, err = strconv.Atoi(checkIntervalStr)
-		if !ok(err, logger, "failed to parse CHECK_INTERVAL_SECONDS") {
-			os.Exit(7)
-		}
-		if checkInterval <= MIN_CHECK_INTERVAL {
-			checkInterval = DEFAULT_CHECK_INTERVAL
-		}
-	}
+	snipeHistory := loadHistory(cfg, kubernetesClient, logger)
 
-	nodeDrainTimeoutStr := os.Getenv("NODE_DRAIN_TIMEOUT_SECONDS")
-	if nodeDrainTimeoutStr == "" {
-		nodeDrainTimeout = DEFAULT_NODE_DRAIN_TIMEOUT
-	} else {
-		nodeDrainTimeout, err = strconv.Atoi(nodeDrainTimeoutStr)
-		if !ok(err, logger, "failed to parse NODE_DRAIN_TIMEOUT_SECONDS") {
-			os.Exit(8)
+	// events are queued from the start, they are sent once the notifier and the emitter run
+	notifier := notify.New(cfg.Webhooks, logger)
+	receivers := notify.Fanout{notifier}
+	var emitter *cloudevent.Emitter
+	if cfg.CloudEvents.URL != "" {
+		emitter, err = cloudevent.New(cfg.CloudEvents, logger)
+		if !ok(err, logger, "failed to create CloudEvents emitter") {
+			googleClient.Close()
+			os.Exit(16)
 		}
-	}
-	if nodeDrainTimeout <= MIN_NODE_DRAIN_TIMEOUT {
-		nodeDrainTimeout = DEFAULT_NODE_DRAIN_TIMEOUT
+		receivers = append(receivers, emitter)
 	}
 
-	logger.Info("initialized", "project", projectID, "allowed", allowedTimes, "blocked", blockedTimes, "checkInterval", checkInterval, "nodeDrainTimeout", nodeDrainTimeout)
-}
+	s, err := sniper.New(kubernetesClient, googleClient, sniper.RealClock{}, configWatcher, policies, snipeHistory, receivers, logger)
+	if !ok(err, logger, "failed to create sniper") {
+		googleClient.Close()
+		os.Exit(13)
+	}
 
-func main() {
 	// Start web server for health checks and statistics
 	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		if healthy {
+		if s.Healthy() {
 			w.WriteHeader(http.StatusOK)
 			w.Write([]byte("ok"))
 		} else {
@@ -132,7 +111,10 @@ func main() {
 	})
 
 	http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
-		if ready {
+		if s.Ready() && s.Paused() {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("ready (paused)"))
+		} else if s.Ready() {
 			w.WriteHeader(http.StatusOK)
 			w.Write([]byte("ready"))
 		} else {
@@ -142,9 +124,12 @@ func main() {
 	})
 
 	http.Handle("/metrics", promhttp.HandlerFor(stats.Reg, promhttp.HandlerOpts{}))
+	// operator actions are disabled without token
+	http.Handle("/api/v1/", api.NewHandler(s, snipeHistory, s, os.Getenv("API_TOKEN"), logger))
+	http.Handle("GET /{$}", dashboard.NewHandler(s, snipeHistory, kubernetesClient, configWatcher, time.Now))
 
 	go func() {
-		logger.Info("starting HTTP server for health checks")
+		logger.Info("starting HTTP server for health checks, metrics, the API and the dashboard")
 		err := http.ListenAndServe(":8080", nil)
 		if !ok(err, logger, "failed to start HTTP server for health checks") {
 			googleClient.Close()
@@ -152,155 +137,113 @@ func main() {
 		}
 	}()
 
-	// background goroutine for updating prometheus metrics
-	go func() {
-		for {
-			stats.UpdateSnipedInLastHour()
-			stats.UpdateSnipesExpectedInNextHour()
-			time.Sleep(STATS_UPDATE_INTERVAL)
+	// background goroutine for updating the legacy prometheus gauges
+	if cfg.LegacyMetrics {
+		logger.Warn("the legacy metrics gke_preemptible_sniper_sniped_last_hour and gke_preemptible_sniper_snipes_expected_next_hour are deprecated and will be disabled by default in the next release, set legacyMetrics to false once your dashboards use the new metrics")
+		stats.EnableLegacyMetrics()
+		// snipes from before a restart are still part of the last hour
+		for _, entry := range snipeHistory.Entries() {
+			if entry.Result == stats.RESULT_SUCCEEDED {
+				stats.AddSnipedNode(entry.Node, entry.Sniped)
+			}
 		}
-	}()
-
-	logger.Info("starting gke-preemptible-sniper")
+		go func() {
+			for {
+				stats.UpdateSnipedInLastHour()
+				stats.UpdateSnipesExpectedInNextHour()
+				time.Sleep(STATS_UPDATE_INTERVAL)
+			}
+		}()
+	}
 
-	restoreErrorBudget()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// main loop for checking nodes.
-	for {
-		checkErrorBudget(errorBudget)
+	// background goroutine for applying changes of the configuration file
+	if configFile != "" {
+		go func() {
+			err := configWatcher.Run(ctx)
+			ok(err, logger, "failed to watch configuration file, changes are not applied", "path", configFile)
+		}()
+	}
 
-		timeout := time.Duration(checkInterval) * time.Second
-		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	// background goroutines for sending notifications to the webhooks and CloudEvents to the sink
+	go notifier.Run(ctx)
+	if emitter != nil {
+		go emitter.Run(ctx)
+	}
 
-		nodes, err := kubernetesClient.GetNodes(ctx)
-		if !ok(err, logger, "failed to get nodes") {
-			cancel()
-			continue
+	if policyWatcher != nil {
+		err = policyWatcher.Start(ctx)
+		if !ok(err, logger, "failed to watch SniperPolicies") {
+			googleClient.Close()
+			os.Exit(15)
 		}
-		logger.Info("retrieved nodes in the cluster", "amount", len(nodes))
-
-		var wg sync.WaitGroup
-
-		for _, node := range nodes {
-			wg.Add(1)
-			go func(node string) {
-				nodeCtx, nodeCancel := context.WithTimeout(ctx, timeout)
-				err := processNode(nodeCtx, node)
+	}
 
-				if !ok(err, logger, "failed to process node", "node", node) {
-					nodeCancel() // TODO check later if this is needed
-					wg.Done()
-					return
-				}
-				nodeCancel()
-				wg.Done()
-			}(node)
-		}
-		wg.Wait()
-		cancel()
-		increaseErrorBudget()
-		checkErrorBudget(errorBudget)
-		logger.Info("sleeping", "seconds", checkInterval)
-		time.Sleep(time.Duration(checkInterval) * time.Second)
+	logger.Info("starting gke-preemptible-sniper", "tracing", tracing.Enabled(os.Getenv))
+	err = s.Run(ctx)
+	if !ok(err, logger, "failed to run sniper") {
+		googleClient.Close()
+		os.Exit(14)
 	}
+	logger.Info("stopped gke-preemptible-sniper")
 }
 
-func processNode(ctx context.Context, node string) error {
-	logger.Info("checking node", "node", node)
-	hasAnnotation, err := kubernetesClient.HasNodeAnnotation(ctx, node, "gke-preemptible-sniper/timestamp")
-	if !hasAnnotation {
-		if !ok(err, logger, "failed to check sniper annotation", "error", err, "node", node) {
-			return err
-		}
-
-		preemptibleAnnotation, err := kubernetesClient.HasNodeLabel(ctx, node, "cloud.google.com/gke-preemptible")
-		if !ok(err, logger, "failed to check preemptible label", "error", err, "node", node) {
-			return err
-		}
-
-		if !preemptibleAnnotation {
-			logger.Info("skipping non-preemptible", "node", node)
-			return nil
-		}
+// loadConfig reads the configuration file and the environment. It exits if the configuration is invalid.
+func loadConfig(path string, logger *slog.Logger) sniper.Config {
+	cfg, err := config.Load(path, os.Getenv)
+	if !ok(err, logger, "failed to load configuration", "path", path) {
+		os.Exit(5)
+	}
 
-		randTime, err := timing.CreateAllowedTime(allowedTimes, blockedTimes)
-		if !ok(err, logger, "failed to create allowed time") {
-			return err
-		}
+	cfg.ProjectID, err = gcloud.GetProjectID()
+	if !ok(err, logger, "failed to get project ID") {
+		os.Exit(3)
+	}
 
-		logger.Info("adding annotation to node", "node", node, "timestamp", randTime.Format(time.RFC3339))
-		err = kubernetesClient.SetNodeAnnotation(ctx, node, "gke-preemptible-sniper/timestamp", randTime.Format(time.RFC3339))
-		if !ok(err, logger, "failed to add annotation", "error", err, "node", node) {
-			return err
+	if cfg.ClusterName == "" {
+		cfg.ClusterName, err = gcloud.GetClusterName()
+		if !ok(err, logger, "failed to get cluster name, set CLUSTER_NAME") {
+			os.Exit(10)
 		}
-	} else {
-		logger.Info("node already has annotation", "node", node)
-		// check if the node should be deleted
-		timestamp, err := kubernetesClient.GetNodeAnnotation(ctx, node, "gke-preemptible-sniper/timestamp")
-		if !ok(err, logger, "failed to get annotation", "error", err, "node", node) {
-			return err
-		}
-		layout := time.RFC3339
-		t, err := time.Parse(layout, timestamp)
-		if !ok(err, logger, "failed to parse time", "error", err, "node", node, "timestamp", timestamp) {
-			return err
-		}
-		if time.Now().After(t) {
-			logger.Info("cordoning", "node", node)
-			err = kubernetesClient.CordonNode(ctx, node)
-			if !ok(err, logger, "failed to cordon node", "error", err, "node", node) {
-				return err
-			}
-			drainCtx, drainCancel := context.WithTimeout(context.Background(), time.Duration(nodeDrainTimeout)*time.Second)
-			logger.Info("draining", "node", node)
-			err = kubernetesClient.DrainNode(drainCtx, node)
-			if !ok(err, logger, "failed to drain node", "error", err, "node", node) {
-				drainCancel()
-				return err
-			}
-			drainCancel()
-			time.Sleep(NODE_DRAIN_SLEEP)
-
-			instance, err := kubernetesClient.GetNodeLabel(ctx, node, "kubernetes.io/hostname")
-			if !ok(err, logger, "failed to get instance name", "error", err, "node", node) {
-				return err
-			}
-			if instance == "" {
-				logger.Error("instance name is empty", "node", node)
-				return errors.New("instance name is empty")
-			}
+	}
 
-			zone, err := kubernetesClient.GetNodeZone(ctx, node)
-			if !ok(err, logger, "failed to get zone", "error", err, "node", node) {
-				return err
-			}
-			if zone == "" {
-				logger.Error("zone is empty", "node", node)
-				return errors.New("zone is empty")
-			}
+	if cfg.PodNamespace == "" {
+		logger.Warn("POD_NAMESPACE environment variable is not set, cluster-wide pausing is disabled")
+	}
 
-			logger.Info("deleting instance", "instance", instance, "zone", zone, "node", node)
-			err = kubernetesClient.DeleteNode(ctx, node)
-			if !ok(err, logger, "failed to delete node", "error", err, "node", node) {
-				return err
-			}
+	logger.Info("initialized", "configFile", path, "project", cfg.ProjectID, "cluster", cfg.ClusterName, "allowed", cfg.AllowedTimes, "blocked", cfg.BlockedTimes, "checkInterval", cfg.CheckInterval, "nodeDrainTimeout", cfg.NodeDrainTimeout, "deleteMode", cfg.DeleteMode, "surge", cfg.Surge, "dryRun", cfg.DryRun, "podNamespace", cfg.PodNamespace, "excludedNodePools", cfg.ExcludedNodePools, "excludedNodeLabels", cfg.ExcludedNodeLabels, "maxSnipesPerHour", cfg.MaxSnipesPerHour, "maxConcurrentSnipes", cfg.MaxConcurrentSnipes, "sniperPolicies", cfg.SniperPolicies, "legacyMetrics", cfg.LegacyMetrics, "historyConfigMap", cfg.HistoryConfigMap, "historyFile", cfg.HistoryFile, "webhooks", webhookNames(cfg.Webhooks), "cloudEventsSink", cfg.CloudEvents.URL, "cloudEventsMode", cfg.CloudEvents.Mode)
+	return cfg
+}
 
-			err = googleClient.DeleteInstance(ctx, projectID, zone, instance)
-			if !ok(err, logger, "failed to delete instance", "error", err, "instance", instance, "zone", zone, "project", projectID, "node", node) {
-				return err
-			}
-			logger.Info("deleted instance", "instance", instance, "zone", zone, "project", projectID, "node", node)
-			stats.AddSnipedNode(instance, time.Now())
-		} else {
-			duration := time.Until(t)
-			logger.Info("node has time to live left", "node", node, "left", fmt.Sprintf("%vh%vm", int(duration.Hours()), int(duration.Minutes())%60))
+// webhookNames returns the names of the webhooks for logging, their URLs usually contain secrets.
+func webhookNames(webhooks []notify.Webhook) []string {
+	names := make([]string, 0, len(webhooks))
+	for _, webhook := range webhooks {
+		names = append(names, webhook.Name)
+	}
+	return names
+}
 
-			if time.Now().Add(time.Hour).After(t) {
-				stats.AddExpectedSnipe(node, t)
-			}
-		}
+// loadHistory creates the snipe history and loads it from the configured storage. Errors start with an empty history.
+func loadHistory(cfg sniper.Config, kubernetesClient *k8s.Client, logger *slog.Logger) *history.History {
+	var store history.Store
+	switch {
+	case cfg.HistoryConfigMap != "":
+		store = history.ConfigMapStore{Client: kubernetesClient, Namespace: cfg.PodNamespace, Name: cfg.HistoryConfigMap}
+	case cfg.HistoryFile != "":
+		store = history.FileStore{Path: cfg.HistoryFile}
+	default:
+		logger.Info("no history storage configured, the snipe history is lost on restart")
 	}
-	return nil
+
+	snipeHistory := history.New(store, time.Now)
+	ctx, cancel := context.WithTimeout(context.Background(), HISTORY_LOAD_TIMEOUT)
+	defer cancel()
+	err := snipeHistory.Load(ctx)
+	ok(err, logger, "failed to load snipe history, starting with an empty one", "configMap", cfg.HistoryConfigMap, "file", cfg.HistoryFile)
+	return snipeHistory
 }
 
 func ok(err error, logger *slog.Logger, message string, loginfo ...any) bool {
@@ -308,36 +251,7 @@ func ok(err error, logger *slog.Logger, message string, loginfo ...any) bool {
 	loginfo = append(loginfo, "error", err)
 	if err != nil {
 		logger.Error(message, loginfo...)
-		decreaseErrorBudget()
 		return false
 	}
 	return true
 }
-
-func checkErrorBudget(errorBudget int) {
-	if errorBudget > MAX_ERROR_BUDGET {
-		restoreErrorBudget()
-	}
-	if errorBudget <= MIN_ERROR_BUDGET {
-		logger.Warn("error budget exceeded, trying to recover")
-		healthy = false
-		ready = false
-		time.Sleep(ERROR_BUDGET_EXCEEDED_SLEEP)
-		increaseErrorBudget()
-	} else {
-		healthy = true
-		ready = true
-	}
-}
-
-func decreaseErrorBudget() {
-	errorBudget--
-}
-
-func increaseErrorBudget() {
-	errorBudget++
-}
-
-func restoreErrorBudget() {
-	errorBudget = INITIAL_ERROR_BUDGET
-}
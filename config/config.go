@@ -0,0 +1,361 @@
+// Package config loads the configuration of gke-preemptible-sniper from a YAML file and environment variables.
+// The file is validated strictly, unknown fields and invalid values are errors instead of being replaced by defaults.
+// Environment variables which are set override the values of the file.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/torbendury/gke-preemptible-sniper/cloudevent"
+	"github.com/torbendury/gke-preemptible-sniper/notify"
+	"github.com/torbendury/gke-preemptible-sniper/sniper"
+	"github.com/torbendury/gke-preemptible-sniper/timing"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	DEFAULT_CHECK_INTERVAL = 300 // used if the check interval is not configured
+	MIN_CHECK_INTERVAL     = 60  // minimum check interval in seconds that makes sense
+
+	DEFAULT_NODE_DRAIN_TIMEOUT = 180 // used if the node drain timeout is not configured
+	MIN_NODE_DRAIN_TIMEOUT     = 45  // minimum node drain timeout in seconds that makes sense
+)
+
+// File is the content of the configuration file.
+type File struct {
+	ClusterName    string        `json:"clusterName,omitempty"`    // read from the metadata server if empty
+	SniperPolicies bool          `json:"sniperPolicies,omitempty"` // watch SniperPolicy resources, requires the CustomResourceDefinition
+	LegacyMetrics  *bool         `json:"legacyMetrics,omitempty"`  // expose the gauges which were replaced by counters and histograms, enabled if unset
+	Schedule       Schedule      `json:"schedule"`
+	Policy         Policy        `json:"policy"`
+	Exclusions     Exclusions    `json:"exclusions"`
+	Limits         Limits        `json:"limits"`
+	History        History       `json:"history"`
+	Notifications  Notifications `json:"notifications"`
+	CloudEvents    CloudEvents   `json:"cloudEvents"`
+}
+
+// Schedule describes when nodes may be sniped and how often they are checked.
+type Schedule struct {
+	Allowed              []string `json:"allowed"`                        // time slots in which nodes may be sniped, e.g. "08:00-16:00"
+	Blocked              []string `json:"blocked,omitempty"`              // time slots in which nodes must not be sniped
+	CheckIntervalSeconds int      `json:"checkIntervalSeconds,omitempty"` // interval for checking all nodes again
+}
+
+// Policy describes how nodes are sniped.
+type Policy struct {
+	DeleteMode              string `json:"deleteMode,omitempty"` // one of "instance", "mig-delete", "mig-recreate"
+	SurgeReplacement        bool   `json:"surgeReplacement,omitempty"`
+	DryRun                  bool   `json:"dryRun,omitempty"`
+	NodeDrainTimeoutSeconds int    `json:"nodeDrainTimeoutSeconds,omitempty"`
+}
+
+// Exclusions describes nodes which are never sniped.
+type Exclusions struct {
+	NodePools  []string          `json:"nodePools,omitempty"`
+	NodeLabels map[string]string `json:"nodeLabels,omitempty"` // nodes with any of these labels are excluded
+}
+
+// Limits describes how many nodes may be sniped.
+type Limits struct {
+	MaxSnipesPerHour    int `json:"maxSnipesPerHour,omitempty"`    // 0 for no limit
+	MaxConcurrentSnipes int `json:"maxConcurrentSnipes,omitempty"` // 0 for no limit
+}
+
+// History describes where the snipe history is persisted. Without both, it is kept in memory only.
+type History struct {
+	ConfigMap string `json:"configMap,omitempty"` // name of a ConfigMap in the namespace of the sniper
+	File      string `json:"file,omitempty"`      // path of a file, e.g. on a mounted volume
+}
+
+// Notifications describes the webhooks which are notified about snipes.
+type Notifications struct {
+	Webhooks []Webhook `json:"webhooks,omitempty"`
+}
+
+// Webhook describes a receiver of notifications. Its URL is read from the environment variable URLEnv if set, to keep it out of the file.
+type Webhook struct {
+	Name   string   `json:"name"`
+	URL    string   `json:"url,omitempty"`
+	URLEnv string   `json:"urlEnv,omitempty"`
+	Format string   `json:"format,omitempty"` // one of "generic", "slack", "teams"
+	Events []string `json:"events,omitempty"` // defaults to "started" and "failed"
+}
+
+// CloudEvents describes the sink which receives the lifecycle of snipes as CloudEvents. Without sink, none are emitted.
+type CloudEvents struct {
+	Sink   string   `json:"sink,omitempty"`   // HTTP URL of the sink, e.g. a broker
+	Mode   string   `json:"mode,omitempty"`   // either "binary" or "structured"
+	Events []string `json:"events,omitempty"` // defaults to all of "scheduled", "cordoned", "drained", "deleted", "failed"
+}
+
+// Parse parses the content of a configuration file. Unknown fields are errors.
+func Parse(data []byte) (File, error) {
+	var file File
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return File{}, fmt.Errorf("invalid configuration file: %w", err)
+	}
+	return file, nil
+}
+
+// Load reads the configuration file at the provided path, applies the environment variables and validates the result.
+// Without path, the configuration is read from the environment variables only.
+func Load(path string, getenv func(string) string) (sniper.Config, error) {
+	var file File
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return sniper.Config{}, fmt.Errorf("failed to read configuration file: %w", err)
+		}
+		file, err = Parse(data)
+		if err != nil {
+			return sniper.Config{}, err
+		}
+	}
+
+	if err := applyEnv(&file, getenv); err != nil {
+		return sniper.Config{}, err
+	}
+	config, err := file.Validate()
+	if err != nil {
+		return sniper.Config{}, err
+	}
+	config.PodNamespace = getenv("POD_NAMESPACE")
+	if config.HistoryConfigMap != "" && config.PodNamespace == "" {
+		return sniper.Config{}, errors.New("invalid configuration: history.configMap: requires POD_NAMESPACE")
+	}
+	return config, nil
+}
+
+// applyEnv overrides the values of the file with the environment variables which are set.
+func applyEnv(file *File, getenv func(string) string) error {
+	var errs []error
+	if value := getenv("CLUSTER_NAME"); value != "" {
+		file.ClusterName = value
+	}
+	if value := getenv("ALLOWED_HOURS"); value != "" {
+		file.Schedule.Allowed = strings.Split(value, ",")
+	}
+	if value := getenv("BLOCKED_HOURS"); value != "" {
+		file.Schedule.Blocked = strings.Split(value, ",")
+	}
+	if value := getenv("CHECK_INTERVAL_SECONDS"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("CHECK_INTERVAL_SECONDS: %q is not a number", value))
+		}
+		file.Schedule.CheckIntervalSeconds = seconds
+	}
+	if value := getenv("NODE_DRAIN_TIMEOUT_SECONDS"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("NODE_DRAIN_TIMEOUT_SECONDS: %q is not a number", value))
+		}
+		file.Policy.NodeDrainTimeoutSeconds = seconds
+	}
+	if value := getenv("DELETE_MODE"); value != "" {
+		file.Policy.DeleteMode = value
+	}
+	if value := getenv("SURGE_REPLACEMENT"); value != "" {
+		surge, err := strconv.ParseBool(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("SURGE_REPLACEMENT: %q is not a boolean", value))
+		}
+		file.Policy.SurgeReplacement = surge
+	}
+	if value := getenv("SNIPER_POLICIES"); value != "" {
+		policies, err := strconv.ParseBool(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("SNIPER_POLICIES: %q is not a boolean", value))
+		}
+		file.SniperPolicies = policies
+	}
+	if value := getenv("LEGACY_METRICS"); value != "" {
+		legacy, err := strconv.ParseBool(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("LEGACY_METRICS: %q is not a boolean", value))
+		}
+		file.LegacyMetrics = &legacy
+	}
+	if value := getenv("HISTORY_CONFIGMAP"); value != "" {
+		file.History.ConfigMap = value
+	}
+	if value := getenv("HISTORY_FILE"); value != "" {
+		file.History.File = value
+	}
+	for i, webhook := range file.Notifications.Webhooks {
+		if webhook.URLEnv != "" {
+			file.Notifications.Webhooks[i].URL = getenv(webhook.URLEnv)
+		}
+	}
+	if value := getenv("CLOUDEVENTS_SINK"); value != "" {
+		file.CloudEvents.Sink = value
+	}
+	if value := getenv("CLOUDEVENTS_MODE"); value != "" {
+		file.CloudEvents.Mode = value
+	}
+	if value := getenv("DRY_RUN"); value != "" {
+		dryRun, err := strconv.ParseBool(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("DRY_RUN: %q is not a boolean", value))
+		}
+		file.Policy.DryRun = dryRun
+	}
+	return errors.Join(errs...)
+}
+
+// Validate checks all values of the file and converts it into the configuration of the sniper.
+// All invalid values are reported at once, each prefixed with the path of its field.
+func (f File) Validate() (sniper.Config, error) {
+	var errs []error
+	config := sniper.Config{
+		ClusterName:         f.ClusterName,
+		SniperPolicies:      f.SniperPolicies,
+		LegacyMetrics:       f.LegacyMetrics == nil || *f.LegacyMetrics,
+		HistoryConfigMap:    f.History.ConfigMap,
+		HistoryFile:         f.History.File,
+		DryRun:              f.Policy.DryRun,
+		Surge:               f.Policy.SurgeReplacement,
+		ExcludedNodePools:   f.Exclusions.NodePools,
+		ExcludedNodeLabels:  f.Exclusions.NodeLabels,
+		MaxSnipesPerHour:    f.Limits.MaxSnipesPerHour,
+		MaxConcurrentSnipes: f.Limits.MaxConcurrentSnipes,
+	}
+
+	var err error
+	if len(f.Schedule.Allowed) == 0 {
+		errs = append(errs, errors.New("schedule.allowed: at least one time slot is required (env ALLOWED_HOURS)"))
+	} else if config.AllowedTimes, err = timing.ParseTimeSlots(f.Schedule.Allowed); err != nil {
+		errs = append(errs, fmt.Errorf("schedule.allowed: %w", err))
+	}
+	if len(f.Schedule.Blocked) > 0 {
+		if config.BlockedTimes, err = timing.ParseTimeSlots(f.Schedule.Blocked); err != nil {
+			errs = append(errs, fmt.Errorf("schedule.blocked: %w", err))
+		}
+	}
+
+	checkInterval := f.Schedule.CheckIntervalSeconds
+	if checkInterval == 0 {
+		checkInterval = DEFAULT_CHECK_INTERVAL
+	} else if checkInterval < MIN_CHECK_INTERVAL {
+		errs = append(errs, fmt.Errorf("schedule.checkIntervalSeconds: %d is less than the minimum of %d", checkInterval, MIN_CHECK_INTERVAL))
+	}
+	config.CheckInterval = time.Duration(checkInterval) * time.Second
+
+	nodeDrainTimeout := f.Policy.NodeDrainTimeoutSeconds
+	if nodeDrainTimeout == 0 {
+		nodeDrainTimeout = DEFAULT_NODE_DRAIN_TIMEOUT
+	} else if nodeDrainTimeout < MIN_NODE_DRAIN_TIMEOUT {
+		errs = append(errs, fmt.Errorf("policy.nodeDrainTimeoutSeconds: %d is less than the minimum of %d", nodeDrainTimeout, MIN_NODE_DRAIN_TIMEOUT))
+	}
+	config.NodeDrainTimeout = time.Duration(nodeDrainTimeout) * time.Second
+
+	config.DeleteMode = f.Policy.DeleteMode
+	switch config.DeleteMode {
+	case "":
+		config.DeleteMode = sniper.DELETE_MODE_INSTANCE
+		if config.Surge {
+			// deleting through the group is what shrinks it back to its original size after a surge
+			config.DeleteMode = sniper.DELETE_MODE_GROUP_DELETE
+		}
+	case sniper.DELETE_MODE_INSTANCE, sniper.DELETE_MODE_GROUP_RECREATE:
+		if config.Surge {
+			errs = append(errs, fmt.Errorf("policy.deleteMode: surge replacement requires %q, got %q", sniper.DELETE_MODE_GROUP_DELETE, config.DeleteMode))
+		}
+	case sniper.DELETE_MODE_GROUP_DELETE:
+	default:
+		errs = append(errs, fmt.Errorf("policy.deleteMode: %q is not one of %q, %q, %q", config.DeleteMode, sniper.DELETE_MODE_INSTANCE, sniper.DELETE_MODE_GROUP_DELETE, sniper.DELETE_MODE_GROUP_RECREATE))
+	}
+
+	for i, pool := range f.Exclusions.NodePools {
+		if pool == "" {
+			errs = append(errs, fmt.Errorf("exclusions.nodePools[%d]: node pool name must not be empty", i))
+		}
+	}
+	for key := range f.Exclusions.NodeLabels {
+		if key == "" {
+			errs = append(errs, errors.New("exclusions.nodeLabels: label key must not be empty"))
+		}
+	}
+
+	if f.Limits.MaxSnipesPerHour < 0 {
+		errs = append(errs, fmt.Errorf("limits.maxSnipesPerHour: %d must not be negative", f.Limits.MaxSnipesPerHour))
+	}
+	if f.Limits.MaxConcurrentSnipes < 0 {
+		errs = append(errs, fmt.Errorf("limits.maxConcurrentSnipes: %d must not be negative", f.Limits.MaxConcurrentSnipes))
+	}
+
+	if f.History.ConfigMap != "" && f.History.File != "" {
+		errs = append(errs, errors.New("history: configMap and file must not be set both"))
+	}
+
+	names := make(map[string]bool)
+	for i, webhook := range f.Notifications.Webhooks {
+		field := fmt.Sprintf("notifications.webhooks[%d]", i)
+		if webhook.Name == "" {
+			errs = append(errs, fmt.Errorf("%s.name: must not be empty", field))
+		} else if names[webhook.Name] {
+			errs = append(errs, fmt.Errorf("%s.name: %q is used more than once", field, webhook.Name))
+		}
+		names[webhook.Name] = true
+
+		// the URL is not part of the errors, it usually contains a secret
+		if webhook.URL == "" && webhook.URLEnv != "" {
+			errs = append(errs, fmt.Errorf("%s.urlEnv: environment variable %s is empty", field, webhook.URLEnv))
+		} else if u, err := url.Parse(webhook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("%s.url: must be an http or https URL", field))
+		}
+
+		format := webhook.Format
+		switch format {
+		case "":
+			format = notify.FORMAT_GENERIC
+		case notify.FORMAT_GENERIC, notify.FORMAT_SLACK, notify.FORMAT_TEAMS:
+		default:
+			errs = append(errs, fmt.Errorf("%s.format: %q is not one of %q, %q, %q", field, format, notify.FORMAT_GENERIC, notify.FORMAT_SLACK, notify.FORMAT_TEAMS))
+		}
+
+		events := webhook.Events
+		if len(events) == 0 {
+			events = notify.DEFAULT_EVENTS
+		}
+		for _, event := range events {
+			if !slices.Contains(notify.EVENT_TYPES, event) {
+				errs = append(errs, fmt.Errorf("%s.events: %q is not one of %q", field, event, notify.EVENT_TYPES))
+			}
+		}
+		config.Webhooks = append(config.Webhooks, notify.Webhook{Name: webhook.Name, URL: webhook.URL, Format: format, Events: events})
+	}
+
+	config.CloudEvents = cloudevent.Sink{URL: f.CloudEvents.Sink, Mode: f.CloudEvents.Mode, Events: f.CloudEvents.Events}
+	if u, err := url.Parse(f.CloudEvents.Sink); f.CloudEvents.Sink != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+		errs = append(errs, errors.New("cloudEvents.sink: must be an http or https URL (env CLOUDEVENTS_SINK)"))
+	}
+	switch config.CloudEvents.Mode {
+	case "":
+		config.CloudEvents.Mode = cloudevent.MODE_BINARY
+	case cloudevent.MODE_BINARY, cloudevent.MODE_STRUCTURED:
+	default:
+		errs = append(errs, fmt.Errorf("cloudEvents.mode: %q is not one of %q, %q", config.CloudEvents.Mode, cloudevent.MODE_BINARY, cloudevent.MODE_STRUCTURED))
+	}
+	if len(config.CloudEvents.Events) == 0 {
+		config.CloudEvents.Events = cloudevent.EVENT_TYPES
+	}
+	for _, event := range config.CloudEvents.Events {
+		if !slices.Contains(cloudevent.EVENT_TYPES, event) {
+			errs = append(errs, fmt.Errorf("cloudEvents.events: %q is not one of %q", event, cloudevent.EVENT_TYPES))
+		}
+	}
+
+	if len(errs) > 0 {
+		return sniper.Config{}, fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+	}
+	return config, nil
+}
@@ -0,0 +1,320 @@
+package config
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/torbendury/gke-preemptible-sniper/cloudevent"
+	"github.com/torbendury/gke-preemptible-sniper/notify"
+	"github.com/torbendury/gke-preemptible-sniper/sniper"
+)
+
+func env(values map[string]string) func(string) string {
+	return func(key string) string { return values[key] }
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		wantErr []string
+		check   func(t *testing.T, config sniper.Config)
+	}{
+		{
+			name: "full file",
+			file: `
+clusterName: test-cluster
+schedule:
+  allowed: ["08:00-16:00"]
+  blocked: ["12:00-13:00"]
+  checkIntervalSeconds: 120
+policy:
+  deleteMode: mig-recreate
+  nodeDrainTimeoutSeconds: 60
+exclusions:
+  nodePools: ["critical"]
+  nodeLabels:
+    example.com/no-snipe: "true"
+limits:
+  maxSnipesPerHour: 5
+  maxConcurrentSnipes: 1
+history:
+  configMap: sniper-history
+`,
+			env: map[string]string{"POD_NAMESPACE": "sniper"},
+			check: func(t *testing.T, config sniper.Config) {
+				if config.ClusterName != "test-cluster" || config.PodNamespace != "sniper" {
+					t.Errorf("unexpected cluster %q or namespace %q", config.ClusterName, config.PodNamespace)
+				}
+				if len(config.AllowedTimes) != 1 || len(config.BlockedTimes) != 1 {
+					t.Errorf("expected one allowed and one blocked slot, got %v and %v", config.AllowedTimes, config.BlockedTimes)
+				}
+				if config.CheckInterval != 2*time.Minute || config.NodeDrainTimeout != time.Minute {
+					t.Errorf("unexpected check interval %s or drain timeout %s", config.CheckInterval, config.NodeDrainTimeout)
+				}
+				if config.DeleteMode != sniper.DELETE_MODE_GROUP_RECREATE {
+					t.Errorf("expected delete mode %q, got %q", sniper.DELETE_MODE_GROUP_RECREATE, config.DeleteMode)
+				}
+				if len(config.ExcludedNodePools) != 1 || config.ExcludedNodeLabels["example.com/no-snipe"] != "true" {
+					t.Errorf("unexpected exclusions %v and %v", config.ExcludedNodePools, config.ExcludedNodeLabels)
+				}
+				if config.MaxSnipesPerHour != 5 || config.MaxConcurrentSnipes != 1 {
+					t.Errorf("unexpected limits %d and %d", config.MaxSnipesPerHour, config.MaxConcurrentSnipes)
+				}
+				if config.HistoryConfigMap != "sniper-history" {
+					t.Errorf("unexpected history ConfigMap %q", config.HistoryConfigMap)
+				}
+			},
+		},
+		{
+			name: "defaults",
+			env:  map[string]string{"ALLOWED_HOURS": "00:00-23:59"},
+			check: func(t *testing.T, config sniper.Config) {
+				if config.CheckInterval != DEFAULT_CHECK_INTERVAL*time.Second || config.NodeDrainTimeout != DEFAULT_NODE_DRAIN_TIMEOUT*time.Second {
+					t.Errorf("expected default durations, got %s and %s", config.CheckInterval, config.NodeDrainTimeout)
+				}
+				if config.DeleteMode != sniper.DELETE_MODE_INSTANCE {
+					t.Errorf("expected delete mode %q, got %q", sniper.DELETE_MODE_INSTANCE, config.DeleteMode)
+				}
+				if !config.LegacyMetrics {
+					t.Errorf("expected legacy metrics to be enabled by default")
+				}
+			},
+		},
+		{
+			name: "legacy metrics disabled",
+			file: "legacyMetrics: false\nschedule:\n  allowed: [\"08:00-16:00\"]\n",
+			check: func(t *testing.T, config sniper.Config) {
+				if config.LegacyMetrics {
+					t.Errorf("expected legacy metrics to be disabled")
+				}
+			},
+		},
+		{
+			name: "environment overrides file",
+			file: `
+schedule:
+  allowed: ["08:00-16:00"]
+policy:
+  dryRun: false
+`,
+			env: map[string]string{"ALLOWED_HOURS": "01:00-02:00,03:00-04:00", "DRY_RUN": "true", "CHECK_INTERVAL_SECONDS": "90"},
+			check: func(t *testing.T, config sniper.Config) {
+				if len(config.AllowedTimes) != 2 || !config.DryRun || config.CheckInterval != 90*time.Second {
+					t.Errorf("expected environment to override the file, got %+v", config)
+				}
+			},
+		},
+		{
+			name: "surge implies mig-delete",
+			env:  map[string]string{"ALLOWED_HOURS": "00:00-23:59", "SURGE_REPLACEMENT": "true"},
+			check: func(t *testing.T, config sniper.Config) {
+				if config.DeleteMode != sniper.DELETE_MODE_GROUP_DELETE {
+					t.Errorf("expected delete mode %q, got %q", sniper.DELETE_MODE_GROUP_DELETE, config.DeleteMode)
+				}
+			},
+		},
+		{
+			name:    "unknown field",
+			file:    "schedule:\n  allowed: [\"08:00-16:00\"]\n  alowed: []\n",
+			wantErr: []string{"alowed"},
+		},
+		{
+			name:    "missing schedule",
+			file:    "policy:\n  dryRun: true\n",
+			wantErr: []string{"schedule.allowed"},
+		},
+		{
+			name: "all errors are reported",
+			file: `
+schedule:
+  allowed: ["8-16"]
+  checkIntervalSeconds: 10
+policy:
+  deleteMode: everything
+  nodeDrainTimeoutSeconds: 5
+limits:
+  maxSnipesPerHour: -1
+`,
+			wantErr: []string{"schedule.allowed", "schedule.checkIntervalSeconds", "policy.deleteMode", "policy.nodeDrainTimeoutSeconds", "limits.maxSnipesPerHour"},
+		},
+		{
+			name:    "surge with conflicting delete mode",
+			file:    "schedule:\n  allowed: [\"08:00-16:00\"]\npolicy:\n  deleteMode: instance\n  surgeReplacement: true\n",
+			wantErr: []string{"policy.deleteMode"},
+		},
+		{
+			name:    "history in ConfigMap and file",
+			file:    "schedule:\n  allowed: [\"08:00-16:00\"]\nhistory:\n  configMap: history\n",
+			env:     map[string]string{"POD_NAMESPACE": "sniper", "HISTORY_FILE": "/var/lib/sniper/history.json"},
+			wantErr: []string{"history"},
+		},
+		{
+			name:    "history in ConfigMap without namespace",
+			env:     map[string]string{"ALLOWED_HOURS": "00:00-23:59", "HISTORY_CONFIGMAP": "history"},
+			wantErr: []string{"POD_NAMESPACE"},
+		},
+		{
+			name: "webhooks",
+			file: `
+schedule:
+  allowed: ["08:00-16:00"]
+notifications:
+  webhooks:
+    - name: chat
+      urlEnv: SLACK_WEBHOOK_URL
+      format: slack
+    - name: audit
+      url: https://audit.example.com/snipes
+      events: ["scheduled", "deleted", "failed"]
+`,
+			env: map[string]string{"SLACK_WEBHOOK_URL": "https://hooks.slack.com/services/secret"},
+			check: func(t *testing.T, config sniper.Config) {
+				if len(config.Webhooks) != 2 {
+					t.Fatalf("expected 2 webhooks, got %+v", config.Webhooks)
+				}
+				chat, audit := config.Webhooks[0], config.Webhooks[1]
+				if chat.URL != "https://hooks.slack.com/services/secret" || chat.Format != notify.FORMAT_SLACK || !slices.Equal(chat.Events, notify.DEFAULT_EVENTS) {
+					t.Errorf("unexpected webhook %+v", chat)
+				}
+				if audit.Format != notify.FORMAT_GENERIC || len(audit.Events) != 3 {
+					t.Errorf("unexpected webhook %+v", audit)
+				}
+			},
+		},
+		{
+			name: "invalid webhooks",
+			file: `
+schedule:
+  allowed: ["08:00-16:00"]
+notifications:
+  webhooks:
+    - name: chat
+      urlEnv: SLACK_WEBHOOK_URL
+    - name: chat
+      url: ftp://example.com
+      format: irc
+      events: ["exploded"]
+`,
+			wantErr: []string{"webhooks[0].urlEnv", "webhooks[1].name", "webhooks[1].url", "webhooks[1].format", "webhooks[1].events"},
+		},
+		{
+			name: "CloudEvents",
+			file: "schedule:\n  allowed: [\"08:00-16:00\"]\ncloudEvents:\n  mode: structured\n  events: [\"deleted\", \"failed\"]\n",
+			env:  map[string]string{"CLOUDEVENTS_SINK": "http://broker-ingress.knative-eventing.svc/default/default"},
+			check: func(t *testing.T, config sniper.Config) {
+				if config.CloudEvents.URL == "" || config.CloudEvents.Mode != cloudevent.MODE_STRUCTURED || len(config.CloudEvents.Events) != 2 {
+					t.Errorf("unexpected CloudEvents sink %+v", config.CloudEvents)
+				}
+			},
+		},
+		{
+			name: "CloudEvents defaults",
+			env:  map[string]string{"ALLOWED_HOURS": "00:00-23:59"},
+			check: func(t *testing.T, config sniper.Config) {
+				if config.CloudEvents.URL != "" || config.CloudEvents.Mode != cloudevent.MODE_BINARY || !slices.Equal(config.CloudEvents.Events, cloudevent.EVENT_TYPES) {
+					t.Errorf("unexpected CloudEvents sink %+v", config.CloudEvents)
+				}
+			},
+		},
+		{
+			name:    "invalid CloudEvents",
+			file:    "schedule:\n  allowed: [\"08:00-16:00\"]\ncloudEvents:\n  sink: broker\n  mode: batched\n  events: [\"started\"]\n",
+			wantErr: []string{"cloudEvents.sink", "cloudEvents.mode", "cloudEvents.events"},
+		},
+		{
+			name:    "malformed environment",
+			env:     map[string]string{"ALLOWED_HOURS": "00:00-23:59", "DRY_RUN": "maybe"},
+			wantErr: []string{"DRY_RUN"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := ""
+			if test.file != "" {
+				path = filepath.Join(t.TempDir(), "config.yaml")
+				writeFile(t, path, test.file)
+			}
+
+			config, err := Load(path, env(test.env))
+			if len(test.wantErr) > 0 {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", config)
+				}
+				for _, want := range test.wantErr {
+					if !strings.Contains(err.Error(), want) {
+						t.Errorf("expected error to mention %q, got %v", want, err)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			test.check(t, config)
+		})
+	}
+}
+
+func TestWatcherReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeFile(t, path, "schedule:\n  allowed: [\"08:00-16:00\"]\n")
+	initial, err := Load(path, env(nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	initial.ProjectID = "test-project"
+	initial.ClusterName = "test-cluster"
+
+	w := NewWatcher(path, env(nil), initial, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	waitFor := func(condition func(sniper.Config) bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !condition(w.Config()) {
+			if time.Now().After(deadline) {
+				t.Fatalf("configuration was not reloaded, got %+v", w.Config())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// give the watcher time to start watching before the file changes
+	time.Sleep(100 * time.Millisecond)
+	writeFile(t, path, "schedule:\n  allowed: [\"08:00-16:00\"]\n  checkIntervalSeconds: 600\nlimits:\n  maxSnipesPerHour: 2\n")
+	waitFor(func(config sniper.Config) bool { return config.MaxSnipesPerHour == 2 })
+
+	config := w.Config()
+	if config.ProjectID != "test-project" || config.ClusterName != "test-cluster" {
+		t.Errorf("expected runtime settings to be kept, got project %q and cluster %q", config.ProjectID, config.ClusterName)
+	}
+	if config.CheckInterval != initial.CheckInterval {
+		t.Errorf("expected check interval to require a restart, got %s", config.CheckInterval)
+	}
+
+	// an invalid file keeps the last valid configuration
+	writeFile(t, path, "limits:\n  maxSnipesPerHour: -1\n")
+	time.Sleep(200 * time.Millisecond)
+	if w.Config().MaxSnipesPerHour != 2 {
+		t.Errorf("expected invalid configuration to be ignored, got %+v", w.Config())
+	}
+}
@@ -0,0 +1,121 @@
+package config
+
+import (
+	"context"
+	"log/slog"
+	"path/filepath"
+	"reflect"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/torbendury/gke-preemptible-sniper/sniper"
+)
+
+// Watcher provides the configuration of the sniper and reloads it whenever the configuration file changes.
+// Invalid files are logged and ignored, the last valid configuration stays in place.
+type Watcher struct {
+	path   string
+	getenv func(string) string
+	logger *slog.Logger
+
+	mu     sync.RWMutex
+	config sniper.Config
+}
+
+var _ sniper.ConfigProvider = (*Watcher)(nil)
+
+// NewWatcher creates a Watcher for the configuration file at the provided path, starting with the initial configuration.
+func NewWatcher(path string, getenv func(string) string, initial sniper.Config, logger *slog.Logger) *Watcher {
+	return &Watcher{
+		path:   path,
+		getenv: getenv,
+		logger: logger,
+		config: initial,
+	}
+}
+
+// Config returns the current configuration.
+func (w *Watcher) Config() sniper.Config {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.config
+}
+
+// Run watches the configuration file until the context is done.
+// The directory is watched instead of the file, since Kubernetes replaces mounted ConfigMaps by swapping a symlink.
+func (w *Watcher) Run(ctx context.Context) error {
+	fsWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer fsWatcher.Close()
+	if err := fsWatcher.Add(filepath.Dir(w.path)); err != nil {
+		return err
+	}
+
+	base := filepath.Base(w.path)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event := <-fsWatcher.Events:
+			// ConfigMap updates only show up as changes of the ..data symlink
+			if name := filepath.Base(event.Name); name != base && name != "..data" {
+				continue
+			}
+			if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) || event.Has(fsnotify.Rename) {
+				w.Reload()
+			}
+		case err := <-fsWatcher.Errors:
+			w.logger.Error("failed to watch configuration file", "path", w.path, "error", err)
+		}
+	}
+}
+
+// Reload reads the configuration file again and applies it if it is valid.
+// Settings which are only read at startup keep their values until the sniper is restarted.
+func (w *Watcher) Reload() {
+	config, err := Load(w.path, w.getenv)
+	if err != nil {
+		w.logger.Error("failed to reload configuration, keeping the current one", "path", w.path, "error", err)
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	current := w.config
+	config.ProjectID = current.ProjectID
+	if config.ClusterName == "" {
+		config.ClusterName = current.ClusterName
+	}
+	if config.DryRun != current.DryRun {
+		w.logger.Warn("changing dry-run mode requires a restart, keeping the current value", "dryRun", current.DryRun)
+		config.DryRun = current.DryRun
+	}
+	if config.SniperPolicies != current.SniperPolicies {
+		w.logger.Warn("enabling or disabling SniperPolicies requires a restart, keeping the current value", "sniperPolicies", current.SniperPolicies)
+		config.SniperPolicies = current.SniperPolicies
+	}
+	if config.LegacyMetrics != current.LegacyMetrics {
+		w.logger.Warn("enabling or disabling the legacy metrics requires a restart, keeping the current value", "legacyMetrics", current.LegacyMetrics)
+		config.LegacyMetrics = current.LegacyMetrics
+	}
+	if config.HistoryConfigMap != current.HistoryConfigMap || config.HistoryFile != current.HistoryFile {
+		w.logger.Warn("changing the history storage requires a restart, keeping the current value", "historyConfigMap", current.HistoryConfigMap, "historyFile", current.HistoryFile)
+		config.HistoryConfigMap, config.HistoryFile = current.HistoryConfigMap, current.HistoryFile
+	}
+	if !reflect.DeepEqual(config.Webhooks, current.Webhooks) {
+		w.logger.Warn("changing the webhooks requires a restart, keeping the current ones", "webhooks", len(current.Webhooks))
+		config.Webhooks = current.Webhooks
+	}
+	if !reflect.DeepEqual(config.CloudEvents, current.CloudEvents) {
+		w.logger.Warn("changing the CloudEvents sink requires a restart, keeping the current one", "cloudEventsSink", current.CloudEvents.URL)
+		config.CloudEvents = current.CloudEvents
+	}
+	if config.CheckInterval != current.CheckInterval {
+		w.logger.Warn("changing the check interval requires a restart, keeping the current value", "checkInterval", current.CheckInterval)
+		config.CheckInterval = current.CheckInterval
+	}
+	w.config = config
+	w.logger.Info("reloaded configuration", "path", w.path, "allowed", config.AllowedTimes, "blocked", config.BlockedTimes, "nodeDrainTimeout", config.NodeDrainTimeout, "deleteMode", config.DeleteMode, "surge", config.Surge, "excludedNodePools", config.ExcludedNodePools, "excludedNodeLabels", config.ExcludedNodeLabels, "maxSnipesPerHour", config.MaxSnipesPerHour, "maxConcurrentSnipes", config.MaxConcurrentSnipes)
+}
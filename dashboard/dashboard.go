@@ -0,0 +1,225 @@
+// Package dashboard serves a small HTML page on the state of gke-preemptible-sniper: upcoming snipes, running drains, recent snipes and the configuration.
+// The page is rendered on the server and refreshes itself, it needs no JavaScript and no access to anything but the sniper.
+package dashboard
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/torbendury/gke-preemptible-sniper/history"
+	"github.com/torbendury/gke-preemptible-sniper/k8s"
+	"github.com/torbendury/gke-preemptible-sniper/sniper"
+	"github.com/torbendury/gke-preemptible-sniper/timing"
+)
+
+const (
+	TIMELINE_WINDOW  = 24 * time.Hour // upcoming snipes shown on the timeline
+	TIMELINE_TICK    = 3 * time.Hour  // distance between the hour marks of the timeline
+	HISTORY_ROWS     = 20             // number of recent snipes shown
+	REFRESH_INTERVAL = 30             // seconds until the page reloads itself
+	TIME_FORMAT      = "2006-01-02 15:04:05 MST"
+)
+
+//go:embed dashboard.html
+var page string
+
+var tmpl = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"time": func(t time.Time) string { return t.Format(TIME_FORMAT) },
+}).Parse(page))
+
+// Nodes provides the state of all nodes and the cluster-wide pause switch.
+type Nodes interface {
+	NodeStatuses() []sniper.NodeStatus
+	Paused() bool
+}
+
+// History provides the recent snipes, oldest first.
+type History interface {
+	Entries() []history.Entry
+}
+
+// Drains provides the progress of the running drains.
+type Drains interface {
+	Drains() []k8s.DrainProgress
+}
+
+var (
+	_ Nodes  = (*sniper.Sniper)(nil)
+	_ Drains = (*k8s.Client)(nil)
+)
+
+type view struct {
+	Now      time.Time
+	Refresh  int
+	Paused   bool
+	DryRun   bool
+	Ticks    []tick
+	Pools    []pool
+	Drains   []drain
+	Snipes   []history.Entry
+	Config   []setting
+	Window   time.Duration
+	Eligible int
+}
+
+type tick struct {
+	Left  float64 // position on the timeline in percent
+	Label string
+}
+
+// pool is the timeline of a node pool.
+type pool struct {
+	Name     string
+	Upcoming []snipe
+	Later    int // snipes planned after the window of the timeline
+}
+
+type snipe struct {
+	Node  string
+	Time  time.Time
+	Phase string
+	Left  float64 // position on the timeline in percent, snipes which are due are at 0
+}
+
+type drain struct {
+	k8s.DrainProgress
+	Removed int
+	Percent float64
+}
+
+type setting struct {
+	Name  string
+	Value string
+}
+
+// NewHandler returns the handler of the dashboard page.
+func NewHandler(nodes Nodes, snipes History, drains Drains, config sniper.ConfigProvider, now func() time.Time) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := config.Config()
+		v := view{
+			Now:     now(),
+			Refresh: REFRESH_INTERVAL,
+			Paused:  nodes.Paused(),
+			DryRun:  cfg.DryRun,
+			Window:  TIMELINE_WINDOW,
+			Config:  settings(cfg),
+		}
+		v.Ticks = ticks(v.Now)
+		v.Pools, v.Eligible = timeline(nodes.NodeStatuses(), v.Now)
+		for _, progress := range drains.Drains() {
+			d := drain{DrainProgress: progress, Removed: progress.Removed(), Percent: 100}
+			if len(progress.Pods) > 0 {
+				d.Percent = 100 * float64(d.Removed) / float64(len(progress.Pods))
+			}
+			v.Drains = append(v.Drains, d)
+		}
+		entries := snipes.Entries()
+		v.Snipes = slices.Clone(entries[len(entries)-min(HISTORY_ROWS, len(entries)):])
+		slices.Reverse(v.Snipes)
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := tmpl.Execute(w, v); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// timeline groups the planned snipes of the eligible nodes by node pool. It returns the pools sorted by name and the number of eligible nodes.
+func timeline(statuses []sniper.NodeStatus, now time.Time) ([]pool, int) {
+	pools := make(map[string]*pool)
+	eligible := 0
+	for _, status := range statuses {
+		if !status.Eligible {
+			continue
+		}
+		eligible++
+		p, exists := pools[status.NodePool]
+		if !exists {
+			p = &pool{Name: status.NodePool}
+			pools[status.NodePool] = p
+		}
+		if status.Scheduled == nil {
+			continue
+		}
+		offset := status.Scheduled.Sub(now)
+		if offset > TIMELINE_WINDOW {
+			p.Later++
+			continue
+		}
+		p.Upcoming = append(p.Upcoming, snipe{
+			Node:  status.Name,
+			Time:  *status.Scheduled,
+			Phase: status.Phase,
+			Left:  100 * max(offset, 0).Seconds() / TIMELINE_WINDOW.Seconds(),
+		})
+	}
+
+	result := make([]pool, 0, len(pools))
+	for _, name := range slices.Sorted(maps.Keys(pools)) {
+		p := pools[name]
+		sort.Slice(p.Upcoming, func(i, j int) bool { return p.Upcoming[i].Time.Before(p.Upcoming[j].Time) })
+		result = append(result, *p)
+	}
+	return result, eligible
+}
+
+// ticks returns the hour marks of the timeline, starting at the first full tick after now.
+func ticks(now time.Time) []tick {
+	var result []tick
+	for t := now.Truncate(TIMELINE_TICK).Add(TIMELINE_TICK); t.Sub(now) < TIMELINE_WINDOW; t = t.Add(TIMELINE_TICK) {
+		result = append(result, tick{Left: 100 * t.Sub(now).Seconds() / TIMELINE_WINDOW.Seconds(), Label: t.Format("15:04")})
+	}
+	return result
+}
+
+// settings returns the configuration as it is shown on the page.
+func settings(cfg sniper.Config) []setting {
+	labels := make([]string, 0, len(cfg.ExcludedNodeLabels))
+	for _, key := range slices.Sorted(maps.Keys(cfg.ExcludedNodeLabels)) {
+		labels = append(labels, key+"="+cfg.ExcludedNodeLabels[key])
+	}
+	return []setting{
+		{"Cluster", cfg.ClusterName},
+		{"Allowed times", timeSlots(cfg.AllowedTimes)},
+		{"Blocked times", timeSlots(cfg.BlockedTimes)},
+		{"Check interval", cfg.CheckInterval.String()},
+		{"Node drain timeout", cfg.NodeDrainTimeout.String()},
+		{"Delete mode", cfg.DeleteMode},
+		{"Surge", fmt.Sprint(cfg.Surge)},
+		{"Dry run", fmt.Sprint(cfg.DryRun)},
+		{"Excluded node pools", list(cfg.ExcludedNodePools)},
+		{"Excluded node labels", list(labels)},
+		{"Max snipes per hour", limit(cfg.MaxSnipesPerHour)},
+		{"Max concurrent snipes", limit(cfg.MaxConcurrentSnipes)},
+		{"SniperPolicies", fmt.Sprint(cfg.SniperPolicies)},
+	}
+}
+
+func timeSlots(slots timing.TimeSlots) string {
+	formatted := make([]string, 0, len(slots))
+	for _, slot := range slots {
+		formatted = append(formatted, slot.String())
+	}
+	return list(formatted)
+}
+
+func list(values []string) string {
+	if len(values) == 0 {
+		return "none"
+	}
+	return strings.Join(values, ", ")
+}
+
+func limit(value int) string {
+	if value == 0 {
+		return "no limit"
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,120 @@
+package dashboard
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/torbendury/gke-preemptible-sniper/history"
+	"github.com/torbendury/gke-preemptible-sniper/k8s"
+	"github.com/torbendury/gke-preemptible-sniper/sniper"
+	"github.com/torbendury/gke-preemptible-sniper/timing"
+)
+
+type fakeNodes struct {
+	statuses []sniper.NodeStatus
+	paused   bool
+}
+
+func (n fakeNodes) NodeStatuses() []sniper.NodeStatus { return n.statuses }
+func (n fakeNodes) Paused() bool                      { return n.paused }
+
+type fakeHistory []history.Entry
+
+func (h fakeHistory) Entries() []history.Entry { return h }
+
+type fakeDrains []k8s.DrainProgress
+
+func (d fakeDrains) Drains() []k8s.DrainProgress { return d }
+
+func TestDashboard(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	soon, due, later := now.Add(6*time.Hour), now.Add(-time.Minute), now.Add(30*time.Hour)
+	nodes := fakeNodes{
+		paused: true,
+		statuses: []sniper.NodeStatus{
+			{Name: "node-soon", NodePool: "pool-a", Eligible: true, Scheduled: &soon, Phase: sniper.PHASE_SCHEDULED},
+			{Name: "node-due", NodePool: "pool-a", Eligible: true, Scheduled: &due, Phase: sniper.PHASE_PAUSED},
+			{Name: "node-later", NodePool: "pool-b", Eligible: true, Scheduled: &later, Phase: sniper.PHASE_SCHEDULED},
+			{Name: "node-critical", NodePool: "critical", ExcludedReason: "node pool critical", Phase: sniper.PHASE_INELIGIBLE},
+		},
+	}
+	snipes := fakeHistory{
+		{Node: "node-old", NodePool: "pool-a", Result: "succeeded"},
+		{Node: "node-<script>", NodePool: "pool-a", Result: "failed", Error: "drain timed out"},
+	}
+	drains := fakeDrains{{Node: "node-draining", Started: now, Pods: []k8s.PodProgress{
+		{Namespace: "default", Name: "pod1", State: k8s.POD_REMOVED},
+		{Namespace: "default", Name: "pod2", State: k8s.POD_EVICTING},
+	}}}
+	allowed, _ := timing.ParseTimeSlots([]string{"08:00-16:00"})
+	config := sniper.StaticConfig{AllowedTimes: allowed, ExcludedNodePools: []string{"critical"}, MaxSnipesPerHour: 2}
+
+	server := httptest.NewServer(NewHandler(nodes, snipes, drains, config, func() time.Time { return now }))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Fatalf("unexpected response %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	page := string(body)
+	for _, want := range []string{
+		"Sniping is paused cluster-wide",
+		`style="left: 25%"`, // node-soon is 6 of 24 hours ahead
+		`style="left: 0%"`,  // node-due is overdue
+		"1 later",           // node-later is beyond the timeline
+		"1/2 pods removed",
+		"default/pod2: Evicting",
+		"node-&lt;script&gt;",
+		"drain timed out",
+		"08:00-16:00",
+		"no limit",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("expected the page to contain %q", want)
+		}
+	}
+	for _, unwanted := range []string{"node-critical", "<script>"} {
+		if strings.Contains(page, unwanted) {
+			t.Errorf("expected the page not to contain %q", unwanted)
+		}
+	}
+	// newest snipes first
+	if strings.Index(page, "node-&lt;script&gt;") > strings.Index(page, "node-old") {
+		t.Error("expected the newest snipe first")
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	first, second := now.Add(2*time.Hour), now.Add(time.Hour)
+	statuses := []sniper.NodeStatus{
+		{Name: "node1", NodePool: "b", Eligible: true, Scheduled: &first},
+		{Name: "node2", NodePool: "b", Eligible: true, Scheduled: &second},
+		{Name: "node3", NodePool: "a", Eligible: true},
+		{Name: "node4", NodePool: "c"},
+	}
+
+	pools, eligible := timeline(statuses, now)
+	if eligible != 3 {
+		t.Errorf("expected 3 eligible nodes, got %d", eligible)
+	}
+	if len(pools) != 2 || pools[0].Name != "a" || len(pools[0].Upcoming) != 0 || pools[1].Name != "b" {
+		t.Fatalf("unexpected pools %+v", pools)
+	}
+	if upcoming := pools[1].Upcoming; len(upcoming) != 2 || upcoming[0].Node != "node2" || upcoming[1].Node != "node1" {
+		t.Fatalf("expected the snipes sorted by time, got %+v", upcoming)
+	}
+}
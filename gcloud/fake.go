@@ -0,0 +1,244 @@
+package gcloud
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	computepb "cloud.google.com/go/compute/apiv1/computepb"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/protobuf/proto"
+)
+
+var _ InstanceAPI = (*FakeInstanceAPI)(nil)
+
+// FakeInstanceAPI is an in-memory InstanceAPI for tests.
+// Every call can be slowed down by a configurable latency and made to fail with a configurable error.
+type FakeInstanceAPI struct {
+	mu        sync.Mutex
+	instances map[string]*computepb.Instance // keyed by project/zone/instance
+	groups    map[string]int32               // target sizes, keyed by project/zone/group
+	preempted map[string][]Preemption        // preemptions, keyed by project/zone
+	errors    map[string]error               // errors to return, keyed by method name
+	latency   time.Duration
+	calls     []string
+}
+
+// NewFakeInstanceAPI creates an empty FakeInstanceAPI.
+func NewFakeInstanceAPI() *FakeInstanceAPI {
+	return &FakeInstanceAPI{
+		instances: make(map[string]*computepb.Instance),
+		groups:    make(map[string]int32),
+		preempted: make(map[string][]Preemption),
+		errors:    make(map[string]error),
+	}
+}
+
+// AddInstance stores an instance in the provided project and zone.
+func (f *FakeInstanceAPI) AddInstance(projectID, zone string, instance *computepb.Instance) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.instances[path.Join(projectID, zone, instance.GetName())] = instance
+}
+
+// Instance returns a stored instance and whether it exists.
+func (f *FakeInstanceAPI) Instance(projectID, zone, instanceName string) (*computepb.Instance, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	instance, exists := f.instances[path.Join(projectID, zone, instanceName)]
+	return instance, exists
+}
+
+// AddInstanceGroup stores a managed instance group with the provided target size.
+func (f *FakeInstanceAPI) AddInstanceGroup(projectID, zone, groupName string, size int32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.groups[path.Join(projectID, zone, groupName)] = size
+}
+
+// Preempt removes an instance and records its preemption at the provided time, like Compute Engine does.
+func (f *FakeInstanceAPI) Preempt(projectID, zone, instanceName string, at time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.instances, path.Join(projectID, zone, instanceName))
+	zoneKey := path.Join(projectID, zone)
+	f.preempted[zoneKey] = append(f.preempted[zoneKey], Preemption{
+		ID:           fmt.Sprintf("%s-%d", instanceName, at.UnixNano()),
+		InstanceName: instanceName,
+		Time:         at,
+	})
+}
+
+// SetError makes every call of the method with the provided name fail with err. A nil err removes the failure.
+func (f *FakeInstanceAPI) SetError(method string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		delete(f.errors, method)
+		return
+	}
+	f.errors[method] = err
+}
+
+// SetLatency delays every call by the provided duration, or until the context of the call is done.
+func (f *FakeInstanceAPI) SetLatency(latency time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.latency = latency
+}
+
+// Calls returns the names of all methods called so far, in order.
+func (f *FakeInstanceAPI) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+// call records the call of a method, waits for the configured latency and returns the configured error.
+func (f *FakeInstanceAPI) call(ctx context.Context, method string) error {
+	f.mu.Lock()
+	f.calls = append(f.calls, method)
+	latency := f.latency
+	err := f.errors[method]
+	f.mu.Unlock()
+
+	if latency > 0 {
+		if sleepErr := sleep(ctx, latency); sleepErr != nil {
+			return sleepErr
+		}
+	}
+	return err
+}
+
+func notFound(resource string) error {
+	return &googleapi.Error{Code: http.StatusNotFound, Message: fmt.Sprintf("%s not found", resource)}
+}
+
+func (f *FakeInstanceAPI) ListInstances(ctx context.Context, projectID, zone string) ([]*computepb.Instance, error) {
+	if err := f.call(ctx, "ListInstances"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var instances []*computepb.Instance
+	for key, instance := range f.instances {
+		if path.Dir(key) == path.Join(projectID, zone) {
+			instances = append(instances, proto.Clone(instance).(*computepb.Instance))
+		}
+	}
+	return instances, nil
+}
+
+func (f *FakeInstanceAPI) GetInstance(ctx context.Context, projectID, zone, instanceName string) (*computepb.Instance, error) {
+	if err := f.call(ctx, "GetInstance"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	instance, exists := f.instances[path.Join(projectID, zone, instanceName)]
+	if !exists {
+		return nil, fmt.Errorf("failed to get instance: %w", notFound(instanceName))
+	}
+	return proto.Clone(instance).(*computepb.Instance), nil
+}
+
+// DeleteInstance removes the instance. Like Client, it treats missing instances as deleted.
+func (f *FakeInstanceAPI) DeleteInstance(ctx context.Context, projectID, zone, instanceName string) error {
+	if err := f.call(ctx, "DeleteInstance"); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.instances, path.Join(projectID, zone, instanceName))
+	return nil
+}
+
+// DeleteInstanceViaGroup removes the instance and reduces the target size of the group by one. Like Client, it skips missing instances.
+func (f *FakeInstanceAPI) DeleteInstanceViaGroup(ctx context.Context, projectID, zone, groupName, instanceName string) error {
+	if err := f.call(ctx, "DeleteInstanceViaGroup"); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	groupKey := path.Join(projectID, zone, groupName)
+	if _, exists := f.groups[groupKey]; !exists {
+		return fmt.Errorf("failed to delete instance via group: %w", notFound(groupName))
+	}
+	instanceKey := path.Join(projectID, zone, instanceName)
+	if _, exists := f.instances[instanceKey]; !exists {
+		return nil
+	}
+	delete(f.instances, instanceKey)
+	f.groups[groupKey]--
+	return nil
+}
+
+// RecreateInstanceViaGroup keeps the instance and the target size of the group as they are. Like Client, it ignores missing instances.
+func (f *FakeInstanceAPI) RecreateInstanceViaGroup(ctx context.Context, projectID, zone, groupName, instanceName string) error {
+	if err := f.call(ctx, "RecreateInstanceViaGroup"); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, exists := f.groups[path.Join(projectID, zone, groupName)]; !exists {
+		return fmt.Errorf("failed to recreate instance via group: %w", notFound(groupName))
+	}
+	return nil
+}
+
+func (f *FakeInstanceAPI) GetInstanceGroupTargetSize(ctx context.Context, projectID, zone, groupName string) (int32, error) {
+	if err := f.call(ctx, "GetInstanceGroupTargetSize"); err != nil {
+		return 0, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	size, exists := f.groups[path.Join(projectID, zone, groupName)]
+	if !exists {
+		return 0, fmt.Errorf("failed to get instance group: %w", notFound(groupName))
+	}
+	return size, nil
+}
+
+func (f *FakeInstanceAPI) ResizeInstanceGroup(ctx context.Context, projectID, zone, groupName string, size int32) error {
+	if err := f.call(ctx, "ResizeInstanceGroup"); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	groupKey := path.Join(projectID, zone, groupName)
+	if _, exists := f.groups[groupKey]; !exists {
+		return fmt.Errorf("failed to resize instance group: %w", notFound(groupName))
+	}
+	f.groups[groupKey] = size
+	return nil
+}
+
+func (f *FakeInstanceAPI) ListPreemptions(ctx context.Context, projectID, zone string, since time.Time) ([]Preemption, error) {
+	if err := f.call(ctx, "ListPreemptions"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var preemptions []Preemption
+	for _, preemption := range f.preempted[path.Join(projectID, zone)] {
+		if preemption.Time.After(since) {
+			preemptions = append(preemptions, preemption)
+		}
+	}
+	return preemptions, nil
+}
+
+func (f *FakeInstanceAPI) Close() error {
+	return nil
+}
@@ -0,0 +1,104 @@
+package gcloud
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	computepb "cloud.google.com/go/compute/apiv1/computepb"
+	"google.golang.org/api/googleapi"
+)
+
+func TestFakeInstanceAPI(t *testing.T) {
+	fake := NewFakeInstanceAPI()
+	fake.AddInstance("project", "zone", &computepb.Instance{Name: stringPtr("instance-1")})
+	fake.AddInstance("project", "zone", &computepb.Instance{Name: stringPtr("instance-2")})
+	fake.AddInstance("project", "other-zone", &computepb.Instance{Name: stringPtr("instance-3")})
+	fake.AddInstanceGroup("project", "zone", "group", 2)
+	ctx := context.Background()
+
+	instances, err := fake.ListInstances(ctx, "project", "zone")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(instances) != 2 {
+		t.Fatalf("expected 2 instances, got %d", len(instances))
+	}
+
+	if _, err := fake.GetInstance(ctx, "project", "zone", "missing"); !IsNotFound(err) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	if err := fake.DeleteInstanceViaGroup(ctx, "project", "zone", "group", "instance-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// deleting twice is neither an error nor does it shrink the group again
+	if err := fake.DeleteInstanceViaGroup(ctx, "project", "zone", "group", "instance-1"); err != nil {
+		t.Fatalf("unexpected error on second delete via group: %v", err)
+	}
+	if _, exists := fake.Instance("project", "zone", "instance-1"); exists {
+		t.Fatalf("expected instance-1 to be deleted")
+	}
+	size, err := fake.GetInstanceGroupTargetSize(ctx, "project", "zone", "group")
+	if err != nil || size != 1 {
+		t.Fatalf("expected target size 1, got %d, %v", size, err)
+	}
+
+	if err := fake.DeleteInstance(ctx, "project", "zone", "instance-2"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// deleting twice is not an error, just like with the real client
+	if err := fake.DeleteInstance(ctx, "project", "zone", "instance-2"); err != nil {
+		t.Fatalf("unexpected error on second delete: %v", err)
+	}
+
+	expectedCalls := []string{"ListInstances", "GetInstance", "DeleteInstanceViaGroup", "DeleteInstanceViaGroup", "GetInstanceGroupTargetSize", "DeleteInstance", "DeleteInstance"}
+	calls := fake.Calls()
+	if len(calls) != len(expectedCalls) {
+		t.Fatalf("expected calls %v, got %v", expectedCalls, calls)
+	}
+	for i := range calls {
+		if calls[i] != expectedCalls[i] {
+			t.Fatalf("expected calls %v, got %v", expectedCalls, calls)
+		}
+	}
+}
+
+func TestFakeInstanceAPIFailures(t *testing.T) {
+	fake := NewFakeInstanceAPI()
+	fake.AddInstance("project", "zone", &computepb.Instance{Name: stringPtr("instance-1")})
+	ctx := context.Background()
+
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable}
+	fake.SetError("DeleteInstance", unavailable)
+	if err := fake.DeleteInstance(ctx, "project", "zone", "instance-1"); !errors.Is(err, unavailable) {
+		t.Fatalf("expected configured error, got %v", err)
+	}
+	if _, exists := fake.Instance("project", "zone", "instance-1"); !exists {
+		t.Fatalf("expected failed delete to keep the instance")
+	}
+
+	fake.SetError("DeleteInstance", nil)
+	if err := fake.DeleteInstance(ctx, "project", "zone", "instance-1"); err != nil {
+		t.Fatalf("unexpected error after clearing failure: %v", err)
+	}
+}
+
+func TestFakeInstanceAPILatency(t *testing.T) {
+	fake := NewFakeInstanceAPI()
+	fake.AddInstance("project", "zone", &computepb.Instance{Name: stringPtr("instance-1")})
+	fake.SetLatency(time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := fake.GetInstance(ctx, "project", "zone", "instance-1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	fake.SetLatency(time.Millisecond)
+	if _, err := fake.GetInstance(context.Background(), "project", "zone", "instance-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
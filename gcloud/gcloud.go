@@ -7,23 +7,80 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	compute "cloud.google.com/go/compute/apiv1"
 	computepb "cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/torbendury/gke-preemptible-sniper/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
+	"google.golang.org/protobuf/proto"
 )
 
 const (
 	MAXIMUM_RETRIES = 3
+
+	CLUSTER_NAME_LABEL    = "goog-k8s-cluster-name" // label GKE puts on every node instance
+	CLUSTER_NAME_METADATA = "cluster-name"          // metadata item GKE puts on every node instance
+	PROVISIONING_SPOT     = "SPOT"
+	CREATED_BY_METADATA   = "created-by" // metadata item pointing to the managed instance group of an instance
+
+	PREEMPTED_OPERATION_TYPE = "compute.instances.preempted"
+
+	REASON_NOT_PREEMPTIBLE  = "not_preemptible"
+	REASON_CLUSTER_MISMATCH = "cluster_mismatch"
+	REASON_NOT_FOUND        = "not_found" // the instance located from the labels of a node does not exist
 )
 
+// InstanceVerificationError is returned if an instance must not be deleted by the sniper.
+type InstanceVerificationError struct {
+	InstanceName string
+	Reason       string
+}
+
+func (e *InstanceVerificationError) Error() string {
+	return fmt.Sprintf("instance %v failed verification: %v", e.InstanceName, e.Reason)
+}
+
+// InstanceAPI is the set of Compute Engine operations used by the sniper.
+// It is implemented by Client, and by FakeInstanceAPI for tests.
+type InstanceAPI interface {
+	ListInstances(ctx context.Context, projectID, zone string) ([]*computepb.Instance, error)
+	GetInstance(ctx context.Context, projectID, zone, instanceName string) (*computepb.Instance, error)
+	DeleteInstance(ctx context.Context, projectID, zone, instanceName string) error
+	DeleteInstanceViaGroup(ctx context.Context, projectID, zone, groupName, instanceName string) error
+	RecreateInstanceViaGroup(ctx context.Context, projectID, zone, groupName, instanceName string) error
+	GetInstanceGroupTargetSize(ctx context.Context, projectID, zone, groupName string) (int32, error)
+	ResizeInstanceGroup(ctx context.Context, projectID, zone, groupName string, size int32) error
+	ListPreemptions(ctx context.Context, projectID, zone string, since time.Time) ([]Preemption, error)
+	Close() error
+}
+
+// Preemption is the preemption of an instance by Compute Engine.
+type Preemption struct {
+	ID           string
+	InstanceName string
+	Time         time.Time
+}
+
+var _ InstanceAPI = (*Client)(nil)
+
 // Client is a Google Cloud client.
 type Client struct {
-	client *compute.InstancesClient
+	client          *compute.InstancesClient
+	groupClient     *compute.InstanceGroupManagersClient
+	operationClient *compute.ZoneOperationsClient
 }
 
-var metadataURL = "http://metadata.google.internal/computeMetadata/v1/project/project-id"
+var (
+	metadataURL    = "http://metadata.google.internal/computeMetadata/v1/project/project-id"
+	clusterNameURL = "http://metadata.google.internal/computeMetadata/v1/instance/attributes/cluster-name"
+)
 
 // NewClient creates a new Google Cloud client using the provided context (workload identity) and returns a Client.
 func NewClient(ctx context.Context) (*Client, error) {
@@ -31,16 +88,38 @@ func NewClient(ctx context.Context) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Client{client: client}, nil
+	groupClient, err := compute.NewInstanceGroupManagersRESTClient(ctx)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	operationClient, err := compute.NewZoneOperationsRESTClient(ctx)
+	if err != nil {
+		groupClient.Close()
+		client.Close()
+		return nil, err
+	}
+	return &Client{client: client, groupClient: groupClient, operationClient: operationClient}, nil
 }
 
 func (c *Client) Close() error {
+	c.operationClient.Close()
+	c.groupClient.Close()
 	return c.client.Close()
 }
 
 // GetProjectID retrieves the project ID from the metadata server.
 func GetProjectID() (string, error) {
-	metadataURL := metadataURL
+	return getMetadata(metadataURL)
+}
+
+// GetClusterName retrieves the name of the GKE cluster the sniper runs in from the metadata server.
+func GetClusterName() (string, error) {
+	return getMetadata(clusterNameURL)
+}
+
+// getMetadata retrieves a single value from the metadata server.
+func getMetadata(metadataURL string) (string, error) {
 	req, err := http.NewRequest("GET", metadataURL, nil)
 	if err != nil {
 		return "", err
@@ -49,29 +128,26 @@ func GetProjectID() (string, error) {
 
 	client := &http.Client{Timeout: 2 * time.Second}
 
-	var lastErr error
-	for i := 0; i < MAXIMUM_RETRIES; i++ {
+	var value string
+	err = defaultRetryPolicy.do(context.Background(), func() error {
 		resp, err := client.Do(req)
 		if err != nil {
-			lastErr = err
-			continue
+			return err
 		}
 		defer resp.Body.Close()
 
 		if resp.StatusCode != http.StatusOK {
-			lastErr = fmt.Errorf("failed to get project ID, status code: %d", resp.StatusCode)
-			continue
+			return &googleapi.Error{Code: resp.StatusCode, Message: "failed to get metadata"}
 		}
 
 		body, err := io.ReadAll(resp.Body)
 		if err != nil {
-			lastErr = err
-			continue
+			return err
 		}
-
-		return string(body), nil
-	}
-	return "", lastErr
+		value = string(body)
+		return nil
+	})
+	return value, err
 }
 
 // ListInstances retrieves a list of instances in the specified project and zone.
@@ -81,52 +157,56 @@ func (c *Client) ListInstances(ctx context.Context, projectID, zone string) ([]*
 		Zone:    zone,
 	}
 
-	var lastErr error
-	var thisErr error
-
-	for i := 0; i < MAXIMUM_RETRIES; i++ {
-		var instances []*computepb.Instance
+	var instances []*computepb.Instance
+	err := defaultRetryPolicy.do(ctx, func() error {
+		instances = nil
 		it := c.client.List(ctx, req)
 		for {
-			lastErr = thisErr
-			thisErr = nil
 			instance, err := it.Next()
 			if err == iterator.Done {
-				break
+				return nil
 			}
 			if err != nil {
-				thisErr = fmt.Errorf("failed to list instances: %v", err)
-				break
+				return fmt.Errorf("failed to list instances: %w", err)
 			}
 			instances = append(instances, instance)
 		}
-		if thisErr == nil {
-			continue
-		}
-		return instances, nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil, lastErr
+	return instances, nil
 }
 
 // DeleteInstance deletes an instance in the specified project, zone, and instance name.
-func (c *Client) DeleteInstance(ctx context.Context, projectID, zone, instanceName string) error {
+// An instance which does not exist (anymore) is treated as deleted, so that deleting an instance twice is not an error.
+func (c *Client) DeleteInstance(ctx context.Context, projectID, zone, instanceName string) (err error) {
+	ctx, span := tracing.Start(ctx, "gcloud.DeleteInstance", trace.WithAttributes(instanceAttributes(projectID, zone, instanceName)...))
+	defer func() { tracing.End(span, err) }()
+
 	req := &computepb.DeleteInstanceRequest{
 		Project:  projectID,
 		Zone:     zone,
 		Instance: instanceName,
 	}
 
-	op, err := c.client.Delete(ctx, req)
+	var op *compute.Operation
+	err = defaultRetryPolicy.do(ctx, func() error {
+		var err error
+		op, err = c.client.Delete(ctx, req)
+		return err
+	})
+	if IsNotFound(err) {
+		return nil
+	}
 	if err != nil {
-		return fmt.Errorf("failed to delete instance: %v", err)
+		return fmt.Errorf("failed to delete instance: %w", err)
 	}
 
-	err = op.Wait(ctx)
+	err = waitForOperation(ctx, op)
 	if err != nil {
-		return fmt.Errorf("failed to wait for the delete operation: %v", err)
+		return fmt.Errorf("failed to wait for the delete operation: %w", err)
 	}
-
-	fmt.Printf("Instance %s deleted successfully\n", instanceName)
 	return nil
 }
 
@@ -138,15 +218,251 @@ func (c *Client) GetInstance(ctx context.Context, projectID, zone, instanceName
 		Instance: instanceName,
 	}
 
-	var lastErr error
-	for i := 0; i < MAXIMUM_RETRIES; i++ {
+	var instance *computepb.Instance
+	err := defaultRetryPolicy.do(ctx, func() error {
+		var err error
+		instance, err = c.client.Get(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get instance: %w", err)
+	}
+	return instance, nil
+}
+
+// DeleteInstanceViaGroup deletes an instance through the managed instance group owning it.
+// The group reduces its target size by one and does not recreate the instance.
+// An instance which is not part of the group (anymore) is skipped, so that deleting an instance twice is not an error.
+func (c *Client) DeleteInstanceViaGroup(ctx context.Context, projectID, zone, groupName, instanceName string) (err error) {
+	ctx, span := tracing.Start(ctx, "gcloud.DeleteInstanceViaGroup", trace.WithAttributes(append(instanceAttributes(projectID, zone, instanceName), attribute.String("group", groupName))...))
+	defer func() { tracing.End(span, err) }()
 
-		instance, err := c.client.Get(ctx, req)
-		if err != nil {
-			lastErr = fmt.Errorf("failed to get instance: %v", err)
-			continue
+	req := &computepb.DeleteInstancesInstanceGroupManagerRequest{
+		Project:              projectID,
+		Zone:                 zone,
+		InstanceGroupManager: groupName,
+		InstanceGroupManagersDeleteInstancesRequestResource: &computepb.InstanceGroupManagersDeleteInstancesRequest{
+			Instances:                      []string{instanceURL(projectID, zone, instanceName)},
+			SkipInstancesOnValidationError: proto.Bool(true),
+		},
+	}
+
+	var op *compute.Operation
+	err = defaultRetryPolicy.do(ctx, func() error {
+		var err error
+		op, err = c.groupClient.DeleteInstances(ctx, req)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete instance via group: %w", err)
+	}
+
+	err = waitForOperation(ctx, op)
+	if err != nil {
+		return fmt.Errorf("failed to wait for the delete instances operation: %w", err)
+	}
+	return nil
+}
+
+// RecreateInstanceViaGroup recreates an instance through the managed instance group owning it.
+// The target size of the group stays the same. An instance which does not exist (anymore) is left to the group,
+// which replaces missing instances on its own, so that recreating an instance twice is not an error.
+func (c *Client) RecreateInstanceViaGroup(ctx context.Context, projectID, zone, groupName, instanceName string) (err error) {
+	ctx, span := tracing.Start(ctx, "gcloud.RecreateInstanceViaGroup", trace.WithAttributes(append(instanceAttributes(projectID, zone, instanceName), attribute.String("group", groupName))...))
+	defer func() { tracing.End(span, err) }()
+
+	_, err = c.GetInstance(ctx, projectID, zone, instanceName)
+	if IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	req := &computepb.RecreateInstancesInstanceGroupManagerRequest{
+		Project:              projectID,
+		Zone:                 zone,
+		InstanceGroupManager: groupName,
+		InstanceGroupManagersRecreateInstancesRequestResource: &computepb.InstanceGroupManagersRecreateInstancesRequest{
+			Instances: []string{instanceURL(projectID, zone, instanceName)},
+		},
+	}
+
+	var op *compute.Operation
+	err = defaultRetryPolicy.do(ctx, func() error {
+		var err error
+		op, err = c.groupClient.RecreateInstances(ctx, req)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to recreate instance via group: %w", err)
+	}
+
+	err = waitForOperation(ctx, op)
+	if err != nil {
+		return fmt.Errorf("failed to wait for the recreate instances operation: %w", err)
+	}
+	return nil
+}
+
+// waitForOperation waits until the operation is done. Its span tells the time spent waiting on Compute Engine apart from the request.
+func waitForOperation(ctx context.Context, op *compute.Operation) error {
+	ctx, span := tracing.Start(ctx, "gcloud.WaitForOperation", trace.WithAttributes(attribute.String("operation", op.Name())))
+	err := op.Wait(ctx)
+	tracing.End(span, err)
+	return err
+}
+
+// instanceAttributes returns the span attributes of an instance.
+func instanceAttributes(projectID, zone, instanceName string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("project", projectID),
+		attribute.String("zone", zone),
+		attribute.String("instance", instanceName),
+	}
+}
+
+// GetInstanceGroupTargetSize returns the target size of a managed instance group.
+func (c *Client) GetInstanceGroupTargetSize(ctx context.Context, projectID, zone, groupName string) (int32, error) {
+	req := &computepb.GetInstanceGroupManagerRequest{
+		Project:              projectID,
+		Zone:                 zone,
+		InstanceGroupManager: groupName,
+	}
+
+	var group *computepb.InstanceGroupManager
+	err := defaultRetryPolicy.do(ctx, func() error {
+		var err error
+		group, err = c.groupClient.Get(ctx, req)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get instance group: %w", err)
+	}
+	return group.GetTargetSize(), nil
+}
+
+// ResizeInstanceGroup sets the target size of a managed instance group.
+func (c *Client) ResizeInstanceGroup(ctx context.Context, projectID, zone, groupName string, size int32) (err error) {
+	ctx, span := tracing.Start(ctx, "gcloud.ResizeInstanceGroup", trace.WithAttributes(attribute.String("project", projectID), attribute.String("zone", zone), attribute.String("group", groupName), attribute.Int("size", int(size))))
+	defer func() { tracing.End(span, err) }()
+
+	req := &computepb.ResizeInstanceGroupManagerRequest{
+		Project:              projectID,
+		Zone:                 zone,
+		InstanceGroupManager: groupName,
+		Size:                 size,
+	}
+
+	var op *compute.Operation
+	err = defaultRetryPolicy.do(ctx, func() error {
+		var err error
+		op, err = c.groupClient.Resize(ctx, req)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to resize instance group: %w", err)
+	}
+
+	err = waitForOperation(ctx, op)
+	if err != nil {
+		return fmt.Errorf("failed to wait for the resize operation: %w", err)
+	}
+	return nil
+}
+
+// ListPreemptions retrieves the preemptions of instances in the specified project and zone which happened after the provided time.
+// Compute Engine keeps zone operations for a limited time only, so preemptions far in the past are not returned.
+func (c *Client) ListPreemptions(ctx context.Context, projectID, zone string, since time.Time) ([]Preemption, error) {
+	req := &computepb.ListZoneOperationsRequest{
+		Project: projectID,
+		Zone:    zone,
+		Filter:  proto.String(fmt.Sprintf("operationType=%q", PREEMPTED_OPERATION_TYPE)),
+	}
+
+	var preemptions []Preemption
+	err := defaultRetryPolicy.do(ctx, func() error {
+		preemptions = nil
+		it := c.operationClient.List(ctx, req)
+		for {
+			op, err := it.Next()
+			if err == iterator.Done {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("failed to list zone operations: %w", err)
+			}
+			insertTime, err := time.Parse(time.RFC3339, op.GetInsertTime())
+			if err != nil || !insertTime.After(since) {
+				continue
+			}
+			preemptions = append(preemptions, Preemption{
+				ID:           strconv.FormatUint(op.GetId(), 10),
+				InstanceName: path.Base(op.GetTargetLink()),
+				Time:         insertTime,
+			})
 		}
-		return instance, nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil, lastErr
+	return preemptions, nil
+}
+
+// instanceURL returns the partial URL of an instance as expected by the instance group manager API.
+func instanceURL(projectID, zone, instanceName string) string {
+	return fmt.Sprintf("projects/%s/zones/%s/instances/%s", projectID, zone, instanceName)
+}
+
+// ParseInstanceGroupManager parses the "created-by" metadata of an instance in the format
+// "projects/PROJECT/zones/ZONE/instanceGroupManagers/NAME" and returns zone and name of the group.
+func ParseInstanceGroupManager(createdBy string) (string, string, error) {
+	parts := strings.Split(createdBy, "/")
+	if len(parts) != 6 || parts[0] != "projects" || parts[2] != "zones" || parts[4] != "instanceGroupManagers" || parts[3] == "" || parts[5] == "" {
+		return "", "", fmt.Errorf("%q is not a zonal instance group manager", createdBy)
+	}
+	return parts[3], parts[5], nil
+}
+
+// InstanceGroupManagerOf returns zone and name of the managed instance group owning the instance.
+func InstanceGroupManagerOf(instance *computepb.Instance) (string, string, error) {
+	for _, item := range instance.GetMetadata().GetItems() {
+		if item.GetKey() == CREATED_BY_METADATA {
+			return ParseInstanceGroupManager(item.GetValue())
+		}
+	}
+	return "", "", fmt.Errorf("instance %s is not part of a managed instance group", instance.GetName())
+}
+
+// IsPreemptible checks whether the instance is a preemptible or a Spot VM.
+func IsPreemptible(instance *computepb.Instance) bool {
+	scheduling := instance.GetScheduling()
+	return scheduling.GetPreemptible() || scheduling.GetProvisioningModel() == PROVISIONING_SPOT
+}
+
+// InstanceClusterName returns the name of the GKE cluster the instance belongs to.
+// It is read from the instance labels, and if that fails, from the instance metadata.
+func InstanceClusterName(instance *computepb.Instance) string {
+	if name, exists := instance.GetLabels()[CLUSTER_NAME_LABEL]; exists {
+		return name
+	}
+	for _, item := range instance.GetMetadata().GetItems() {
+		if item.GetKey() == CLUSTER_NAME_METADATA {
+			return item.GetValue()
+		}
+	}
+	return ""
+}
+
+// VerifyInstance checks that the instance is safe to be deleted by the sniper:
+// it has to be preemptible or Spot, and it has to belong to the provided cluster.
+// If not, an *InstanceVerificationError is returned.
+func VerifyInstance(instance *computepb.Instance, clusterName string) error {
+	if !IsPreemptible(instance) {
+		return &InstanceVerificationError{InstanceName: instance.GetName(), Reason: REASON_NOT_PREEMPTIBLE}
+	}
+	if InstanceClusterName(instance) != clusterName {
+		return &InstanceVerificationError{InstanceName: instance.GetName(), Reason: REASON_CLUSTER_MISMATCH}
+	}
+	return nil
 }
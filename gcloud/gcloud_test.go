@@ -2,13 +2,19 @@ package gcloud
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	compute "cloud.google.com/go/compute/apiv1"
 	computepb "cloud.google.com/go/compute/apiv1/computepb"
 	"github.com/googleapis/gax-go/v2"
+	"github.com/torbendury/gke-preemptible-sniper/tracing/tracingtest"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 )
 
 func TestGetProjectID(t *testing.T) {
@@ -38,6 +44,146 @@ func TestGetProjectID(t *testing.T) {
 	}
 }
 
+func TestGetClusterName(t *testing.T) {
+	expectedClusterName := "test-cluster"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/computeMetadata/v1/instance/attributes/cluster-name" {
+			t.Fatalf("unexpected URL path: %s", r.URL.Path)
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(expectedClusterName))
+	}))
+	defer server.Close()
+
+	originalClusterNameURL := clusterNameURL
+	clusterNameURL = server.URL + "/computeMetadata/v1/instance/attributes/cluster-name"
+	defer func() { clusterNameURL = originalClusterNameURL }()
+
+	clusterName, err := GetClusterName()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if clusterName != expectedClusterName {
+		t.Fatalf("expected %s, got %s", expectedClusterName, clusterName)
+	}
+}
+
+func TestVerifyInstance(t *testing.T) {
+	tests := []struct {
+		name     string
+		instance *computepb.Instance
+		reason   string
+	}{
+		{
+			name: "preemptible in cluster",
+			instance: &computepb.Instance{
+				Name:       stringPtr("instance-1"),
+				Scheduling: &computepb.Scheduling{Preemptible: boolPtr(true)},
+				Labels:     map[string]string{CLUSTER_NAME_LABEL: "cluster"},
+			},
+		},
+		{
+			name: "spot in cluster by metadata",
+			instance: &computepb.Instance{
+				Name:       stringPtr("instance-1"),
+				Scheduling: &computepb.Scheduling{ProvisioningModel: stringPtr(PROVISIONING_SPOT)},
+				Metadata: &computepb.Metadata{Items: []*computepb.Items{
+					{Key: stringPtr(CLUSTER_NAME_METADATA), Value: stringPtr("cluster")},
+				}},
+			},
+		},
+		{
+			name: "on-demand",
+			instance: &computepb.Instance{
+				Name:       stringPtr("instance-1"),
+				Scheduling: &computepb.Scheduling{ProvisioningModel: stringPtr("STANDARD")},
+				Labels:     map[string]string{CLUSTER_NAME_LABEL: "cluster"},
+			},
+			reason: REASON_NOT_PREEMPTIBLE,
+		},
+		{
+			name: "preemptible in other cluster",
+			instance: &computepb.Instance{
+				Name:       stringPtr("instance-1"),
+				Scheduling: &computepb.Scheduling{Preemptible: boolPtr(true)},
+				Labels:     map[string]string{CLUSTER_NAME_LABEL: "other-cluster"},
+			},
+			reason: REASON_CLUSTER_MISMATCH,
+		},
+		{
+			name: "preemptible without cluster",
+			instance: &computepb.Instance{
+				Name:       stringPtr("instance-1"),
+				Scheduling: &computepb.Scheduling{Preemptible: boolPtr(true)},
+			},
+			reason: REASON_CLUSTER_MISMATCH,
+		},
+	}
+
+	for _, test := range tests {
+		err := VerifyInstance(test.instance, "cluster")
+		if test.reason == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+			continue
+		}
+		var verificationErr *InstanceVerificationError
+		if !errors.As(err, &verificationErr) {
+			t.Errorf("%s: expected InstanceVerificationError, got %v", test.name, err)
+			continue
+		}
+		if verificationErr.Reason != test.reason {
+			t.Errorf("%s: expected reason %s, got %s", test.name, test.reason, verificationErr.Reason)
+		}
+	}
+}
+
+func TestInstanceGroupManagerOf(t *testing.T) {
+	tests := []struct {
+		createdBy string
+		zone      string
+		name      string
+		hasError  bool
+	}{
+		{
+			createdBy: "projects/123456789/zones/europe-west1-b/instanceGroupManagers/gke-cluster-pool-1234-grp",
+			zone:      "europe-west1-b",
+			name:      "gke-cluster-pool-1234-grp",
+		},
+		{
+			createdBy: "projects/123456789/regions/europe-west1/instanceGroupManagers/gke-cluster-pool-1234-grp",
+			hasError:  true,
+		},
+		{
+			createdBy: "invalid",
+			hasError:  true,
+		},
+	}
+
+	for _, test := range tests {
+		instance := &computepb.Instance{
+			Name: stringPtr("instance-1"),
+			Metadata: &computepb.Metadata{Items: []*computepb.Items{
+				{Key: stringPtr(CREATED_BY_METADATA), Value: stringPtr(test.createdBy)},
+			}},
+		}
+		zone, name, err := InstanceGroupManagerOf(instance)
+		if (err != nil) != test.hasError {
+			t.Errorf("InstanceGroupManagerOf(%s) error = %v, expected error = %v", test.createdBy, err, test.hasError)
+		}
+		if zone != test.zone || name != test.name {
+			t.Errorf("InstanceGroupManagerOf(%s) = %s, %s, expected %s, %s", test.createdBy, zone, name, test.zone, test.name)
+		}
+	}
+
+	// Instances without created-by metadata are not managed
+	_, _, err := InstanceGroupManagerOf(&computepb.Instance{Name: stringPtr("instance-1")})
+	if err == nil {
+		t.Fatalf("expected error, got none")
+	}
+}
+
 func TestListInstances(t *testing.T) {
 	mockClient := &mockInstancesClient{
 		listFunc: func(ctx context.Context, req *computepb.ListInstancesRequest, opts ...gax.CallOption) *mockInstanceIterator {
@@ -74,11 +220,102 @@ func TestListInstances(t *testing.T) {
 	}
 }
 
+func TestDeleteInstanceTraces(t *testing.T) {
+	exporter := tracingtest.InMemory()
+	// the fake Compute Engine API responds with a finished operation, so that waiting needs a single poll
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodDelete && r.URL.Path == "/compute/v1/projects/project/zones/zone/instances/instance1":
+		case r.Method == http.MethodGet && r.URL.Path == "/compute/v1/projects/project/zones/zone/operations/operation-1":
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"name": "operation-1", "zone": "zone", "status": "DONE"}`))
+	}))
+	defer server.Close()
+
+	instancesClient, err := compute.NewInstancesRESTClient(context.TODO(), option.WithEndpoint(server.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	client := &Client{client: instancesClient}
+	defer instancesClient.Close()
+
+	err = client.DeleteInstance(context.TODO(), "project", "zone", "instance1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the requests of the Compute Engine client have spans of their own
+	var spans tracetest.SpanStubs
+	for _, span := range exporter.GetSpans() {
+		if strings.HasPrefix(span.Name, "gcloud.") {
+			spans = append(spans, span)
+		}
+	}
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	wait, deletion := spans[0], spans[1]
+	if deletion.Name != "gcloud.DeleteInstance" || wait.Name != "gcloud.WaitForOperation" || wait.Parent.SpanID() != deletion.SpanContext.SpanID() {
+		t.Fatalf("expected the wait for the operation within the delete, got %s and %s", wait.Name, deletion.Name)
+	}
+}
+
+func TestResizeInstanceGroupTraces(t *testing.T) {
+	exporter := tracingtest.InMemory()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/compute/v1/projects/project/zones/zone/instanceGroupManagers/group/resize":
+		case r.Method == http.MethodGet && r.URL.Path == "/compute/v1/projects/project/zones/zone/operations/operation-1":
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"name": "operation-1", "zone": "zone", "status": "DONE"}`))
+	}))
+	defer server.Close()
+
+	groupClient, err := compute.NewInstanceGroupManagersRESTClient(context.TODO(), option.WithEndpoint(server.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	client := &Client{groupClient: groupClient}
+	defer groupClient.Close()
+
+	err = client.ResizeInstanceGroup(context.TODO(), "project", "zone", "group", 4)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var spans tracetest.SpanStubs
+	for _, span := range exporter.GetSpans() {
+		if strings.HasPrefix(span.Name, "gcloud.") {
+			spans = append(spans, span)
+		}
+	}
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	wait, resize := spans[0], spans[1]
+	if resize.Name != "gcloud.ResizeInstanceGroup" || wait.Name != "gcloud.WaitForOperation" || wait.Parent.SpanID() != resize.SpanContext.SpanID() {
+		t.Fatalf("expected the wait for the operation within the resize, got %s and %s", wait.Name, resize.Name)
+	}
+}
+
 // Helper function to create a pointer to a string
 func stringPtr(s string) *string {
 	return &s
 }
 
+// Helper function to create a pointer to a bool
+func boolPtr(b bool) *bool {
+	return &b
+}
+
 type mockInstancesClient struct {
 	listFunc func(ctx context.Context, req *computepb.ListInstancesRequest, opts ...gax.CallOption) *mockInstanceIterator
 }
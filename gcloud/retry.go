@@ -0,0 +1,105 @@
+package gcloud
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/googleapis/gax-go/v2/apierror"
+	"google.golang.org/api/googleapi"
+)
+
+// retryPolicy describes how often a failed Google Cloud call is retried and how long to wait in between.
+// The wait time grows exponentially with every attempt and is jittered to avoid retrying in lockstep.
+type retryPolicy struct {
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+// defaultRetryPolicy is shared by all calls of the Google Cloud client.
+var defaultRetryPolicy = retryPolicy{
+	maxAttempts:    MAXIMUM_RETRIES,
+	initialBackoff: 500 * time.Millisecond,
+	maxBackoff:     10 * time.Second,
+}
+
+// do calls the provided function until it succeeds, fails with an error which is not retryable,
+// the maximum number of attempts is reached or the context is done. It returns the last error of the call.
+func (p retryPolicy) do(ctx context.Context, call func() error) error {
+	var err error
+	for attempt := 0; attempt < p.maxAttempts; attempt++ {
+		err = call()
+		if err == nil || !IsRetryable(err) || attempt == p.maxAttempts-1 {
+			return err
+		}
+		if sleepErr := sleep(ctx, p.backoff(attempt)); sleepErr != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// backoff returns the jittered wait time before the retry following the provided attempt.
+// It is a random duration between half and the full exponential backoff, capped at maxBackoff.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	backoff := p.initialBackoff << attempt
+	if backoff > p.maxBackoff || backoff <= 0 {
+		backoff = p.maxBackoff
+	}
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// sleep waits for the provided duration or until the context is done, whichever happens first.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// IsRetryable checks whether a failed Google Cloud call is worth retrying.
+// Rate limiting, server side errors and errors without HTTP status (e.g. network errors) are retryable,
+// client side errors like 403 or 404 and canceled contexts are not.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	switch httpStatusCode(err) {
+	case 0, http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsNotFound checks whether a failed Google Cloud call failed because the resource does not exist.
+func IsNotFound(err error) bool {
+	return httpStatusCode(err) == http.StatusNotFound
+}
+
+// IsPermissionDenied checks whether a failed Google Cloud call failed because the sniper is not authenticated or not allowed to make it.
+func IsPermissionDenied(err error) bool {
+	code := httpStatusCode(err)
+	return code == http.StatusUnauthorized || code == http.StatusForbidden
+}
+
+// httpStatusCode extracts the HTTP status code from a Google Cloud error, or 0 if there is none.
+func httpStatusCode(err error) int {
+	var apiErr *apierror.APIError
+	if errors.As(err, &apiErr) && apiErr.HTTPCode() > 0 {
+		return apiErr.HTTPCode()
+	}
+	var googleErr *googleapi.Error
+	if errors.As(err, &googleErr) {
+		return googleErr.Code
+	}
+	return 0
+}
@@ -0,0 +1,176 @@
+package gcloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// testRetryPolicy retries quickly to keep the tests fast
+var testRetryPolicy = retryPolicy{
+	maxAttempts:    3,
+	initialBackoff: time.Millisecond,
+	maxBackoff:     5 * time.Millisecond,
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{name: "nil", err: nil, retryable: false},
+		{name: "not found", err: &googleapi.Error{Code: http.StatusNotFound}, retryable: false},
+		{name: "forbidden", err: &googleapi.Error{Code: http.StatusForbidden}, retryable: false},
+		{name: "unavailable", err: &googleapi.Error{Code: http.StatusServiceUnavailable}, retryable: true},
+		{name: "rate limited", err: &googleapi.Error{Code: http.StatusTooManyRequests}, retryable: true},
+		{name: "wrapped unavailable", err: fmt.Errorf("failed: %w", &googleapi.Error{Code: http.StatusServiceUnavailable}), retryable: true},
+		{name: "network error", err: errors.New("connection reset by peer"), retryable: true},
+		{name: "canceled", err: context.Canceled, retryable: false},
+		{name: "deadline exceeded", err: fmt.Errorf("failed: %w", context.DeadlineExceeded), retryable: false},
+	}
+
+	for _, test := range tests {
+		if IsRetryable(test.err) != test.retryable {
+			t.Errorf("%s: expected retryable = %v", test.name, test.retryable)
+		}
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	if !IsNotFound(fmt.Errorf("failed: %w", &googleapi.Error{Code: http.StatusNotFound})) {
+		t.Fatalf("expected wrapped 404 to be not found")
+	}
+	if IsNotFound(&googleapi.Error{Code: http.StatusForbidden}) {
+		t.Fatalf("expected 403 not to be not found")
+	}
+	if IsNotFound(errors.New("not found")) {
+		t.Fatalf("expected error without status code not to be not found")
+	}
+}
+
+func TestIsPermissionDenied(t *testing.T) {
+	if !IsPermissionDenied(fmt.Errorf("failed: %w", &googleapi.Error{Code: http.StatusForbidden})) {
+		t.Fatalf("expected wrapped 403 to be permission denied")
+	}
+	if !IsPermissionDenied(&googleapi.Error{Code: http.StatusUnauthorized}) {
+		t.Fatalf("expected 401 to be permission denied")
+	}
+	if IsPermissionDenied(&googleapi.Error{Code: http.StatusServiceUnavailable}) {
+		t.Fatalf("expected 503 not to be permission denied")
+	}
+}
+
+func TestRetryPolicyRetriesTransientErrors(t *testing.T) {
+	attempts := 0
+	err := testRetryPolicy.do(context.Background(), func() error {
+		attempts++
+		if attempts < 3 {
+			return &googleapi.Error{Code: http.StatusServiceUnavailable}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestRetryPolicyGivesUp(t *testing.T) {
+	attempts := 0
+	err := testRetryPolicy.do(context.Background(), func() error {
+		attempts++
+		return &googleapi.Error{Code: http.StatusServiceUnavailable}
+	})
+	if err == nil {
+		t.Fatalf("expected error, got none")
+	}
+	if attempts != testRetryPolicy.maxAttempts {
+		t.Fatalf("expected %d attempts, got %d", testRetryPolicy.maxAttempts, attempts)
+	}
+}
+
+func TestRetryPolicyStopsOnFatalErrors(t *testing.T) {
+	attempts := 0
+	err := testRetryPolicy.do(context.Background(), func() error {
+		attempts++
+		return &googleapi.Error{Code: http.StatusForbidden}
+	})
+	if !errors.As(err, new(*googleapi.Error)) {
+		t.Fatalf("expected googleapi error, got %v", err)
+	}
+	if attempts != 1 {
+		t.Fatalf("expected 1 attempt, got %d", attempts)
+	}
+}
+
+func TestRetryPolicyStopsOnDoneContext(t *testing.T) {
+	policy := retryPolicy{maxAttempts: 5, initialBackoff: time.Hour, maxBackoff: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	attempts := 0
+	start := time.Now()
+	err := policy.do(ctx, func() error {
+		attempts++
+		return &googleapi.Error{Code: http.StatusServiceUnavailable}
+	})
+	if err == nil {
+		t.Fatalf("expected error, got none")
+	}
+	if attempts != 1 {
+		t.Fatalf("expected 1 attempt, got %d", attempts)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("expected sleep to be interrupted by the context")
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := retryPolicy{maxAttempts: 10, initialBackoff: 100 * time.Millisecond, maxBackoff: time.Second}
+	for attempt := 0; attempt < 10; attempt++ {
+		expected := min(100*time.Millisecond<<attempt, time.Second)
+		backoff := policy.backoff(attempt)
+		if backoff < expected/2 || backoff > expected {
+			t.Errorf("attempt %d: expected backoff between %v and %v, got %v", attempt, expected/2, expected, backoff)
+		}
+	}
+}
+
+func TestGetProjectIDRetriesServerErrors(t *testing.T) {
+	originalPolicy := defaultRetryPolicy
+	defaultRetryPolicy = testRetryPolicy
+	defer func() { defaultRetryPolicy = originalPolicy }()
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("test-project-id"))
+	}))
+	defer server.Close()
+
+	originalMetadataURL := metadataURL
+	metadataURL = server.URL
+	defer func() { metadataURL = originalMetadataURL }()
+
+	projectID, err := GetProjectID()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if projectID != "test-project-id" || requests != 2 {
+		t.Fatalf("expected project ID after 2 requests, got %s after %d", projectID, requests)
+	}
+}
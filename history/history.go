@@ -0,0 +1,107 @@
+// Package history keeps a rolling history of snipes and persists it, so that it survives restarts of the sniper.
+package history
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	MAX_ENTRIES = 500                // maximum number of snipes kept, the oldest are dropped first
+	MAX_AGE     = 7 * 24 * time.Hour // snipes older than this are dropped
+)
+
+// Entry is a single snipe.
+type Entry struct {
+	Node      string    `json:"node"`
+	NodePool  string    `json:"nodePool"`
+	Zone      string    `json:"zone"`
+	Scheduled time.Time `json:"scheduled"`       // planned snipe time from the timestamp annotation
+	Sniped    time.Time `json:"sniped"`          // time the snipe started
+	Duration  float64   `json:"durationSeconds"` // seconds from surge or cordon until the instance was deleted
+	Result    string    `json:"result"`          // either "succeeded" or "failed"
+	Error     string    `json:"error,omitempty"` // error of a failed snipe
+}
+
+// Store persists the history.
+type Store interface {
+	Load(ctx context.Context) ([]Entry, error)
+	Save(ctx context.Context, entries []Entry) error
+}
+
+// History is a rolling history of snipes, oldest first. It is safe for concurrent use.
+// Every added snipe is saved to the store immediately.
+type History struct {
+	store Store
+	now   func() time.Time
+
+	mu      sync.Mutex
+	entries []Entry
+}
+
+// New creates an empty History which is saved to the store. Without store, the history is kept in memory only.
+func New(store Store, now func() time.Time) *History {
+	return &History{store: store, now: now}
+}
+
+// Load replaces the history with the one of the store.
+func (h *History) Load(ctx context.Context) error {
+	if h.store == nil {
+		return nil
+	}
+	entries, err := h.store.Load(ctx)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	slices.SortStableFunc(entries, func(a, b Entry) int { return a.Sniped.Compare(b.Sniped) })
+	h.entries = h.trim(entries)
+	return nil
+}
+
+// Add adds a snipe to the history and saves it. The snipe is kept in memory even if saving fails.
+func (h *History) Add(ctx context.Context, entry Entry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// snipes finish in a different order than they start, the history stays sorted by start time
+	i, _ := slices.BinarySearchFunc(h.entries, entry, func(a, b Entry) int {
+		if a.Sniped.After(b.Sniped) {
+			return 1
+		}
+		return -1
+	})
+	h.entries = h.trim(slices.Insert(h.entries, i, entry))
+
+	if h.store == nil {
+		return nil
+	}
+	// saving under the lock keeps the saved histories in order
+	return h.store.Save(ctx, h.entries)
+}
+
+// Entries returns a copy of all snipes, oldest first.
+func (h *History) Entries() []Entry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries = h.trim(h.entries)
+	return slices.Clone(h.entries)
+}
+
+// trim removes the snipes which are too old or exceed the maximum number of entries.
+func (h *History) trim(entries []Entry) []Entry {
+	oldest := h.now().Add(-MAX_AGE)
+	i := 0
+	for i < len(entries) && entries[i].Sniped.Before(oldest) {
+		i++
+	}
+	entries = entries[i:]
+	if len(entries) > MAX_ENTRIES {
+		entries = entries[len(entries)-MAX_ENTRIES:]
+	}
+	return entries
+}
@@ -0,0 +1,120 @@
+package history
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/torbendury/gke-preemptible-sniper/k8s"
+	testclient "k8s.io/client-go/kubernetes/fake"
+)
+
+var now = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func entry(node string, sniped time.Time) Entry {
+	return Entry{Node: node, NodePool: "pool", Zone: "zone", Scheduled: sniped, Sniped: sniped, Duration: 60, Result: "succeeded"}
+}
+
+func nodes(entries []Entry) []string {
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Node)
+	}
+	return names
+}
+
+func TestHistory(t *testing.T) {
+	tests := []struct {
+		name  string
+		added []Entry
+		want  []string
+	}{
+		{
+			name:  "sorted by snipe time",
+			added: []Entry{entry("node2", now.Add(-time.Minute)), entry("node1", now.Add(-time.Hour)), entry("node3", now)},
+			want:  []string{"node1", "node2", "node3"},
+		},
+		{
+			name:  "old snipes are dropped",
+			added: []Entry{entry("node1", now.Add(-MAX_AGE-time.Minute)), entry("node2", now.Add(-MAX_AGE+time.Minute))},
+			want:  []string{"node2"},
+		},
+	}
+
+	for _, test := range tests {
+		h := New(nil, func() time.Time { return now })
+		for _, e := range test.added {
+			if err := h.Add(context.TODO(), e); err != nil {
+				t.Fatalf("%s: expected no error, got %v", test.name, err)
+			}
+		}
+		if got := nodes(h.Entries()); fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestHistoryMaxEntries(t *testing.T) {
+	h := New(nil, func() time.Time { return now })
+	for i := range MAX_ENTRIES + 10 {
+		h.Add(context.TODO(), entry(fmt.Sprintf("node%d", i), now.Add(time.Duration(i-MAX_ENTRIES-10)*time.Second)))
+	}
+	entries := h.Entries()
+	if len(entries) != MAX_ENTRIES {
+		t.Fatalf("expected %d entries, got %d", MAX_ENTRIES, len(entries))
+	}
+	if entries[0].Node != "node10" {
+		t.Fatalf("expected the oldest snipes to be dropped, got %s first", entries[0].Node)
+	}
+}
+
+func TestStores(t *testing.T) {
+	tests := []struct {
+		name  string
+		store Store
+	}{
+		{name: "file", store: FileStore{Path: filepath.Join(t.TempDir(), "history.json")}},
+		{name: "ConfigMap", store: ConfigMapStore{Client: k8s.NewClientForClientset(testclient.NewSimpleClientset()), Namespace: "sniper", Name: "history"}},
+	}
+
+	for _, test := range tests {
+		// nothing saved yet
+		h := New(test.store, func() time.Time { return now })
+		if err := h.Load(context.TODO()); err != nil {
+			t.Fatalf("%s: expected no error, got %v", test.name, err)
+		}
+		if len(h.Entries()) != 0 {
+			t.Fatalf("%s: expected empty history, got %v", test.name, h.Entries())
+		}
+
+		failed := entry("node2", now)
+		failed.Result, failed.Error = "failed", "drain timed out"
+		for _, e := range []Entry{entry("node1", now.Add(-time.Hour)), failed} {
+			if err := h.Add(context.TODO(), e); err != nil {
+				t.Fatalf("%s: expected no error, got %v", test.name, err)
+			}
+		}
+
+		// a restarted sniper continues with the saved history
+		restarted := New(test.store, func() time.Time { return now })
+		if err := restarted.Load(context.TODO()); err != nil {
+			t.Fatalf("%s: expected no error, got %v", test.name, err)
+		}
+		if got, want := fmt.Sprint(restarted.Entries()), fmt.Sprint(h.Entries()); got != want {
+			t.Errorf("%s: expected %v, got %v", test.name, want, got)
+		}
+	}
+}
+
+func TestFileStoreInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.json")
+	if err := os.WriteFile(path, []byte("not json"), 0o600); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := New(FileStore{Path: path}, time.Now).Load(context.TODO()); err == nil {
+		t.Fatalf("expected error for invalid history, got none")
+	}
+}
@@ -0,0 +1,98 @@
+package history
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const CONFIG_MAP_KEY = "history.json" // key of the history in the data of the ConfigMap
+
+// FileStore persists the history as JSON in a local file, e.g. on a mounted volume.
+type FileStore struct {
+	Path string
+}
+
+// Load reads the history from the file. A missing file is an empty history.
+func (s FileStore) Load(ctx context.Context) ([]Entry, error) {
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decode(data)
+}
+
+// Save writes the history to a temporary file next to the file and renames it, so that the file is never partially written.
+func (s FileStore) Save(ctx context.Context, entries []Entry) error {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
+
+// ConfigMaps reads and writes the data of ConfigMaps.
+type ConfigMaps interface {
+	GetConfigMapData(ctx context.Context, namespace, name string) (map[string]string, error)
+	SetConfigMapData(ctx context.Context, namespace, name string, data map[string]string) error
+}
+
+// ConfigMapStore persists the history as JSON in a ConfigMap.
+type ConfigMapStore struct {
+	Client    ConfigMaps
+	Namespace string
+	Name      string
+}
+
+// Load reads the history from the ConfigMap. A missing ConfigMap is an empty history.
+func (s ConfigMapStore) Load(ctx context.Context) ([]Entry, error) {
+	data, err := s.Client.GetConfigMapData(ctx, s.Namespace, s.Name)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	value, exists := data[CONFIG_MAP_KEY]
+	if !exists {
+		return nil, nil
+	}
+	return decode([]byte(value))
+}
+
+// Save writes the history to the ConfigMap, which is created if it does not exist.
+func (s ConfigMapStore) Save(ctx context.Context, entries []Entry) error {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return s.Client.SetConfigMapData(ctx, s.Namespace, s.Name, map[string]string{CONFIG_MAP_KEY: string(data)})
+}
+
+func decode(data []byte) ([]Entry, error) {
+	var entries []Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("invalid history: %w", err)
+	}
+	return entries, nil
+}
@@ -0,0 +1,44 @@
+package k8s
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	EVENT_COMPONENT = "gke-preemptible-sniper" // source of all Events
+
+	// EVENT_REASON_EVICTED is the reason of the Event on every Pod evicted by DrainNode. It is stable, so that it can be alerted on.
+	EVENT_REASON_EVICTED = "EvictedBySniper"
+)
+
+// newEventRecorder creates an EventRecorder which writes Events through the clientset in the background.
+func newEventRecorder(clientset kubernetes.Interface) (record.EventBroadcaster, record.EventRecorder) {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	return broadcaster, broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: EVENT_COMPONENT})
+}
+
+// EventRecorder returns the EventRecorder of the client, which writes Events to the cluster the client points to.
+func (c *Client) EventRecorder() record.EventRecorder {
+	if c.recorder == nil {
+		// clients built without a constructor do not record anything
+		return &record.FakeRecorder{}
+	}
+	return c.recorder
+}
+
+// Shutdown stops writing Events. Events which were not written yet are dropped.
+func (c *Client) Shutdown() {
+	if c.broadcaster != nil {
+		c.broadcaster.Shutdown()
+	}
+}
+
+func (c *Client) event(object runtime.Object, eventType, reason, messageFmt string, args ...any) {
+	c.EventRecorder().Eventf(object, eventType, reason, messageFmt, args...)
+}
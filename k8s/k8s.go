@@ -7,23 +7,34 @@ import (
 	"encoding/json"
 	"fmt"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/torbendury/gke-preemptible-sniper/stats"
+	"github.com/torbendury/gke-preemptible-sniper/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/api/policy/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/strategicpatch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/homedir"
 )
 
 // Client is a Kubernetes client wrapper.
 type Client struct {
-	client kubernetes.Interface
+	client      kubernetes.Interface
+	broadcaster record.EventBroadcaster
+	recorder    record.EventRecorder
+	drains      drainTracker // progress of the running drains
 }
 
 type PodEvictionError struct {
@@ -36,30 +47,51 @@ func (r *PodEvictionError) Error() string {
 	return fmt.Sprintf("pod %v, namespace %v, err %v", r.PodName, r.PodNamespace, r.Err)
 }
 
+// ProviderID is the location of the Compute Engine instance backing a node, as found in the node's spec.providerID.
+type ProviderID struct {
+	Project  string
+	Zone     string
+	Instance string
+}
+
+func (p ProviderID) String() string {
+	return fmt.Sprintf("gce://%s/%s/%s", p.Project, p.Zone, p.Instance)
+}
+
 const POD_EVICT_TIMEOUT_SECONDS = 30
 
+const NODE_READY_POLL_INTERVAL = 5 * time.Second
+
+const GCE_PROVIDER_PREFIX = "gce://"
+
+const NODE_POOL_LABEL = "cloud.google.com/gke-nodepool"
+
+// NewRestConfig tries to use the in-cluster config, and if that fails, it will fallback to a kubeconfig file.
+func NewRestConfig() (*rest.Config, error) {
+	// Try to use in-cluster config
+	config, err := rest.InClusterConfig()
+	if err == nil {
+		return config, nil
+	}
+
+	// Fallback to kubeconfig file
+	var kubeconfig string
+	if home := homedir.HomeDir(); home != "" {
+		kubeconfig = filepath.Join(home, ".kube", "config")
+	}
+	return clientcmd.BuildConfigFromFlags("", kubeconfig)
+}
+
 // NewClient creates a new Kubernetes client using the provided rest.Config and returns a Client.
-// If no config is provided, it will try to use in-cluster config, and if that fails, it will fallback to a kubeconfig file.
+// If no config is provided, it is created with NewRestConfig.
 // At the moment, it does not apply client-side rate limiting.
 func NewClient(config *rest.Config) (*Client, error) {
 	var err error
 
 	if config == nil {
-		// Try to use in-cluster config
-		config, err = rest.InClusterConfig()
+		config, err = NewRestConfig()
 		if err != nil {
-			// Fallback to kubeconfig file
-			var kubeconfig string
-			if home := homedir.HomeDir(); home != "" {
-				kubeconfig = filepath.Join(home, ".kube", "config")
-			} else {
-				kubeconfig = ""
-			}
-
-			config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
-			if err != nil {
-				return nil, err
-			}
+			return nil, err
 		}
 	}
 
@@ -71,7 +103,13 @@ func NewClient(config *rest.Config) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Client{client: clientset}, nil
+	return NewClientForClientset(clientset), nil
+}
+
+// NewClientForClientset wraps an already configured clientset, e.g. a fake one, into a Client.
+func NewClientForClientset(clientset kubernetes.Interface) *Client {
+	broadcaster, recorder := newEventRecorder(clientset)
+	return &Client{client: clientset, broadcaster: broadcaster, recorder: recorder}
 }
 
 // GetNodes returns a list of node names in the Kubernetes cluster where the client points to.
@@ -89,6 +127,62 @@ func (c *Client) GetNodes(ctx context.Context) ([]string, error) {
 	return nodeNames, nil
 }
 
+// GetNodesWithLabel returns a list of names of the nodes which have the label with the provided key and value.
+func (c *Client) GetNodesWithLabel(ctx context.Context, key, value string) ([]string, error) {
+	nodes, err := c.client.CoreV1().Nodes().List(ctx, metav1.ListOptions{
+		LabelSelector: key + "=" + value,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var nodeNames []string
+	for _, node := range nodes.Items {
+		nodeNames = append(nodeNames, node.Name)
+	}
+
+	return nodeNames, nil
+}
+
+// WaitForNewReadyNode waits until a node with the label with the provided key and value, which is not in the list of known nodes, is Ready.
+// It polls the nodes until the context is done and returns the name of the new node.
+func (c *Client) WaitForNewReadyNode(ctx context.Context, key, value string, knownNodes []string) (string, error) {
+	known := make(map[string]bool, len(knownNodes))
+	for _, name := range knownNodes {
+		known[name] = true
+	}
+
+	for {
+		nodes, err := c.client.CoreV1().Nodes().List(ctx, metav1.ListOptions{
+			LabelSelector: key + "=" + value,
+		})
+		// errors are ignored here, the nodes are polled again until the context is done
+		if err == nil {
+			for _, node := range nodes.Items {
+				if !known[node.Name] && isNodeReady(&node) {
+					return node.Name, nil
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("no new ready node with label %s=%s: %v", key, value, ctx.Err())
+		case <-time.After(NODE_READY_POLL_INTERVAL):
+		}
+	}
+}
+
+// isNodeReady checks if the node has the Ready condition set to true.
+func isNodeReady(node *v1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
 // CordonNode cordon the node with the provided name.
 // Since no out of the box method is provided by the client-go library, we need to patch the node object to set the spec.unschedulable field to true.
 func (c *Client) CordonNode(ctx context.Context, nodeName string) error {
@@ -122,63 +216,48 @@ func (c *Client) CordonNode(ctx context.Context, nodeName string) error {
 // DrainNode drains the node with the provided name.
 // It evicts all the pods running on the node, except for the ones in the kube-system namespace and DaemonSet pods.
 // It uses the Eviction API to evict the pods.
-func (c *Client) DrainNode(ctx context.Context, nodeName string) error {
-	pods, err := c.client.CoreV1().Pods("").List(ctx, metav1.ListOptions{
-		FieldSelector: "spec.nodeName=" + nodeName,
-	})
+// It returns the pods which were removed from the node as namespace/name, sorted, also if the drain failed for other pods.
+func (c *Client) DrainNode(ctx context.Context, nodeName string) (removed []string, err error) {
+	ctx, span := tracing.Start(ctx, "k8s.DrainNode", trace.WithAttributes(attribute.String("node", nodeName)))
+	defer func() { tracing.End(span, err) }()
+
+	pods, err := c.GetEvictablePods(ctx, nodeName)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	span.SetAttributes(attribute.Int("pods", len(pods)))
+	pool, zone := c.nodeMetricLabels(ctx, nodeName)
 
-	var wg sync.WaitGroup
-	errChan := make(chan error, len(pods.Items))
-
-	for _, pod := range pods.Items {
-		if pod.Namespace == "kube-system" {
-			continue // Skip system pods
-		}
+	progress := make([]PodProgress, 0, len(pods))
+	for _, pod := range pods {
+		progress = append(progress, PodProgress{Namespace: pod.Namespace, Name: pod.Name, State: POD_EVICTING})
+	}
+	c.drains.start(nodeName, progress)
+	defer c.drains.finish(nodeName)
 
-		// Skip DaemonSet pods
-		if c.isDaemonSetPod(&pod) {
-			continue
-		}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	errChan := make(chan error, len(pods))
 
+	for _, pod := range pods {
 		wg.Add(1)
 
 		go func(pod v1.Pod) {
-
 			defer wg.Done()
-
-			err = c.evictPod(ctx, &pod)
-			if err != nil {
-				// try to recover by deleting the pod
-				err = c.DeletePod(ctx, pod.Name, pod.Namespace)
-				if err != nil {
-					errChan <- err
-				}
-			}
-
-			for range POD_EVICT_TIMEOUT_SECONDS {
-				_, err = c.client.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
-				if err != nil {
-					break
-				}
-				<-time.After(1 * time.Second)
+			// one error per pod, errChan has no room for more
+			if err := c.removePod(ctx, nodeName, pool, zone, pod); err != nil {
+				errChan <- err
+				return
 			}
-			_, err = c.client.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
-			if err == nil {
-				errChan <- &PodEvictionError{
-					PodName:      pod.Name,
-					PodNamespace: pod.Namespace,
-					Err:          fmt.Errorf("pod %s/%s still exists after eviction", pod.Namespace, pod.Name),
-				}
-			}
-
+			mu.Lock()
+			removed = append(removed, pod.Namespace+"/"+pod.Name)
+			mu.Unlock()
 		}(pod)
 	}
 
 	wg.Wait()
 	close(errChan)
+	slices.Sort(removed)
 
 	// Get all errors and compile them to one
 	var errList []error
@@ -186,10 +265,102 @@ func (c *Client) DrainNode(ctx context.Context, nodeName string) error {
 		errList = append(errList, err)
 	}
 	if len(errList) > 0 {
-		return fmt.Errorf("failed to drain node %s: %v", nodeName, errList)
+		return removed, fmt.Errorf("failed to drain node %s: %v", nodeName, errList)
 	}
 
-	return nil
+	return removed, nil
+}
+
+// removePod evicts the pod, or deletes it if the eviction fails, and waits until it is gone.
+// Every pod gets its own span, which covers both the eviction and the polling for its removal.
+func (c *Client) removePod(ctx context.Context, nodeName, pool, zone string, pod v1.Pod) (err error) {
+	ctx, span := tracing.Start(ctx, "k8s.EvictPod", trace.WithAttributes(
+		attribute.String("node", nodeName),
+		attribute.String("pod.namespace", pod.Namespace),
+		attribute.String("pod.name", pod.Name),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	reason := "the node is replaced before it is preempted"
+	removal := stats.REMOVAL_EVICTED
+	err = c.evictPod(ctx, &pod)
+	if err != nil {
+		// try to recover by deleting the pod
+		reason = fmt.Sprintf("the node is replaced before it is preempted, deleted since the eviction failed: %v", err)
+		removal = stats.REMOVAL_DELETED
+		err = c.DeletePod(ctx, pod.Name, pod.Namespace)
+		if err != nil {
+			c.drains.update(nodeName, pod.Namespace, pod.Name, POD_FAILED)
+			return err
+		}
+	}
+	span.SetAttributes(attribute.String("removal", removal))
+	// the rest of the span is spent waiting for the pod to terminate
+	span.AddEvent("terminating")
+	c.drains.update(nodeName, pod.Namespace, pod.Name, POD_TERMINATING)
+	c.event(&pod, v1.EventTypeNormal, EVENT_REASON_EVICTED, "Evicted from node %s: %s", nodeName, reason)
+	stats.PodRemovals.WithLabelValues(pool, zone, removal).Inc()
+
+	for range POD_EVICT_TIMEOUT_SECONDS {
+		_, err = c.client.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+		if err != nil {
+			break
+		}
+		<-time.After(1 * time.Second)
+	}
+	_, err = c.client.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+	if err != nil {
+		c.drains.update(nodeName, pod.Namespace, pod.Name, POD_REMOVED)
+		return nil
+	}
+	c.drains.update(nodeName, pod.Namespace, pod.Name, POD_FAILED)
+	return &PodEvictionError{
+		PodName:      pod.Name,
+		PodNamespace: pod.Namespace,
+		Err:          fmt.Errorf("pod %s/%s still exists after eviction", pod.Namespace, pod.Name),
+	}
+}
+
+// nodeMetricLabels returns the node pool and zone of the node with the provided name for metric labels.
+func (c *Client) nodeMetricLabels(ctx context.Context, nodeName string) (string, string) {
+	pool, zone := stats.UNKNOWN, stats.UNKNOWN
+	node, err := c.client.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return pool, zone
+	}
+	if value, exists := node.Labels[NODE_POOL_LABEL]; exists {
+		pool = value
+	}
+	if value, err := NodeZone(node); err == nil {
+		zone = value
+	}
+	return pool, zone
+}
+
+// GetEvictablePods returns the pods running on the node with the provided name which DrainNode would evict.
+// Pods in the kube-system namespace and DaemonSet pods are left out.
+func (c *Client) GetEvictablePods(ctx context.Context, nodeName string) ([]v1.Pod, error) {
+	pods, err := c.client.CoreV1().Pods("").List(ctx, metav1.ListOptions{
+		FieldSelector: "spec.nodeName=" + nodeName,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var evictable []v1.Pod
+	for _, pod := range pods.Items {
+		if pod.Namespace == "kube-system" {
+			continue // Skip system pods
+		}
+
+		// Skip DaemonSet pods
+		if c.isDaemonSetPod(&pod) {
+			continue
+		}
+
+		evictable = append(evictable, pod)
+	}
+	return evictable, nil
 }
 
 // evictPod evicts the provided pod.
@@ -319,8 +490,69 @@ func (c *Client) GetNodeZone(ctx context.Context, nodeName string) (string, erro
 	return l, nil
 }
 
+// GetNamespaceAnnotations returns all annotations of the namespace with the provided name.
+func (c *Client) GetNamespaceAnnotations(ctx context.Context, namespace string) (map[string]string, error) {
+	ns, err := c.client.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return ns.Annotations, nil
+}
+
+// GetConfigMapData returns the data of the ConfigMap with the provided namespace and name.
+func (c *Client) GetConfigMapData(ctx context.Context, namespace, name string) (map[string]string, error) {
+	configMap, err := c.client.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return configMap.Data, nil
+}
+
+// SetConfigMapData replaces the data of the ConfigMap with the provided namespace and name. The ConfigMap is created if it does not exist.
+func (c *Client) SetConfigMapData(ctx context.Context, namespace, name string, data map[string]string) error {
+	configMap, err := c.client.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = c.client.CoreV1().ConfigMaps(namespace).Create(ctx, &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Data:       data,
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	configMap.Data = data
+	_, err = c.client.CoreV1().ConfigMaps(namespace).Update(ctx, configMap, metav1.UpdateOptions{})
+	return err
+}
+
+// ParseProviderID parses a provider ID in the format "gce://project/zone/instance".
+func ParseProviderID(providerID string) (ProviderID, error) {
+	var p ProviderID
+	if !strings.HasPrefix(providerID, GCE_PROVIDER_PREFIX) {
+		return p, fmt.Errorf("provider ID %q is not a GCE provider ID", providerID)
+	}
+	parts := strings.Split(strings.TrimPrefix(providerID, GCE_PROVIDER_PREFIX), "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return p, fmt.Errorf("provider ID %q is not in the format gce://project/zone/instance", providerID)
+	}
+	p.Project, p.Zone, p.Instance = parts[0], parts[1], parts[2]
+	return p, nil
+}
+
+// GetNodeProviderID returns the parsed provider ID of the node with the provided name.
+func (c *Client) GetNodeProviderID(ctx context.Context, nodeName string) (ProviderID, error) {
+	node, err := c.client.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return ProviderID{}, err
+	}
+	return NodeProviderID(node)
+}
+
 // DeleteNode deletes the node with the provided name.
-func (c *Client) DeleteNode(ctx context.Context, nodeName string) error {
+func (c *Client) DeleteNode(ctx context.Context, nodeName string) (err error) {
+	ctx, span := tracing.Start(ctx, "k8s.DeleteNode", trace.WithAttributes(attribute.String("node", nodeName)))
+	defer func() { tracing.End(span, err) }()
 	return c.client.CoreV1().Nodes().Delete(ctx, nodeName, metav1.DeleteOptions{})
 }
 
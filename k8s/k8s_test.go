@@ -2,14 +2,22 @@ package k8s
 
 import (
 	"context"
+	"errors"
+	"slices"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/torbendury/gke-preemptible-sniper/stats"
+	"github.com/torbendury/gke-preemptible-sniper/tracing/tracingtest"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
 	testclient "k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 // GetMockClient returns a fake k8s client for testing purposes
@@ -110,12 +118,196 @@ func TestDrainNode(t *testing.T) {
 	}, metav1.CreateOptions{})
 
 	// Drain a node
-	err := client.DrainNode(context.TODO(), "node1")
+	_, err := client.DrainNode(context.TODO(), "node1")
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
 }
 
+func TestDrainNodeRecordsEvents(t *testing.T) {
+	clientset := testclient.NewSimpleClientset(
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: map[string]string{NODE_POOL_LABEL: "pool", "topology.kubernetes.io/zone": "zone"}}},
+		&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "default"}, Spec: v1.PodSpec{NodeName: "node1"}},
+	)
+	// the fake clientset accepts evictions without removing the pod, so evicted pods are deleted here
+	clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		eviction := action.(k8stesting.CreateAction).GetObject().(metav1.Object)
+		return true, nil, clientset.Tracker().Delete(v1.SchemeGroupVersion.WithResource("pods"), action.GetNamespace(), eviction.GetName())
+	})
+	client := NewClientForClientset(clientset)
+	defer client.Shutdown()
+	evicted := testutil.ToFloat64(stats.PodRemovals.WithLabelValues("pool", "zone", stats.REMOVAL_EVICTED))
+
+	removed, err := client.DrainNode(context.TODO(), "node1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !slices.Equal(removed, []string{"default/pod1"}) {
+		t.Fatalf("expected pod1 to be removed, got %v", removed)
+	}
+	if got := testutil.ToFloat64(stats.PodRemovals.WithLabelValues("pool", "zone", stats.REMOVAL_EVICTED)) - evicted; got != 1 {
+		t.Fatalf("expected 1 evicted pod, got %v", got)
+	}
+
+	// events are written in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		events, err := clientset.CoreV1().Events("default").List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if len(events.Items) == 1 {
+			event := events.Items[0]
+			if event.Reason != EVENT_REASON_EVICTED || event.InvolvedObject.Kind != "Pod" || event.InvolvedObject.Name != "pod1" {
+				t.Fatalf("unexpected event %+v", event)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected one event, got %d", len(events.Items))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDrainNodeReturnsOnlyRemovedPods(t *testing.T) {
+	clientset := testclient.NewSimpleClientset(
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}},
+		&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "default"}, Spec: v1.PodSpec{NodeName: "node1"}},
+		&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod2", Namespace: "default"}, Spec: v1.PodSpec{NodeName: "node1"}},
+	)
+	// pod1 is evicted, pod2 can neither be evicted nor deleted
+	clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		eviction := action.(k8stesting.CreateAction).GetObject().(metav1.Object)
+		if eviction.GetName() == "pod2" {
+			return true, nil, errors.New("pod cannot be evicted")
+		}
+		return true, nil, clientset.Tracker().Delete(v1.SchemeGroupVersion.WithResource("pods"), action.GetNamespace(), eviction.GetName())
+	})
+	clientset.PrependReactor("delete", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return action.(k8stesting.DeleteAction).GetName() == "pod2", nil, errors.New("pod cannot be deleted")
+	})
+	client := NewClientForClientset(clientset)
+	defer client.Shutdown()
+
+	removed, err := client.DrainNode(context.TODO(), "node1")
+	if err == nil {
+		t.Fatalf("expected the drain to fail")
+	}
+	if !slices.Equal(removed, []string{"default/pod1"}) {
+		t.Fatalf("expected only pod1 to be removed, got %v", removed)
+	}
+}
+
+func TestDrainProgress(t *testing.T) {
+	clientset := testclient.NewSimpleClientset(
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}},
+		&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "default"}, Spec: v1.PodSpec{NodeName: "node1"}},
+	)
+	client := NewClientForClientset(clientset)
+	defer client.Shutdown()
+
+	// the progress is captured while the pod is evicted
+	var during []DrainProgress
+	clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		during = client.Drains()
+		eviction := action.(k8stesting.CreateAction).GetObject().(metav1.Object)
+		return true, nil, clientset.Tracker().Delete(v1.SchemeGroupVersion.WithResource("pods"), action.GetNamespace(), eviction.GetName())
+	})
+
+	_, err := client.DrainNode(context.TODO(), "node1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(during) != 1 || during[0].Node != "node1" || len(during[0].Pods) != 1 || during[0].Pods[0].State != POD_EVICTING {
+		t.Fatalf("unexpected progress during the drain %+v", during)
+	}
+	if drains := client.Drains(); len(drains) != 0 {
+		t.Fatalf("expected no drains after the drain, got %+v", drains)
+	}
+}
+
+func TestDrainNodeTraces(t *testing.T) {
+	exporter := tracingtest.InMemory()
+	clientset := testclient.NewSimpleClientset(
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}},
+		&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "default"}, Spec: v1.PodSpec{NodeName: "node1"}},
+		&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod2", Namespace: "default"}, Spec: v1.PodSpec{NodeName: "node1"}},
+	)
+	clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		eviction := action.(k8stesting.CreateAction).GetObject().(metav1.Object)
+		return true, nil, clientset.Tracker().Delete(v1.SchemeGroupVersion.WithResource("pods"), action.GetNamespace(), eviction.GetName())
+	})
+	client := NewClientForClientset(clientset)
+	defer client.Shutdown()
+
+	_, err := client.DrainNode(context.TODO(), "node1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err = client.DeleteNode(context.TODO(), "node1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 4 {
+		t.Fatalf("expected 4 spans, got %d", len(spans))
+	}
+	drain, deletion := spans[2], spans[3]
+	if drain.Name != "k8s.DrainNode" || deletion.Name != "k8s.DeleteNode" {
+		t.Fatalf("unexpected spans %s and %s", drain.Name, deletion.Name)
+	}
+	pods := map[string]bool{}
+	for _, span := range spans[:2] {
+		if span.Name != "k8s.EvictPod" || span.Parent.SpanID() != drain.SpanContext.SpanID() {
+			t.Fatalf("expected eviction span within the drain, got %s", span.Name)
+		}
+		for _, attr := range span.Attributes {
+			if attr.Key == "pod.name" {
+				pods[attr.Value.AsString()] = true
+			}
+		}
+	}
+	if !pods["pod1"] || !pods["pod2"] {
+		t.Fatalf("expected one eviction span per pod, got %v", pods)
+	}
+}
+
+func TestDrainTracker(t *testing.T) {
+	var tracker drainTracker
+	tracker.start("node1", []PodProgress{{Namespace: "default", Name: "pod1", State: POD_EVICTING}, {Namespace: "default", Name: "pod2", State: POD_EVICTING}})
+	tracker.update("node1", "default", "pod1", POD_REMOVED)
+	tracker.update("node2", "default", "pod2", POD_REMOVED)
+
+	drains := tracker.list()
+	if len(drains) != 1 || drains[0].Removed() != 1 || drains[0].Pods[1].State != POD_EVICTING {
+		t.Fatalf("unexpected drains %+v", drains)
+	}
+	// the returned progress is a copy
+	drains[0].Pods[1].State = POD_FAILED
+	if tracker.list()[0].Pods[1].State != POD_EVICTING {
+		t.Fatal("expected the tracker to be unaffected by changes of the returned progress")
+	}
+
+	tracker.finish("node1")
+	if drains := tracker.list(); len(drains) != 0 {
+		t.Fatalf("expected no drains, got %+v", drains)
+	}
+}
+
 func TestEvictPod(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -310,3 +502,222 @@ func TestHasNodeLabel(t *testing.T) {
 		t.Fatalf("expected label, got none")
 	}
 }
+
+func TestGetEvictablePods(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// Create a mock client
+	client := GetMockClient()
+
+	// Create mock pods in client, only the first one is evictable
+	pods := []v1.Pod{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+			Spec:       v1.PodSpec{NodeName: "node1"},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "dns", Namespace: "kube-system"},
+			Spec:       v1.PodSpec{NodeName: "node1"},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "agent",
+				Namespace:       "default",
+				OwnerReferences: []metav1.OwnerReference{{Kind: "DaemonSet", Name: "agent"}},
+			},
+			Spec: v1.PodSpec{NodeName: "node1"},
+		},
+	}
+	for _, pod := range pods {
+		client.client.CoreV1().Pods(pod.Namespace).Create(context.TODO(), &pod, metav1.CreateOptions{})
+	}
+
+	// Get evictable pods
+	evictable, err := client.GetEvictablePods(context.TODO(), "node1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(evictable) != 1 || evictable[0].Name != "app" {
+		t.Fatalf("expected only pod app, got %v", evictable)
+	}
+}
+
+func TestGetNamespaceAnnotations(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// Create a mock client
+	client := GetMockClient()
+
+	// Create mock namespace in client
+	client.client.CoreV1().Namespaces().Create(context.TODO(), &v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "sniper",
+			Annotations: map[string]string{"key": "value"},
+		},
+	}, metav1.CreateOptions{})
+
+	// Get namespace annotations
+	annotations, err := client.GetNamespaceAnnotations(context.TODO(), "sniper")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if annotations["key"] != "value" {
+		t.Fatalf("expected value, got %v", annotations["key"])
+	}
+
+	// Missing namespaces are an error
+	_, err = client.GetNamespaceAnnotations(context.TODO(), "missing")
+	if err == nil {
+		t.Fatalf("expected error, got none")
+	}
+}
+
+func TestConfigMapData(t *testing.T) {
+	client := GetMockClient()
+
+	if _, err := client.GetConfigMapData(context.TODO(), "sniper", "history"); err == nil {
+		t.Fatalf("expected error for missing ConfigMap, got none")
+	}
+
+	// the ConfigMap is created first and updated afterwards
+	for _, value := range []string{"first", "second"} {
+		if err := client.SetConfigMapData(context.TODO(), "sniper", "history", map[string]string{"key": value}); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		data, err := client.GetConfigMapData(context.TODO(), "sniper", "history")
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if data["key"] != value {
+			t.Fatalf("expected %s, got %v", value, data["key"])
+		}
+	}
+}
+
+func TestParseProviderID(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected ProviderID
+		hasError bool
+	}{
+		{
+			input:    "gce://my-project/europe-west1-b/gke-cluster-pool-1234",
+			expected: ProviderID{Project: "my-project", Zone: "europe-west1-b", Instance: "gke-cluster-pool-1234"},
+			hasError: false,
+		},
+		{
+			input:    "aws:///eu-west-1a/i-1234",
+			hasError: true,
+		},
+		{
+			input:    "gce://my-project/europe-west1-b",
+			hasError: true,
+		},
+		{
+			input:    "gce://my-project//gke-cluster-pool-1234",
+			hasError: true,
+		},
+		{
+			input:    "",
+			hasError: true,
+		},
+	}
+
+	for _, test := range tests {
+		result, err := ParseProviderID(test.input)
+		if (err != nil) != test.hasError {
+			t.Errorf("ParseProviderID(%s) error = %v, expected error = %v", test.input, err, test.hasError)
+		}
+		if !test.hasError && result != test.expected {
+			t.Errorf("ParseProviderID(%s) = %v, expected %v", test.input, result, test.expected)
+		}
+		if !test.hasError && result.String() != test.input {
+			t.Errorf("ProviderID.String() = %s, expected %s", result.String(), test.input)
+		}
+	}
+}
+
+func TestGetNodeProviderID(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// Create a mock client
+	client := GetMockClient()
+
+	// Create mock nodes in client
+	client.client.CoreV1().Nodes().Create(context.TODO(), &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+		Spec:       v1.NodeSpec{ProviderID: "gce://project/zone/instance"},
+	}, metav1.CreateOptions{})
+	client.client.CoreV1().Nodes().Create(context.TODO(), &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node2"},
+	}, metav1.CreateOptions{})
+
+	// Get node provider ID
+	providerID, err := client.GetNodeProviderID(context.TODO(), "node1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if providerID.Instance != "instance" {
+		t.Fatalf("expected instance, got %v", providerID.Instance)
+	}
+
+	// Nodes without provider ID are an error
+	_, err = client.GetNodeProviderID(context.TODO(), "node2")
+	if err == nil {
+		t.Fatalf("expected error, got none")
+	}
+}
+
+func TestWaitForNewReadyNode(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// Create a mock client
+	client := GetMockClient()
+
+	ready := v1.NodeStatus{Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}}
+	notReady := v1.NodeStatus{Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionFalse}}}
+	pool := map[string]string{"cloud.google.com/gke-nodepool": "pool"}
+
+	// Create mock nodes in client
+	client.client.CoreV1().Nodes().Create(context.TODO(), &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "old", Labels: pool},
+		Status:     ready,
+	}, metav1.CreateOptions{})
+	client.client.CoreV1().Nodes().Create(context.TODO(), &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "booting", Labels: pool},
+		Status:     notReady,
+	}, metav1.CreateOptions{})
+
+	known, err := client.GetNodesWithLabel(context.TODO(), "cloud.google.com/gke-nodepool", "pool")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(known) != 2 {
+		t.Fatalf("expected 2 nodes, got %v", known)
+	}
+
+	// Only known or not ready nodes, so waiting times out
+	ctx, cancel := context.WithTimeout(context.TODO(), 100*time.Millisecond)
+	defer cancel()
+	_, err = client.WaitForNewReadyNode(ctx, "cloud.google.com/gke-nodepool", "pool", []string{"old"})
+	if err == nil {
+		t.Fatalf("expected error, got none")
+	}
+
+	// A new ready node is found right away
+	client.client.CoreV1().Nodes().Create(context.TODO(), &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "new", Labels: pool},
+		Status:     ready,
+	}, metav1.CreateOptions{})
+	name, err := client.WaitForNewReadyNode(context.TODO(), "cloud.google.com/gke-nodepool", "pool", known)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if name != "new" {
+		t.Fatalf("expected new, got %v", name)
+	}
+}
@@ -0,0 +1,94 @@
+package k8s
+
+import (
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// states of a pod during a drain
+const (
+	POD_EVICTING    = "Evicting"    // eviction was requested
+	POD_TERMINATING = "Terminating" // pod was evicted or deleted and is shutting down
+	POD_REMOVED     = "Removed"     // pod is gone
+	POD_FAILED      = "Failed"      // pod could not be removed
+)
+
+// PodProgress is the state of a pod of a running drain.
+type PodProgress struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	State     string `json:"state"` // one of the POD_* constants
+}
+
+// DrainProgress is the state of a running drain.
+type DrainProgress struct {
+	Node    string        `json:"node"`
+	Started time.Time     `json:"started"`
+	Pods    []PodProgress `json:"pods"`
+}
+
+// Removed returns the number of pods which are gone.
+func (d DrainProgress) Removed() int {
+	removed := 0
+	for _, pod := range d.Pods {
+		if pod.State == POD_REMOVED {
+			removed++
+		}
+	}
+	return removed
+}
+
+// drainTracker keeps the progress of the running drains. The zero value is ready to use.
+type drainTracker struct {
+	mu     sync.Mutex
+	drains map[string]*DrainProgress
+}
+
+func (t *drainTracker) start(nodeName string, pods []PodProgress) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.drains == nil {
+		t.drains = make(map[string]*DrainProgress)
+	}
+	t.drains[nodeName] = &DrainProgress{Node: nodeName, Started: time.Now(), Pods: pods}
+}
+
+func (t *drainTracker) update(nodeName, namespace, name, state string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	drain, exists := t.drains[nodeName]
+	if !exists {
+		return
+	}
+	for i := range drain.Pods {
+		if drain.Pods[i].Namespace == namespace && drain.Pods[i].Name == name {
+			drain.Pods[i].State = state
+		}
+	}
+}
+
+func (t *drainTracker) finish(nodeName string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.drains, nodeName)
+}
+
+func (t *drainTracker) list() []DrainProgress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	drains := make([]DrainProgress, 0, len(t.drains))
+	for _, drain := range t.drains {
+		copied := *drain
+		copied.Pods = slices.Clone(drain.Pods)
+		drains = append(drains, copied)
+	}
+	sort.Slice(drains, func(i, j int) bool { return drains[i].Started.Before(drains[j].Started) })
+	return drains
+}
+
+// Drains returns the progress of all drains which are running, oldest first.
+func (c *Client) Drains() []DrainProgress {
+	return c.drains.list()
+}
@@ -0,0 +1,146 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// RETRY_MAX_DELAY caps the backoff of nodes which fail again and again.
+const RETRY_MAX_DELAY = time.Hour
+
+// NodeWatcher keeps a cache of all nodes in the cluster, fed by a shared informer, and a rate limited work queue of node names.
+// Every added or changed node is queued, and all nodes are queued again once per resync period.
+type NodeWatcher struct {
+	factory  informers.SharedInformerFactory
+	informer cache.SharedIndexInformer
+	lister   listersv1.NodeLister
+	queue    workqueue.TypedRateLimitingInterface[string]
+}
+
+// NewNodeWatcher creates a NodeWatcher for the cluster the client points to. It does not watch anything before Start is called.
+// A failed node is queued again after retryDelay, doubled for every further failure up to RETRY_MAX_DELAY.
+func (c *Client) NewNodeWatcher(resync, retryDelay time.Duration) (*NodeWatcher, error) {
+	factory := informers.NewSharedInformerFactory(c.client, resync)
+	nodes := factory.Core().V1().Nodes()
+
+	w := &NodeWatcher{
+		factory:  factory,
+		informer: nodes.Informer(),
+		lister:   nodes.Lister(),
+		queue: workqueue.NewTypedRateLimitingQueueWithConfig(
+			workqueue.NewTypedItemExponentialFailureRateLimiter[string](retryDelay, max(retryDelay, RETRY_MAX_DELAY)),
+			workqueue.TypedRateLimitingQueueConfig[string]{Name: "nodes"},
+		),
+	}
+
+	_, err := w.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    w.enqueue,
+		UpdateFunc: func(_, newObj any) { w.enqueue(newObj) },
+		DeleteFunc: w.forget,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to add node event handler: %w", err)
+	}
+	return w, nil
+}
+
+func (w *NodeWatcher) enqueue(obj any) {
+	if node, ok := obj.(*v1.Node); ok {
+		w.queue.Add(node.Name)
+	}
+}
+
+func (w *NodeWatcher) forget(obj any) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	if node, ok := obj.(*v1.Node); ok {
+		w.queue.Forget(node.Name)
+	}
+}
+
+// Start starts the informer and waits until the cache is filled. The informer stops when the context is done.
+func (w *NodeWatcher) Start(ctx context.Context) error {
+	w.factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), w.informer.HasSynced) {
+		return errors.New("failed to sync node cache")
+	}
+	return nil
+}
+
+// Node returns the node with the provided name from the cache. The returned node must not be modified.
+func (w *NodeWatcher) Node(nodeName string) (*v1.Node, error) {
+	return w.lister.Get(nodeName)
+}
+
+// Nodes returns all nodes from the cache.
+func (w *NodeWatcher) Nodes() []*v1.Node {
+	nodes, _ := w.lister.List(labels.Everything())
+	return nodes
+}
+
+// Next blocks until a node name is queued and returns it. It returns false once the queue is shut down.
+// Every name returned by Next must be handed back with Done.
+func (w *NodeWatcher) Next() (string, bool) {
+	nodeName, shutdown := w.queue.Get()
+	return nodeName, !shutdown
+}
+
+// Done marks the node as processed. Failed nodes are queued again with a per node exponential backoff,
+// successful nodes are queued again after requeueAfter, if it is positive.
+func (w *NodeWatcher) Done(nodeName string, err error, requeueAfter time.Duration) {
+	defer w.queue.Done(nodeName)
+
+	if err != nil {
+		w.queue.AddRateLimited(nodeName)
+		return
+	}
+	w.queue.Forget(nodeName)
+	if requeueAfter > 0 {
+		w.queue.AddAfter(nodeName, requeueAfter)
+	}
+}
+
+// Enqueue queues the node right away, e.g. after its schedule was changed.
+func (w *NodeWatcher) Enqueue(nodeName string) {
+	w.queue.Add(nodeName)
+}
+
+// Retries returns how often the node failed since it was last processed successfully.
+func (w *NodeWatcher) Retries(nodeName string) int {
+	return w.queue.NumRequeues(nodeName)
+}
+
+// ShutDown stops handing out node names, Next returns false afterwards.
+func (w *NodeWatcher) ShutDown() {
+	w.queue.ShutDown()
+}
+
+// NodeZone returns the zone of the node from the "topology.kubernetes.io/zone" label,
+// or the "failure-domain.beta.kubernetes.io/zone" label if the former is missing.
+func NodeZone(node *v1.Node) (string, error) {
+	if zone, exists := node.Labels["topology.kubernetes.io/zone"]; exists {
+		return zone, nil
+	}
+	if zone, exists := node.Labels["failure-domain.beta.kubernetes.io/zone"]; exists {
+		return zone, nil
+	}
+	return "", fmt.Errorf("zone label not found on node %s", node.Name)
+}
+
+// NodeProviderID returns the parsed provider ID of the node.
+func NodeProviderID(node *v1.Node) (ProviderID, error) {
+	if node.Spec.ProviderID == "" {
+		return ProviderID{}, fmt.Errorf("no provider ID found on node %s", node.Name)
+	}
+	return ParseProviderID(node.Spec.ProviderID)
+}
@@ -0,0 +1,109 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNodeWatcher(t *testing.T) {
+	// Create a mock client
+	client := GetMockClient()
+	client.client.CoreV1().Nodes().Create(context.TODO(), &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1", Annotations: map[string]string{"key": "value"}},
+	}, metav1.CreateOptions{})
+
+	watcher, err := client.NewNodeWatcher(time.Hour, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer watcher.ShutDown()
+	if err := watcher.Start(ctx); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// Existing nodes are queued and cached
+	nodeName, more := watcher.Next()
+	if !more || nodeName != "node1" {
+		t.Fatalf("expected node1, got %v", nodeName)
+	}
+	node, err := watcher.Node("node1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if node.Annotations["key"] != "value" {
+		t.Fatalf("expected cached annotation, got %v", node.Annotations)
+	}
+	watcher.Done(nodeName, nil, 0)
+
+	// New nodes are queued right away
+	client.client.CoreV1().Nodes().Create(context.TODO(), &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node2"},
+	}, metav1.CreateOptions{})
+	nodeName, _ = watcher.Next()
+	if nodeName != "node2" {
+		t.Fatalf("expected node2, got %v", nodeName)
+	}
+
+	// Nodes are queued again after the requested time
+	start := time.Now()
+	watcher.Done(nodeName, nil, 50*time.Millisecond)
+	nodeName, _ = watcher.Next()
+	if nodeName != "node2" {
+		t.Fatalf("expected node2, got %v", nodeName)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatalf("expected node2 to be queued after 50ms, got %v", time.Since(start))
+	}
+
+	// Failed nodes are retried after the retry delay, doubled for every further failure
+	for _, delay := range []time.Duration{50 * time.Millisecond, 100 * time.Millisecond} {
+		start = time.Now()
+		watcher.Done(nodeName, errors.New("failed"), 0)
+		nodeName, _ = watcher.Next()
+		if nodeName != "node2" {
+			t.Fatalf("expected node2, got %v", nodeName)
+		}
+		if time.Since(start) < delay {
+			t.Fatalf("expected node2 to be retried after %v, got %v", delay, time.Since(start))
+		}
+	}
+	if retries := watcher.Retries(nodeName); retries != 2 {
+		t.Fatalf("expected 2 retries, got %d", retries)
+	}
+	watcher.Done(nodeName, nil, 0)
+
+	// Unknown nodes are not found in the cache
+	if _, err := watcher.Node("node3"); err == nil {
+		t.Fatalf("expected error, got none")
+	}
+}
+
+func TestNodeZone(t *testing.T) {
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		expected string
+		err      bool
+	}{
+		{name: "topology label", labels: map[string]string{"topology.kubernetes.io/zone": "zone-a"}, expected: "zone-a"},
+		{name: "legacy label", labels: map[string]string{"failure-domain.beta.kubernetes.io/zone": "zone-b"}, expected: "zone-b"},
+		{name: "no label", labels: nil, err: true},
+	}
+
+	for _, test := range tests {
+		zone, err := NodeZone(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node", Labels: test.labels}})
+		if (err != nil) != test.err {
+			t.Errorf("%s: expected error = %v, got %v", test.name, test.err, err)
+		}
+		if zone != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, zone)
+		}
+	}
+}
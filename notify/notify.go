@@ -0,0 +1,218 @@
+// Package notify sends the events of snipes to webhooks, e.g. into a chat channel.
+// Every webhook has its own bounded queue and worker, so that a slow or broken webhook never delays a snipe or the other webhooks.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	neturl "net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/torbendury/gke-preemptible-sniper/stats"
+)
+
+// event types
+const (
+	EVENT_SCHEDULED = "scheduled" // a snipe time was planned for the node
+	EVENT_STARTED   = "started"   // the node is about to be sniped
+	EVENT_CORDONED  = "cordoned"  // the node was cordoned
+	EVENT_DRAINED   = "drained"   // all pods were removed from the node
+	EVENT_DELETED   = "deleted"   // the node and its instance were deleted, the snipe succeeded
+	EVENT_FAILED    = "failed"    // the snipe failed
+)
+
+// EVENT_TYPES are all event types, in the order in which they happen.
+var EVENT_TYPES = []string{EVENT_SCHEDULED, EVENT_STARTED, EVENT_CORDONED, EVENT_DRAINED, EVENT_DELETED, EVENT_FAILED}
+
+// DEFAULT_EVENTS are sent to webhooks which do not list their events.
+var DEFAULT_EVENTS = []string{EVENT_STARTED, EVENT_FAILED}
+
+// payload formats
+const (
+	FORMAT_GENERIC = "generic" // the event as JSON
+	FORMAT_SLACK   = "slack"   // Slack incoming webhook
+	FORMAT_TEAMS   = "teams"   // Microsoft Teams incoming webhook
+)
+
+const (
+	QUEUE_SIZE      = 100              // events waiting per webhook, further events are dropped
+	MAX_ATTEMPTS    = 5                // attempts to deliver an event before it is dropped
+	RETRY_BACKOFF   = 2 * time.Second  // wait before the first retry, doubled for every further retry
+	REQUEST_TIMEOUT = 10 * time.Second // timeout of a single attempt
+)
+
+// Event is something that happened to a node during its snipe.
+type Event struct {
+	Type      string    `json:"type"` // one of the EVENT_* constants
+	Time      time.Time `json:"time"`
+	Cluster   string    `json:"cluster"`
+	Node      string    `json:"node"`
+	NodePool  string    `json:"nodePool"`
+	Zone      string    `json:"zone"`
+	Instance  string    `json:"instance,omitempty"` // Compute Engine instance of the node, once the snipe started
+	Scheduled time.Time `json:"scheduled,omitzero"` // planned snipe time
+	Started   time.Time `json:"started,omitzero"`   // start of the snipe
+	Pods      []string  `json:"pods,omitempty"`     // pods actually removed by the drain as namespace/name, also for a failed drain
+	Message   string    `json:"message"`
+	Error     string    `json:"error,omitempty"` // only set for failed snipes
+}
+
+// Webhook is a receiver of events.
+type Webhook struct {
+	Name   string   // used in logs and metrics
+	URL    string   // receives the events as POST requests
+	Format string   // one of the FORMAT_* constants
+	Events []string // event types sent to the webhook
+}
+
+// Receiver receives events. Notify must not block.
+type Receiver interface {
+	Notify(event Event)
+}
+
+// Fanout passes every event on to all its receivers.
+type Fanout []Receiver
+
+// Notify passes the event on to all receivers.
+func (f Fanout) Notify(event Event) {
+	for _, receiver := range f {
+		receiver.Notify(event)
+	}
+}
+
+// Notifier sends events to webhooks.
+type Notifier struct {
+	client  *http.Client
+	backoff time.Duration
+	logger  *slog.Logger
+	queues  []*queue
+}
+
+type queue struct {
+	webhook Webhook
+	events  chan Event
+}
+
+// New creates a Notifier for the provided webhooks. Events are sent once Run was started.
+func New(webhooks []Webhook, logger *slog.Logger) *Notifier {
+	n := &Notifier{
+		client:  &http.Client{Timeout: REQUEST_TIMEOUT},
+		backoff: RETRY_BACKOFF,
+		logger:  logger,
+	}
+	for _, webhook := range webhooks {
+		n.queues = append(n.queues, &queue{webhook: webhook, events: make(chan Event, QUEUE_SIZE)})
+	}
+	return n
+}
+
+// Notify queues the event for all webhooks which want it. It never blocks, if the queue of a webhook is full, the event is dropped for it.
+func (n *Notifier) Notify(event Event) {
+	for _, q := range n.queues {
+		if !slices.Contains(q.webhook.Events, event.Type) {
+			continue
+		}
+		select {
+		case q.events <- event:
+		default:
+			n.logger.Warn("notification queue is full, dropping event", "webhook", q.webhook.Name, "type", event.Type, "node", event.Node)
+			stats.Notifications.WithLabelValues(q.webhook.Name, stats.NOTIFICATION_DROPPED).Inc()
+		}
+	}
+}
+
+// Run sends the queued events until the context is done.
+func (n *Notifier) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, q := range n.queues {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case event := <-q.events:
+					err := n.send(ctx, q.webhook, event)
+					if err != nil {
+						n.logger.Error("failed to send notification", "webhook", q.webhook.Name, "type", event.Type, "node", event.Node, "error", err)
+					}
+					stats.Notifications.WithLabelValues(q.webhook.Name, stats.Result(err)).Inc()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// send delivers the event to the webhook. Network errors, rate limits and server errors are retried with exponential backoff.
+func (n *Notifier) send(ctx context.Context, webhook Webhook, event Event) error {
+	body, err := Payload(webhook.Format, event)
+	if err != nil {
+		return err
+	}
+
+	backoff := n.backoff
+	for attempt := 1; ; attempt++ {
+		err = n.post(ctx, webhook.URL, body)
+		var permanent *permanentError
+		if err == nil || errors.As(err, &permanent) || attempt == MAX_ATTEMPTS {
+			return err
+		}
+		n.logger.Warn("failed to send notification, retrying", "webhook", webhook.Name, "attempt", attempt, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// redact removes the URL from errors of the HTTP client and the URL parser.
+func redact(err error) error {
+	var urlErr *neturl.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Errorf("%s request failed: %w", urlErr.Op, urlErr.Err)
+	}
+	return err
+}
+
+// permanentError is an error which does not change by retrying, e.g. an invalid URL or a rejected payload.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// post sends the body to the URL. Its errors never contain the URL, it usually contains a secret.
+func (n *Notifier) post(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return &permanentError{err: redact(err)}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return redact(err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	default:
+		return &permanentError{err: fmt.Errorf("webhook rejected the notification with status %d", resp.StatusCode)}
+	}
+}
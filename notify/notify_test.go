@@ -0,0 +1,249 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/torbendury/gke-preemptible-sniper/stats"
+)
+
+func newTestNotifier(webhooks ...Webhook) *Notifier {
+	n := New(webhooks, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	n.backoff = time.Millisecond
+	return n
+}
+
+func testEvent(eventType string) Event {
+	return Event{
+		Type:      eventType,
+		Time:      time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC),
+		Cluster:   "cluster",
+		Node:      "node1",
+		NodePool:  "pool",
+		Zone:      "zone",
+		Scheduled: time.Date(2024, 6, 1, 11, 0, 0, 0, time.UTC),
+	}
+}
+
+// receiver is a webhook which responds with the provided status codes in turn, the last one repeatedly.
+type receiver struct {
+	server   *httptest.Server
+	requests atomic.Int32
+	bodies   chan []byte
+}
+
+func newReceiver(t *testing.T, statuses ...int) *receiver {
+	r := &receiver{bodies: make(chan []byte, 10)}
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		i := int(r.requests.Add(1)) - 1
+		body, _ := io.ReadAll(req.Body)
+		w.WriteHeader(statuses[min(i, len(statuses)-1)])
+		if req.Header.Get("Content-Type") == "application/json" {
+			r.bodies <- body
+		}
+	}))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+// next waits for the next request body.
+func (r *receiver) next(t *testing.T) []byte {
+	t.Helper()
+	select {
+	case body := <-r.bodies:
+		return body
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a notification")
+		return nil
+	}
+}
+
+func TestNotify(t *testing.T) {
+	generic := newReceiver(t, http.StatusOK)
+	slack := newReceiver(t, http.StatusOK)
+	teams := newReceiver(t, http.StatusOK)
+	n := newTestNotifier(
+		Webhook{Name: "generic", URL: generic.server.URL, Format: FORMAT_GENERIC, Events: []string{EVENT_SCHEDULED, EVENT_FAILED}},
+		Webhook{Name: "slack", URL: slack.server.URL, Format: FORMAT_SLACK, Events: []string{EVENT_STARTED}},
+		Webhook{Name: "teams", URL: teams.server.URL, Format: FORMAT_TEAMS, Events: []string{EVENT_FAILED}},
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go n.Run(ctx)
+
+	n.Notify(testEvent(EVENT_SCHEDULED))
+	n.Notify(testEvent(EVENT_STARTED))
+	failed := testEvent(EVENT_FAILED)
+	failed.Error = "drain timed out"
+	n.Notify(failed)
+
+	var event Event
+	if err := json.Unmarshal(generic.next(t), &event); err != nil || event.Type != EVENT_SCHEDULED || event.Node != "node1" {
+		t.Fatalf("unexpected generic notification %+v, %v", event, err)
+	}
+	if err := json.Unmarshal(generic.next(t), &event); err != nil || event.Type != EVENT_FAILED || event.Error != "drain timed out" {
+		t.Fatalf("unexpected generic notification %+v, %v", event, err)
+	}
+
+	var message slackMessage
+	if err := json.Unmarshal(slack.next(t), &message); err != nil || !strings.Contains(message.Text, "Node node1 is about to be sniped in cluster cluster") {
+		t.Fatalf("unexpected Slack notification %+v, %v", message, err)
+	}
+
+	var card teamsMessage
+	if err := json.Unmarshal(teams.next(t), &card); err != nil || card.Type != "MessageCard" || !strings.Contains(card.Text, "drain timed out") {
+		t.Fatalf("unexpected Teams notification %+v, %v", card, err)
+	}
+
+	// events the webhooks did not ask for are not sent
+	time.Sleep(50 * time.Millisecond)
+	if got := slack.requests.Load() + teams.requests.Load(); got != 2 {
+		t.Fatalf("expected 2 requests to Slack and Teams, got %d", got)
+	}
+}
+
+func TestNotifyRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		requests int32
+		result   string
+	}{
+		{name: "success", statuses: []int{http.StatusNoContent}, requests: 1, result: stats.RESULT_SUCCEEDED},
+		{name: "server errors are retried", statuses: []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusOK}, requests: 3, result: stats.RESULT_SUCCEEDED},
+		{name: "rate limits are retried", statuses: []int{http.StatusTooManyRequests, http.StatusOK}, requests: 2, result: stats.RESULT_SUCCEEDED},
+		{name: "client errors are not retried", statuses: []int{http.StatusBadRequest}, requests: 1, result: stats.RESULT_FAILED},
+		{name: "attempts are limited", statuses: []int{http.StatusInternalServerError}, requests: MAX_ATTEMPTS, result: stats.RESULT_FAILED},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newReceiver(t, test.statuses...)
+			webhook := Webhook{Name: "retries-" + test.name, URL: r.server.URL, Events: []string{EVENT_FAILED}}
+			n := newTestNotifier(webhook)
+
+			err := n.send(context.TODO(), webhook, testEvent(EVENT_FAILED))
+			if stats.Result(err) != test.result {
+				t.Errorf("expected result %s, got error %v", test.result, err)
+			}
+			if got := r.requests.Load(); got != test.requests {
+				t.Errorf("expected %d requests, got %d", test.requests, got)
+			}
+		})
+	}
+}
+
+// syncBuffer collects log output written from the workers.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestNotifyKeepsURLOutOfLogs(t *testing.T) {
+	// nothing listens on the closed server, so every attempt fails with a network error
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	secret := "T000/B000/XXXXsecretXXXX"
+
+	tests := []struct {
+		name string
+		url  string
+	}{
+		{name: "unreachable", url: server.URL + "/services/" + secret},
+		{name: "invalid", url: "http://hooks.example.com/services/" + secret + "/%zz"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var logs syncBuffer
+			n := New([]Webhook{{Name: "chat", URL: test.url, Events: []string{EVENT_FAILED}}}, slog.New(slog.NewTextHandler(&logs, nil)))
+			n.backoff = time.Millisecond
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go n.Run(ctx)
+
+			n.Notify(testEvent(EVENT_FAILED))
+			deadline := time.Now().Add(5 * time.Second)
+			for !strings.Contains(logs.String(), "failed to send notification\"") {
+				if time.Now().After(deadline) {
+					t.Fatalf("expected the failed notification to be logged, got %s", logs.String())
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if output := logs.String(); strings.Contains(output, secret) {
+				t.Fatalf("expected the webhook URL not to be logged, got %s", output)
+			}
+		})
+	}
+}
+
+func TestNotifyDropsWhenQueueIsFull(t *testing.T) {
+	webhook := Webhook{Name: "full", URL: "http://localhost", Events: []string{EVENT_SCHEDULED}}
+	n := newTestNotifier(webhook)
+	dropped := testutil.ToFloat64(stats.Notifications.WithLabelValues("full", stats.NOTIFICATION_DROPPED))
+
+	// nothing is sent without Run, so the queue fills up, Notify must return anyway
+	done := make(chan struct{})
+	go func() {
+		for range QUEUE_SIZE + 3 {
+			n.Notify(testEvent(EVENT_SCHEDULED))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Notify not to block")
+	}
+	if got := testutil.ToFloat64(stats.Notifications.WithLabelValues("full", stats.NOTIFICATION_DROPPED)) - dropped; got != 3 {
+		t.Fatalf("expected 3 dropped notifications, got %v", got)
+	}
+}
+
+func TestPayload(t *testing.T) {
+	tests := []struct {
+		format  string
+		want    string
+		wantErr bool
+	}{
+		{format: "", want: `"type":"started"`},
+		{format: FORMAT_GENERIC, want: `"scheduled":"2024-06-01T11:00:00Z"`},
+		{format: FORMAT_SLACK, want: `{"text":"Node node1 is about to be sniped in cluster cluster (node pool pool, zone zone), planned for 2024-06-01T11:00:00Z"}`},
+		{format: FORMAT_TEAMS, want: `"title":"Node node1 is about to be sniped"`},
+		{format: "irc", wantErr: true},
+	}
+
+	for _, test := range tests {
+		body, err := Payload(test.format, testEvent(EVENT_STARTED))
+		if (err != nil) != test.wantErr {
+			t.Errorf("%q: expected error %v, got %v", test.format, test.wantErr, err)
+			continue
+		}
+		if !strings.Contains(string(body), test.want) {
+			t.Errorf("%q: expected %s in %s", test.format, test.want, body)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// slackMessage is the body of a Slack incoming webhook.
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+// teamsMessage is the body of a Microsoft Teams incoming webhook, a legacy actionable message card.
+type teamsMessage struct {
+	Type       string `json:"@type"`
+	Context    string `json:"@context"`
+	Summary    string `json:"summary"`
+	ThemeColor string `json:"themeColor"`
+	Title      string `json:"title"`
+	Text       string `json:"text"`
+}
+
+// Payload returns the body of the request for the event in the provided format.
+func Payload(format string, event Event) ([]byte, error) {
+	switch format {
+	case FORMAT_GENERIC, "":
+		return json.Marshal(event)
+	case FORMAT_SLACK:
+		return json.Marshal(slackMessage{Text: Text(event)})
+	case FORMAT_TEAMS:
+		color := "0076D7"
+		if event.Type == EVENT_FAILED {
+			color = "D9534F"
+		}
+		return json.Marshal(teamsMessage{
+			Type:       "MessageCard",
+			Context:    "https://schema.org/extensions",
+			Summary:    Title(event),
+			ThemeColor: color,
+			Title:      Title(event),
+			Text:       Text(event),
+		})
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// Title returns a one-line summary of the event.
+func Title(event Event) string {
+	switch event.Type {
+	case EVENT_SCHEDULED:
+		return fmt.Sprintf("Node %s is scheduled to be sniped", event.Node)
+	case EVENT_STARTED:
+		return fmt.Sprintf("Node %s is about to be sniped", event.Node)
+	case EVENT_CORDONED:
+		return fmt.Sprintf("Node %s was cordoned", event.Node)
+	case EVENT_DRAINED:
+		return fmt.Sprintf("Node %s was drained", event.Node)
+	case EVENT_DELETED:
+		return fmt.Sprintf("Node %s was sniped", event.Node)
+	case EVENT_FAILED:
+		return fmt.Sprintf("Snipe of node %s failed", event.Node)
+	default:
+		return fmt.Sprintf("Node %s: %s", event.Node, event.Type)
+	}
+}
+
+// Text returns the event as a short message for chats.
+func Text(event Event) string {
+	text := fmt.Sprintf("%s in cluster %s (node pool %s, zone %s)", Title(event), event.Cluster, event.NodePool, event.Zone)
+	if !event.Scheduled.IsZero() {
+		text += fmt.Sprintf(", planned for %s", event.Scheduled.Format(time.RFC3339))
+	}
+	if event.Message != "" {
+		text += ": " + event.Message
+	}
+	if event.Error != "" {
+		text += "\nError: " + event.Error
+	}
+	return text
+}
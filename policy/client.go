@@ -0,0 +1,94 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+)
+
+// Client is a typed client for SniperPolicies on top of the dynamic client, so that no generated clientset is needed.
+type Client struct {
+	resource dynamic.NamespaceableResourceInterface
+}
+
+// NewClient creates a Client using the provided dynamic client.
+func NewClient(client dynamic.Interface) *Client {
+	return &Client{resource: client.Resource(GroupVersionResource)}
+}
+
+// Get returns the SniperPolicy with the provided name.
+func (c *Client) Get(ctx context.Context, name string) (*SniperPolicy, error) {
+	obj, err := c.resource.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return FromUnstructured(obj)
+}
+
+// List returns all SniperPolicies.
+func (c *Client) List(ctx context.Context) (*SniperPolicyList, error) {
+	list, err := c.resource.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	policies := &SniperPolicyList{ListMeta: metav1.ListMeta{ResourceVersion: list.GetResourceVersion()}}
+	for i := range list.Items {
+		policy, err := FromUnstructured(&list.Items[i])
+		if err != nil {
+			return nil, err
+		}
+		policies.Items = append(policies.Items, *policy)
+	}
+	return policies, nil
+}
+
+// Create creates the provided SniperPolicy and returns it as stored by the API server.
+func (c *Client) Create(ctx context.Context, policy *SniperPolicy) (*SniperPolicy, error) {
+	obj, err := ToUnstructured(policy)
+	if err != nil {
+		return nil, err
+	}
+	obj, err = c.resource.Create(ctx, obj, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return FromUnstructured(obj)
+}
+
+// UpdateStatus replaces the status of the provided SniperPolicy. Changes of the spec are ignored by the API server.
+func (c *Client) UpdateStatus(ctx context.Context, policy *SniperPolicy) (*SniperPolicy, error) {
+	obj, err := ToUnstructured(policy)
+	if err != nil {
+		return nil, err
+	}
+	obj, err = c.resource.UpdateStatus(ctx, obj, metav1.UpdateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return FromUnstructured(obj)
+}
+
+// FromUnstructured converts an object returned by the dynamic client into a SniperPolicy.
+func FromUnstructured(obj *unstructured.Unstructured) (*SniperPolicy, error) {
+	var policy SniperPolicy
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.UnstructuredContent(), &policy); err != nil {
+		return nil, fmt.Errorf("failed to convert %s %q: %w", KIND, obj.GetName(), err)
+	}
+	return &policy, nil
+}
+
+// ToUnstructured converts a SniperPolicy into an object for the dynamic client.
+func ToUnstructured(policy *SniperPolicy) (*unstructured.Unstructured, error) {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(policy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert %s %q: %w", KIND, policy.Name, err)
+	}
+	obj := &unstructured.Unstructured{Object: content}
+	obj.SetAPIVersion(GROUP + "/" + VERSION)
+	obj.SetKind(KIND)
+	return obj, nil
+}
@@ -0,0 +1,103 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/torbendury/gke-preemptible-sniper/timing"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const MIN_DRAIN_TIMEOUT_SECONDS = 45 // minimum drain timeout in seconds that makes sense
+
+// Policy is a validated SniperPolicy, ready to be applied to nodes. Zero values fall back to the sniper configuration.
+type Policy struct {
+	Name                string
+	Selector            labels.Selector
+	AllowedTimes        timing.TimeSlots
+	BlockedTimes        timing.TimeSlots
+	Location            *time.Location
+	MinLifetime         time.Duration
+	MaxLifetime         time.Duration
+	MaxConcurrentSnipes int
+	NodeDrainTimeout    time.Duration
+}
+
+// Compile validates the SniperPolicy and converts it into a Policy. All invalid fields are reported at once.
+func Compile(p *SniperPolicy) (*Policy, error) {
+	var errs []error
+	policy := &Policy{
+		Name:                p.Name,
+		Location:            time.UTC,
+		MaxConcurrentSnipes: p.Spec.MaxConcurrentSnipes,
+		NodeDrainTimeout:    time.Duration(p.Spec.Drain.TimeoutSeconds) * time.Second,
+	}
+
+	var err error
+	if policy.Selector, err = metav1.LabelSelectorAsSelector(&p.Spec.NodeSelector); err != nil {
+		errs = append(errs, fmt.Errorf("spec.nodeSelector: %w", err))
+	}
+	if len(p.Spec.Allowed) > 0 {
+		if policy.AllowedTimes, err = timing.ParseTimeSlots(p.Spec.Allowed); err != nil {
+			errs = append(errs, fmt.Errorf("spec.allowed: %w", err))
+		}
+	}
+	if len(p.Spec.Blocked) > 0 {
+		if policy.BlockedTimes, err = timing.ParseTimeSlots(p.Spec.Blocked); err != nil {
+			errs = append(errs, fmt.Errorf("spec.blocked: %w", err))
+		}
+	}
+	if p.Spec.Timezone != "" {
+		if policy.Location, err = time.LoadLocation(p.Spec.Timezone); err != nil {
+			errs = append(errs, fmt.Errorf("spec.timezone: %w", err))
+		}
+	}
+
+	if p.Spec.MinLifetime != nil {
+		policy.MinLifetime = p.Spec.MinLifetime.Duration
+		if policy.MinLifetime < 0 {
+			errs = append(errs, fmt.Errorf("spec.minLifetime: %s must not be negative", policy.MinLifetime))
+		}
+	}
+	if p.Spec.MaxLifetime != nil {
+		policy.MaxLifetime = p.Spec.MaxLifetime.Duration
+		if policy.MaxLifetime <= 0 {
+			errs = append(errs, fmt.Errorf("spec.maxLifetime: %s must be positive", policy.MaxLifetime))
+		} else if policy.MaxLifetime < policy.MinLifetime {
+			errs = append(errs, fmt.Errorf("spec.maxLifetime: %s is less than spec.minLifetime %s", policy.MaxLifetime, policy.MinLifetime))
+		}
+	}
+
+	if policy.MaxConcurrentSnipes < 0 {
+		errs = append(errs, fmt.Errorf("spec.maxConcurrentSnipes: %d must not be negative", policy.MaxConcurrentSnipes))
+	}
+	if timeout := p.Spec.Drain.TimeoutSeconds; timeout != 0 && timeout < MIN_DRAIN_TIMEOUT_SECONDS {
+		errs = append(errs, fmt.Errorf("spec.drain.timeoutSeconds: %d is less than the minimum of %d", timeout, MIN_DRAIN_TIMEOUT_SECONDS))
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return policy, nil
+}
+
+// Matches reports whether the policy applies to the node.
+func (p *Policy) Matches(node *v1.Node) bool {
+	return p.Selector.Matches(labels.Set(node.Labels))
+}
+
+// SnipeWindow returns the earliest and latest time a node created at the provided time may be sniped according to its lifetime bounds.
+// Without a maximum lifetime, or if the node is older than its maximum lifetime already, the window is one day long.
+func (p *Policy) SnipeWindow(created, now time.Time) (time.Time, time.Time) {
+	earliest := now
+	if minimum := created.Add(p.MinLifetime); minimum.After(earliest) {
+		earliest = minimum
+	}
+	if maximum := created.Add(p.MaxLifetime); p.MaxLifetime > 0 && maximum.After(earliest) {
+		return earliest, maximum
+	}
+	return earliest, earliest.Add(24 * time.Hour)
+}
@@ -0,0 +1,112 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testPolicy(name string, spec SniperPolicySpec) *SniperPolicy {
+	return &SniperPolicy{ObjectMeta: metav1.ObjectMeta{Name: name, Generation: 1}, Spec: spec}
+}
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    SniperPolicySpec
+		wantErr []string
+	}{
+		{
+			name: "valid",
+			spec: SniperPolicySpec{
+				NodeSelector:        metav1.LabelSelector{MatchLabels: map[string]string{"pool": "batch"}},
+				Allowed:             []string{"08:00-16:00"},
+				Blocked:             []string{"12:00-13:00"},
+				Timezone:            "UTC",
+				MinLifetime:         &metav1.Duration{Duration: time.Hour},
+				MaxLifetime:         &metav1.Duration{Duration: 20 * time.Hour},
+				MaxConcurrentSnipes: 1,
+				Drain:               DrainOptions{TimeoutSeconds: 120},
+			},
+		},
+		{
+			name: "all errors are reported",
+			spec: SniperPolicySpec{
+				NodeSelector: metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "pool", Operator: "Sometimes"}}},
+				Allowed:      []string{"8-16"},
+				Timezone:     "Mars/Olympus_Mons",
+				MinLifetime:  &metav1.Duration{Duration: 2 * time.Hour},
+				MaxLifetime:  &metav1.Duration{Duration: time.Hour},
+				Drain:        DrainOptions{TimeoutSeconds: 5},
+			},
+			wantErr: []string{"spec.nodeSelector", "spec.allowed", "spec.timezone", "spec.maxLifetime", "spec.drain.timeoutSeconds"},
+		},
+		{
+			name:    "negative concurrency",
+			spec:    SniperPolicySpec{MaxConcurrentSnipes: -1},
+			wantErr: []string{"spec.maxConcurrentSnipes"},
+		},
+	}
+
+	for _, test := range tests {
+		policy, err := Compile(testPolicy("policy", test.spec))
+		if len(test.wantErr) == 0 {
+			if err != nil {
+				t.Errorf("%s: expected no error, got %v", test.name, err)
+			} else if policy.NodeDrainTimeout != 2*time.Minute || len(policy.AllowedTimes) != 1 {
+				t.Errorf("%s: unexpected policy %+v", test.name, policy)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: expected error", test.name)
+			continue
+		}
+		for _, want := range test.wantErr {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: expected error to mention %q, got %v", test.name, want, err)
+			}
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	policy, err := Compile(testPolicy("policy", SniperPolicySpec{
+		NodeSelector: metav1.LabelSelector{MatchLabels: map[string]string{"pool": "batch"}},
+	}))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	batch := &v1.Node{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"pool": "batch"}}}
+	web := &v1.Node{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"pool": "web"}}}
+	if !policy.Matches(batch) || policy.Matches(web) {
+		t.Fatalf("expected policy to match the batch node only")
+	}
+}
+
+func TestSnipeWindow(t *testing.T) {
+	created := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		policy   Policy
+		now      time.Time
+		earliest time.Time
+		latest   time.Time
+	}{
+		{name: "no bounds", now: created, earliest: created, latest: created.Add(24 * time.Hour)},
+		{name: "minimum lifetime", policy: Policy{MinLifetime: 2 * time.Hour}, now: created, earliest: created.Add(2 * time.Hour), latest: created.Add(26 * time.Hour)},
+		{name: "maximum lifetime", policy: Policy{MaxLifetime: 12 * time.Hour}, now: created.Add(time.Hour), earliest: created.Add(time.Hour), latest: created.Add(12 * time.Hour)},
+		{name: "older than maximum lifetime", policy: Policy{MaxLifetime: 12 * time.Hour}, now: created.Add(13 * time.Hour), earliest: created.Add(13 * time.Hour), latest: created.Add(37 * time.Hour)},
+	}
+
+	for _, test := range tests {
+		earliest, latest := test.policy.SnipeWindow(created, test.now)
+		if !earliest.Equal(test.earliest) || !latest.Equal(test.latest) {
+			t.Errorf("%s: expected window %v - %v, got %v - %v", test.name, test.earliest, test.latest, earliest, latest)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Package policy provides the SniperPolicy custom resource, which declares how the nodes matched by its selector are sniped.
+// Policies override the schedule, drain timeout and concurrency of the sniper configuration for their nodes.
+//
+// +k8s:deepcopy-gen=package
+// +groupName=gke-preemptible-sniper.torbendury.github.io
+package policy
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	GROUP    = "gke-preemptible-sniper.torbendury.github.io"
+	VERSION  = "v1alpha1"
+	KIND     = "SniperPolicy"
+	RESOURCE = "sniperpolicies"
+
+	CONDITION_READY = "Ready" // true if the policy is valid and applied to its nodes
+)
+
+// GroupVersionResource identifies SniperPolicies in the Kubernetes API.
+var GroupVersionResource = schema.GroupVersionResource{Group: GROUP, Version: VERSION, Resource: RESOURCE}
+
+// SniperPolicy declares how the nodes matched by its selector are sniped. It is cluster-scoped.
+//
+// +genclient
+// +genclient:nonNamespaced
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:subresource:status
+type SniperPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   SniperPolicySpec   `json:"spec"`
+	Status SniperPolicyStatus `json:"status,omitempty"`
+}
+
+// SniperPolicySpec is the desired behavior of a SniperPolicy. Fields which are not set fall back to the sniper configuration.
+type SniperPolicySpec struct {
+	// NodeSelector selects the nodes the policy applies to. If several policies match a node, the first one by name wins.
+	NodeSelector metav1.LabelSelector `json:"nodeSelector"`
+	// Allowed contains the time slots in which nodes may be sniped, e.g. "08:00-16:00".
+	Allowed []string `json:"allowed,omitempty"`
+	// Blocked contains the time slots in which nodes must not be sniped.
+	Blocked []string `json:"blocked,omitempty"`
+	// Timezone is the IANA name of the time zone of the time slots, UTC if empty.
+	Timezone string `json:"timezone,omitempty"`
+	// MinLifetime is the minimum age of a node before it is sniped.
+	MinLifetime *metav1.Duration `json:"minLifetime,omitempty"`
+	// MaxLifetime is the maximum age of a node when it is sniped.
+	MaxLifetime *metav1.Duration `json:"maxLifetime,omitempty"`
+	// MaxConcurrentSnipes is the maximum number of nodes of the policy sniped at the same time, 0 for no limit.
+	MaxConcurrentSnipes int `json:"maxConcurrentSnipes,omitempty"`
+	// Drain configures how the nodes are drained.
+	Drain DrainOptions `json:"drain,omitempty"`
+}
+
+// DrainOptions configures how the nodes of a SniperPolicy are drained.
+type DrainOptions struct {
+	// TimeoutSeconds is the maximum time for evicting all Pods of a node.
+	TimeoutSeconds int `json:"timeoutSeconds,omitempty"`
+}
+
+// SniperPolicyStatus is the observed state of a SniperPolicy, reported by the sniper.
+type SniperPolicyStatus struct {
+	// ObservedGeneration is the generation of the spec the status was reported for.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// MatchedNodes is the number of nodes the policy applies to.
+	MatchedNodes int `json:"matchedNodes"`
+	// NextSnipe is the earliest planned snipe of the nodes of the policy.
+	NextSnipe *metav1.Time `json:"nextSnipe,omitempty"`
+	// LastSnipe is the time the last node of the policy was sniped.
+	LastSnipe *metav1.Time `json:"lastSnipe,omitempty"`
+	// Conditions contains the Ready condition of the policy.
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// SniperPolicyList is a list of SniperPolicies.
+//
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+type SniperPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []SniperPolicy `json:"items"`
+}
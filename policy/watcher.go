@@ -0,0 +1,157 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+const SYNC_TIMEOUT = 30 * time.Second // maximum time to wait for the first list of SniperPolicies
+
+// Watcher keeps a cache of all SniperPolicies, fed by an informer, and reports their status.
+type Watcher struct {
+	client   *Client
+	informer cache.SharedIndexInformer
+	logger   *slog.Logger
+
+	mu         sync.Mutex
+	lastSnipes map[string]time.Time // time of the last snipe per policy since the start of the sniper
+}
+
+// NewWatcher creates a Watcher using the provided dynamic client. It does not watch anything before Start is called.
+func NewWatcher(client dynamic.Interface, resync time.Duration, logger *slog.Logger) *Watcher {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, resync)
+	return &Watcher{
+		client:     NewClient(client),
+		informer:   factory.ForResource(GroupVersionResource).Informer(),
+		logger:     logger,
+		lastSnipes: make(map[string]time.Time),
+	}
+}
+
+// Start starts watching the SniperPolicies until the context is done and waits until the cache is filled.
+func (w *Watcher) Start(ctx context.Context) error {
+	go w.informer.Run(ctx.Done())
+
+	syncCtx, cancel := context.WithTimeout(ctx, SYNC_TIMEOUT)
+	defer cancel()
+	if !cache.WaitForCacheSync(syncCtx.Done(), w.informer.HasSynced) {
+		return fmt.Errorf("failed to sync %s, is the CustomResourceDefinition installed?", RESOURCE)
+	}
+	return nil
+}
+
+// Match returns the valid policy which applies to the node, or nil if there is none.
+// If several policies match, the first one by name wins.
+func (w *Watcher) Match(node *v1.Node) *Policy {
+	for _, p := range w.policies() {
+		if compiled, err := Compile(p); err == nil && compiled.Matches(node) {
+			return compiled
+		}
+	}
+	return nil
+}
+
+// Sniped records the snipe of a node of the policy with the provided name.
+func (w *Watcher) Sniped(name string, t time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lastSnipes[name] = t
+}
+
+// UpdateStatus reports the status of all SniperPolicies for the provided nodes.
+// nextSnipe returns the planned snipe time of a node, if there is one. Policies whose status did not change are not updated.
+func (w *Watcher) UpdateStatus(ctx context.Context, nodes []*v1.Node, nextSnipe func(*v1.Node) (time.Time, bool), now time.Time) error {
+	policies := w.policies()
+	compiled := make([]*Policy, len(policies))
+	statuses := make([]SniperPolicyStatus, len(policies))
+	for i, p := range policies {
+		statuses[i] = SniperPolicyStatus{
+			ObservedGeneration: p.Generation,
+			LastSnipe:          p.Status.LastSnipe,
+			Conditions:         append([]metav1.Condition(nil), p.Status.Conditions...),
+		}
+
+		var err error
+		compiled[i], err = Compile(p)
+		condition := metav1.Condition{
+			Type:               CONDITION_READY,
+			Status:             metav1.ConditionTrue,
+			ObservedGeneration: p.Generation,
+			LastTransitionTime: metav1.NewTime(now),
+			Reason:             "Applied",
+			Message:            "policy is applied to matching nodes",
+		}
+		if err != nil {
+			condition.Status = metav1.ConditionFalse
+			condition.Reason = "Invalid"
+			condition.Message = err.Error()
+		}
+		meta.SetStatusCondition(&statuses[i].Conditions, condition)
+
+		w.mu.Lock()
+		if last, exists := w.lastSnipes[p.Name]; exists && (statuses[i].LastSnipe == nil || last.After(statuses[i].LastSnipe.Time)) {
+			statuses[i].LastSnipe = &metav1.Time{Time: last}
+		}
+		w.mu.Unlock()
+	}
+
+	// every node counts for the first matching policy only, the same one Match returns
+	for _, node := range nodes {
+		for i, p := range compiled {
+			if p == nil || !p.Matches(node) {
+				continue
+			}
+			statuses[i].MatchedNodes++
+			if next, planned := nextSnipe(node); planned && (statuses[i].NextSnipe == nil || next.Before(statuses[i].NextSnipe.Time)) {
+				statuses[i].NextSnipe = &metav1.Time{Time: next}
+			}
+			break
+		}
+	}
+
+	var errs []error
+	for i, p := range policies {
+		if equality.Semantic.DeepEqual(p.Status, statuses[i]) {
+			continue
+		}
+		updated := p.DeepCopy()
+		updated.Status = statuses[i]
+		if _, err := w.client.UpdateStatus(ctx, updated); err != nil {
+			errs = append(errs, fmt.Errorf("failed to update status of %s %q: %w", KIND, p.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// policies returns all SniperPolicies in the cache, sorted by name. Objects which cannot be converted are logged and skipped.
+func (w *Watcher) policies() []*SniperPolicy {
+	var policies []*SniperPolicy
+	for _, obj := range w.informer.GetStore().List() {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		p, err := FromUnstructured(u)
+		if err != nil {
+			w.logger.Error("failed to read policy", "policy", u.GetName(), "error", err)
+			continue
+		}
+		policies = append(policies, p)
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Name < policies[j].Name })
+	return policies
+}
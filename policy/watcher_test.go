@@ -0,0 +1,131 @@
+package policy
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func newFakeDynamicClient(t *testing.T, policies ...*SniperPolicy) *dynamicfake.FakeDynamicClient {
+	t.Helper()
+	var objects []runtime.Object
+	for _, p := range policies {
+		obj, err := ToUnstructured(p)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		objects = append(objects, obj)
+	}
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{GroupVersionResource: KIND + "List"}, objects...)
+}
+
+func TestClient(t *testing.T) {
+	client := NewClient(newFakeDynamicClient(t))
+	ctx := context.TODO()
+
+	created, err := client.Create(ctx, testPolicy("batch", SniperPolicySpec{
+		Allowed:     []string{"08:00-16:00"},
+		MaxLifetime: &metav1.Duration{Duration: 12 * time.Hour},
+	}))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if created.Spec.MaxLifetime.Duration != 12*time.Hour {
+		t.Fatalf("expected spec to survive the round trip, got %+v", created.Spec)
+	}
+
+	created.Status.MatchedNodes = 3
+	if _, err := client.UpdateStatus(ctx, created); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	got, err := client.Get(ctx, "batch")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if got.Status.MatchedNodes != 3 {
+		t.Fatalf("expected 3 matched nodes, got %d", got.Status.MatchedNodes)
+	}
+
+	list, err := client.List(ctx)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(list.Items) != 1 || list.Items[0].Name != "batch" {
+		t.Fatalf("expected one policy, got %+v", list.Items)
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	batch := testPolicy("a-batch", SniperPolicySpec{NodeSelector: metav1.LabelSelector{MatchLabels: map[string]string{"pool": "batch"}}})
+	all := testPolicy("b-all", SniperPolicySpec{})
+	invalid := testPolicy("c-invalid", SniperPolicySpec{Timezone: "Mars/Olympus_Mons"})
+	client := newFakeDynamicClient(t, batch, all, invalid)
+
+	w := NewWatcher(client, 0, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := w.Start(ctx); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	batchNode := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: map[string]string{"pool": "batch"}}}
+	webNode := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node2", Labels: map[string]string{"pool": "web"}}}
+	if p := w.Match(batchNode); p == nil || p.Name != "a-batch" {
+		t.Fatalf("expected first policy by name to win, got %+v", p)
+	}
+	if p := w.Match(webNode); p == nil || p.Name != "b-all" {
+		t.Fatalf("expected catch-all policy, got %+v", p)
+	}
+
+	now := time.Now().Truncate(time.Second)
+	next := now.Add(time.Hour)
+	w.Sniped("a-batch", now)
+	nextSnipe := func(node *v1.Node) (time.Time, bool) { return next, node.Name == "node1" }
+	if err := w.UpdateStatus(ctx, []*v1.Node{batchNode, webNode}, nextSnipe, now); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	policies := NewClient(client)
+	tests := []struct {
+		name      string
+		matched   int
+		nextSnipe bool
+		lastSnipe bool
+		ready     bool
+	}{
+		{name: "a-batch", matched: 1, nextSnipe: true, lastSnipe: true, ready: true},
+		{name: "b-all", matched: 1, ready: true},
+		{name: "c-invalid", matched: 0, ready: false},
+	}
+	for _, test := range tests {
+		p, err := policies.Get(ctx, test.name)
+		if err != nil {
+			t.Fatalf("%s: expected no error, got %v", test.name, err)
+		}
+		if p.Status.MatchedNodes != test.matched {
+			t.Errorf("%s: expected %d matched nodes, got %d", test.name, test.matched, p.Status.MatchedNodes)
+		}
+		if (p.Status.NextSnipe != nil) != test.nextSnipe || (test.nextSnipe && !p.Status.NextSnipe.Time.Equal(next)) {
+			t.Errorf("%s: unexpected next snipe %v", test.name, p.Status.NextSnipe)
+		}
+		if (p.Status.LastSnipe != nil) != test.lastSnipe {
+			t.Errorf("%s: unexpected last snipe %v", test.name, p.Status.LastSnipe)
+		}
+		if meta.IsStatusConditionTrue(p.Status.Conditions, CONDITION_READY) != test.ready {
+			t.Errorf("%s: expected ready = %v, got %+v", test.name, test.ready, p.Status.Conditions)
+		}
+		if p.Status.ObservedGeneration != 1 {
+			t.Errorf("%s: expected observed generation 1, got %d", test.name, p.Status.ObservedGeneration)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// Package preemption detects preemptions of nodes by Compute Engine which happened before the sniper got to them.
+// It compares the nodes the sniper manages against the "compute.instances.preempted" zone operations and counts
+// sniped vs. preempted nodes per node pool.
+package preemption
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/torbendury/gke-preemptible-sniper/gcloud"
+	"github.com/torbendury/gke-preemptible-sniper/k8s"
+	"github.com/torbendury/gke-preemptible-sniper/stats"
+)
+
+const (
+	CAUSE_SNIPED    = "sniped"
+	CAUSE_PREEMPTED = "preempted"
+
+	NODE_RETENTION = 24 * time.Hour // how long a node is remembered after it was last tracked
+)
+
+// Node is a node managed by the sniper.
+type Node struct {
+	Name     string
+	Pool     string
+	Location k8s.ProviderID
+	Planned  time.Time // planned snipe time
+}
+
+type trackedNode struct {
+	Node
+	lastSeen time.Time
+}
+
+// Clock tells the time. The sniper hands in its own clock, so that detection and planned snipe times agree.
+type Clock interface {
+	Now() time.Time
+}
+
+// Detector remembers the nodes managed by the sniper and checks whether Compute Engine preempted any of them.
+type Detector struct {
+	googleClient gcloud.InstanceAPI
+	clock        Clock
+	logger       *slog.Logger
+
+	mu        sync.Mutex
+	nodes     map[string]trackedNode // keyed by project/zone/instance
+	seen      map[string]time.Time   // IDs of preemption operations already counted
+	lastCheck time.Time
+}
+
+// NewDetector creates a new Detector. Only preemptions happening after its creation are detected.
+func NewDetector(googleClient gcloud.InstanceAPI, clock Clock, logger *slog.Logger) *Detector {
+	return &Detector{
+		googleClient: googleClient,
+		clock:        clock,
+		logger:       logger,
+		nodes:        make(map[string]trackedNode),
+		seen:         make(map[string]time.Time),
+		lastCheck:    clock.Now(),
+	}
+}
+
+// Track remembers a node, so that a preemption of its instance can be detected.
+// Nodes are kept for NODE_RETENTION after they were last tracked, since preempted nodes disappear from the cluster.
+func (d *Detector) Track(node Node) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.nodes[node.Location.String()] = trackedNode{Node: node, lastSeen: d.clock.Now()}
+}
+
+// Sniped records that the sniper deleted the node's instance and forgets the node.
+func (d *Detector) Sniped(node Node) {
+	d.mu.Lock()
+	delete(d.nodes, node.Location.String())
+	d.mu.Unlock()
+
+	stats.NodeTerminations.WithLabelValues(node.Pool, CAUSE_SNIPED).Inc()
+}
+
+// Check lists the preemptions in all zones of the tracked nodes since the last check
+// and records a preemption for every tracked node it finds.
+func (d *Detector) Check(ctx context.Context) error {
+	d.mu.Lock()
+	since := d.lastCheck
+	zones := make(map[[2]string]bool)
+	for _, node := range d.nodes {
+		zones[[2]string{node.Location.Project, node.Location.Zone}] = true
+	}
+	d.mu.Unlock()
+
+	now := d.clock.Now()
+	var lastErr error
+	for zone := range zones {
+		preemptions, err := d.googleClient.ListPreemptions(ctx, zone[0], zone[1], since)
+		if err != nil {
+			d.logger.Error("failed to list preemptions", "project", zone[0], "zone", zone[1], "error", err)
+			lastErr = err
+			continue
+		}
+		for _, preemption := range preemptions {
+			d.record(k8s.ProviderID{Project: zone[0], Zone: zone[1], Instance: preemption.InstanceName}, preemption)
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// zones which failed are checked again from the same point in time, duplicates are filtered by operation ID
+	if lastErr == nil {
+		d.lastCheck = now
+	}
+	for key, node := range d.nodes {
+		if now.Sub(node.lastSeen) > NODE_RETENTION {
+			delete(d.nodes, key)
+		}
+	}
+	for id, at := range d.seen {
+		if now.Sub(at) > NODE_RETENTION {
+			delete(d.seen, id)
+		}
+	}
+	return lastErr
+}
+
+// record counts a preemption if it belongs to a tracked node and was not counted before.
+func (d *Detector) record(location k8s.ProviderID, preemption gcloud.Preemption) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, counted := d.seen[preemption.ID]; counted {
+		return
+	}
+	node, tracked := d.nodes[location.String()]
+	if !tracked {
+		return
+	}
+	d.seen[preemption.ID] = preemption.Time
+	delete(d.nodes, location.String())
+
+	stats.NodeTerminations.WithLabelValues(node.Pool, CAUSE_PREEMPTED).Inc()
+	d.logger.Warn("node was preempted before it was sniped", "node", node.Name, "pool", node.Pool, "instance", location.Instance,
+		"zone", location.Zone, "preempted", preemption.Time.Format(time.RFC3339), "planned", node.Planned.Format(time.RFC3339))
+}
+
+// Run checks for preemptions in the provided interval until the context is done.
+func (d *Detector) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.Check(ctx)
+		}
+	}
+}
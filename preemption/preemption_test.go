@@ -0,0 +1,138 @@
+package preemption
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/torbendury/gke-preemptible-sniper/gcloud"
+	"github.com/torbendury/gke-preemptible-sniper/k8s"
+	"github.com/torbendury/gke-preemptible-sniper/stats"
+	"google.golang.org/api/googleapi"
+)
+
+// fakeClock is a clock which only moves when the test advances it.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func newTestDetector(fake *gcloud.FakeInstanceAPI) (*Detector, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	return NewDetector(fake, clock, slog.New(slog.NewTextHandler(io.Discard, nil))), clock
+}
+
+func terminations(pool, cause string) float64 {
+	return testutil.ToFloat64(stats.NodeTerminations.WithLabelValues(pool, cause))
+}
+
+func TestCheckCountsPreemptedNodes(t *testing.T) {
+	fake := gcloud.NewFakeInstanceAPI()
+	detector, clock := newTestDetector(fake)
+	ctx := context.Background()
+
+	preempted := Node{Name: "node1", Pool: "pool-preempted", Location: k8s.ProviderID{Project: "project", Zone: "zone", Instance: "instance-1"}, Planned: clock.Now().Add(time.Hour)}
+	survivor := Node{Name: "node2", Pool: "pool-preempted", Location: k8s.ProviderID{Project: "project", Zone: "zone", Instance: "instance-2"}, Planned: clock.Now().Add(time.Hour)}
+	detector.Track(preempted)
+	detector.Track(survivor)
+
+	fake.Preempt("project", "zone", "instance-1", clock.Now().Add(time.Minute))
+	// preemptions of instances which are not tracked, e.g. of other clusters, are ignored
+	fake.Preempt("project", "zone", "instance-foreign", clock.Now().Add(time.Minute))
+
+	if err := detector.Check(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := terminations("pool-preempted", CAUSE_PREEMPTED); got != 1 {
+		t.Fatalf("expected 1 preempted node, got %v", got)
+	}
+
+	// a second check must not count the same preemption again
+	if err := detector.Check(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := terminations("pool-preempted", CAUSE_PREEMPTED); got != 1 {
+		t.Fatalf("expected preemption to be counted once, got %v", got)
+	}
+}
+
+func TestCheckIgnoresPreemptionsBeforeTracking(t *testing.T) {
+	fake := gcloud.NewFakeInstanceAPI()
+	detector, clock := newTestDetector(fake)
+	fake.Preempt("project", "zone", "instance-1", clock.Now().Add(-time.Hour))
+	detector.Track(Node{Name: "node1", Pool: "pool-old", Location: k8s.ProviderID{Project: "project", Zone: "zone", Instance: "instance-1"}})
+
+	if err := detector.Check(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := terminations("pool-old", CAUSE_PREEMPTED); got != 0 {
+		t.Fatalf("expected old preemption to be ignored, got %v", got)
+	}
+}
+
+func TestSnipedNodesAreNotCountedAsPreempted(t *testing.T) {
+	fake := gcloud.NewFakeInstanceAPI()
+	detector, clock := newTestDetector(fake)
+
+	node := Node{Name: "node1", Pool: "pool-sniped", Location: k8s.ProviderID{Project: "project", Zone: "zone", Instance: "instance-1"}}
+	detector.Track(node)
+	detector.Sniped(node)
+	fake.Preempt("project", "zone", "instance-1", clock.Now().Add(time.Minute))
+
+	if err := detector.Check(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := terminations("pool-sniped", CAUSE_SNIPED); got != 1 {
+		t.Fatalf("expected 1 sniped node, got %v", got)
+	}
+	if got := terminations("pool-sniped", CAUSE_PREEMPTED); got != 0 {
+		t.Fatalf("expected no preempted node, got %v", got)
+	}
+}
+
+func TestCheckRetriesFailedZones(t *testing.T) {
+	fake := gcloud.NewFakeInstanceAPI()
+	detector, clock := newTestDetector(fake)
+	detector.Track(Node{Name: "node1", Pool: "pool-retry", Location: k8s.ProviderID{Project: "project", Zone: "zone", Instance: "instance-1"}})
+	fake.Preempt("project", "zone", "instance-1", clock.Now().Add(time.Minute))
+
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable}
+	fake.SetError("ListPreemptions", unavailable)
+	if err := detector.Check(context.Background()); !errors.Is(err, unavailable) {
+		t.Fatalf("expected configured error, got %v", err)
+	}
+
+	// the next check still finds the preemption, since the failed check did not move the window forward
+	fake.SetError("ListPreemptions", nil)
+	if err := detector.Check(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := terminations("pool-retry", CAUSE_PREEMPTED); got != 1 {
+		t.Fatalf("expected 1 preempted node, got %v", got)
+	}
+}
+
+func TestCheckForgetsNodesAfterRetention(t *testing.T) {
+	fake := gcloud.NewFakeInstanceAPI()
+	detector, clock := newTestDetector(fake)
+	detector.Track(Node{Name: "node1", Pool: "pool-gone", Location: k8s.ProviderID{Project: "project", Zone: "zone", Instance: "instance-1"}})
+
+	// the node left the cluster without being preempted, its instance name is reused a day later
+	clock.now = clock.now.Add(NODE_RETENTION + time.Minute)
+	if err := detector.Check(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fake.Preempt("project", "zone", "instance-1", clock.Now().Add(time.Minute))
+	if err := detector.Check(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := terminations("pool-gone", CAUSE_PREEMPTED); got != 0 {
+		t.Fatalf("expected the forgotten node not to be counted, got %v", got)
+	}
+}
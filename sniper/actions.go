@@ -0,0 +1,184 @@
+package sniper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/torbendury/gke-preemptible-sniper/notify"
+	"github.com/torbendury/gke-preemptible-sniper/policy"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Operator actions change the schedule of nodes on request. They only write annotations and queue the node,
+// the snipe itself happens in ProcessNode with all its checks, limits and the pause switch.
+
+var (
+	// ErrNodeNotFound is returned by operator actions for nodes which are not in the cache.
+	ErrNodeNotFound = errors.New("node not found")
+	// ErrNotEligible is returned by operator actions for nodes which are excluded or not preemptible.
+	ErrNotEligible = errors.New("node is not eligible")
+	// ErrInvalidTime is returned by Reschedule for times which are not in the future or not allowed for the node.
+	ErrInvalidTime = errors.New("invalid snipe time")
+)
+
+// SnipeNow schedules the node for now and queues it, so that it is sniped right away.
+func (s *Sniper) SnipeNow(ctx context.Context, nodeName string) (time.Time, error) {
+	node, _, _, err := s.eligibleNode(nodeName)
+	if err != nil {
+		return time.Time{}, err
+	}
+	now := s.clock.Now()
+	if err := s.setSchedule(ctx, node, now, "operator requested an immediate snipe"); err != nil {
+		return time.Time{}, err
+	}
+	if until, exempt := s.exemptUntil(node); exempt && now.Before(until) {
+		s.logger.Warn("node is exempt, it is sniped once the exemption ends", "node", nodeName, "until", until.Format(time.RFC3339))
+	}
+	return now, nil
+}
+
+// Reschedule schedules the node at the provided time. Without time, a random allowed time is planned like for a new node.
+// A provided time must be in the future, within the allowed and outside the blocked times and within the lifetime bounds of the node's policy.
+func (s *Sniper) Reschedule(ctx context.Context, nodeName string, t time.Time) (time.Time, error) {
+	node, cfg, pol, err := s.eligibleNode(nodeName)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if t.IsZero() {
+		t, err = planSnipe(node, cfg, pol, s.clock.Now(), time.Time{})
+	} else {
+		err = checkSnipeTime(node, cfg, pol, t, s.clock.Now())
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t, s.setSchedule(ctx, node, t, "operator rescheduled the snipe")
+}
+
+// checkSnipeTime checks a snipe time requested by an operator against the rules planSnipe plans with.
+func checkSnipeTime(node *v1.Node, cfg Config, pol *policy.Policy, t, now time.Time) error {
+	if !t.After(now) {
+		return fmt.Errorf("%w: %s is not in the future, use snipe to snipe the node right away", ErrInvalidTime, t.Format(time.RFC3339))
+	}
+	loc := time.Local
+	if pol != nil {
+		loc = pol.Location
+	}
+	if local := t.In(loc); !cfg.AllowedTimes.IsTimeAllowed(local) || cfg.BlockedTimes.IsTimeBlocked(local) {
+		return fmt.Errorf("%w: %s is not within the allowed times %v or within the blocked times %v", ErrInvalidTime, t.Format(time.RFC3339), cfg.AllowedTimes, cfg.BlockedTimes)
+	}
+	if pol == nil {
+		return nil
+	}
+	created := node.CreationTimestamp.Time
+	if minimum := created.Add(pol.MinLifetime); t.Before(minimum) {
+		return fmt.Errorf("%w: %s is before the minimum lifetime of policy %s ends at %s", ErrInvalidTime, t.Format(time.RFC3339), pol.Name, minimum.Format(time.RFC3339))
+	}
+	if maximum := created.Add(pol.MaxLifetime); pol.MaxLifetime > 0 && t.After(maximum) {
+		return fmt.Errorf("%w: %s is after the maximum lifetime of policy %s ends at %s", ErrInvalidTime, t.Format(time.RFC3339), pol.Name, maximum.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// RescheduleAll moves the snipes of all eligible nodes which are scheduled before notBefore to a random allowed time within one day after it.
+// It returns the new snipe times by node name. Nodes which failed are skipped and their errors are returned together.
+func (s *Sniper) RescheduleAll(ctx context.Context, notBefore time.Time) (map[string]time.Time, error) {
+	rescheduled := make(map[string]time.Time)
+	var errs []error
+	for _, node := range s.watcher.Nodes() {
+		planned, scheduled := s.nextSnipe(node)
+		if !scheduled || !planned.Before(notBefore) {
+			continue
+		}
+		_, cfg, pol, err := s.eligibleNode(node.Name)
+		if errors.Is(err, ErrNotEligible) {
+			continue
+		}
+		var t time.Time
+		if err == nil {
+			t, err = planSnipe(node, cfg, pol, s.clock.Now(), notBefore)
+		}
+		if err == nil {
+			err = s.setSchedule(ctx, node, t, fmt.Sprintf("operator moved all snipes to after %s", notBefore.Format(time.RFC3339)))
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("node %s: %w", node.Name, err))
+			continue
+		}
+		rescheduled[node.Name] = t
+	}
+	return rescheduled, errors.Join(errs...)
+}
+
+// Exempt keeps the node from being sniped for the provided duration and returns the end of the exemption. Its schedule is kept, so that an overdue node is sniped once the exemption ends.
+func (s *Sniper) Exempt(ctx context.Context, nodeName string, duration time.Duration) (time.Time, error) {
+	node, err := s.watcher.Node(nodeName)
+	if apierrors.IsNotFound(err) {
+		return time.Time{}, fmt.Errorf("%w: %s", ErrNodeNotFound, nodeName)
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	// the end is taken from the sniper clock, which ProcessNode compares it against
+	until := s.clock.Now().Add(duration).Truncate(time.Second)
+	err = s.mutator.SetNodeAnnotation(ctx, nodeName, EXEMPT_ANNOTATION, until.Format(time.RFC3339))
+	if err != nil {
+		return time.Time{}, err
+	}
+	s.event(node, v1.EventTypeNormal, EVENT_REASON_EXEMPTED, "Operator exempted the node from sniping until %s", until.Format(time.RFC3339))
+	s.watcher.Enqueue(nodeName)
+	return until, nil
+}
+
+// exemptUntil returns the end of the exemption of the node, if it has one.
+func (s *Sniper) exemptUntil(node *v1.Node) (time.Time, bool) {
+	value, exists := node.Annotations[EXEMPT_ANNOTATION]
+	if !exists {
+		value, exists = s.mutator.PlannedAnnotation(node.Name, EXEMPT_ANNOTATION)
+	}
+	if !exists {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	return t, err == nil
+}
+
+// eligibleNode returns the node from the cache together with its configuration and policy, if it may be sniped.
+func (s *Sniper) eligibleNode(nodeName string) (*v1.Node, Config, *policy.Policy, error) {
+	node, err := s.watcher.Node(nodeName)
+	if apierrors.IsNotFound(err) {
+		return nil, Config{}, nil, fmt.Errorf("%w: %s", ErrNodeNotFound, nodeName)
+	}
+	if err != nil {
+		return nil, Config{}, nil, err
+	}
+	cfg := s.config.Config()
+	if reason := excluded(node, cfg); reason != "" {
+		return nil, Config{}, nil, fmt.Errorf("%w: excluded by %s", ErrNotEligible, reason)
+	}
+	if _, preemptible := node.Labels[PREEMPTIBLE_LABEL]; !preemptible {
+		return nil, Config{}, nil, fmt.Errorf("%w: not preemptible", ErrNotEligible)
+	}
+
+	var pol *policy.Policy
+	if s.policies != nil {
+		pol = s.policies.Match(node)
+		cfg = applyPolicy(cfg, pol)
+	}
+	return node, cfg, pol, nil
+}
+
+// setSchedule sets the snipe time of the node and queues it, so that the new time is picked up right away.
+func (s *Sniper) setSchedule(ctx context.Context, node *v1.Node, t time.Time, reason string) error {
+	err := s.mutator.SetNodeAnnotation(ctx, node.Name, TIMESTAMP_ANNOTATION, t.Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	s.event(node, v1.EventTypeNormal, EVENT_REASON_SCHEDULED, "Snipe scheduled at %s: %s", t.Format(time.RFC3339), reason)
+	s.notify(node, notify.EVENT_SCHEDULED, notify.Event{Scheduled: t, Message: reason})
+	s.watcher.Enqueue(node.Name)
+	return nil
+}
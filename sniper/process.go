@@ -0,0 +1,582 @@
+package sniper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	computepb "cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/torbendury/gke-preemptible-sniper/gcloud"
+	"github.com/torbendury/gke-preemptible-sniper/history"
+	"github.com/torbendury/gke-preemptible-sniper/k8s"
+	"github.com/torbendury/gke-preemptible-sniper/notify"
+	"github.com/torbendury/gke-preemptible-sniper/policy"
+	"github.com/torbendury/gke-preemptible-sniper/preemption"
+	"github.com/torbendury/gke-preemptible-sniper/stats"
+	"github.com/torbendury/gke-preemptible-sniper/timing"
+	"github.com/torbendury/gke-preemptible-sniper/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// ProcessNode schedules the snipe of the node with the provided name or snipes it, if its time has come.
+// The node is read from the cache of the node watcher. It returns when the node should be processed again, 0 if not at all.
+func (s *Sniper) ProcessNode(ctx context.Context, nodeName string) (next time.Duration, err error) {
+	ctx, span := tracing.Start(ctx, "sniper.ProcessNode", trace.WithAttributes(attribute.String("node", nodeName)))
+	defer func() { tracing.End(span, err) }()
+
+	node, err := s.watcher.Node(nodeName)
+	if apierrors.IsNotFound(err) {
+		return 0, nil
+	}
+	if !s.ok(err, "failed to get node from cache", "error", err, "node", nodeName) {
+		return 0, err
+	}
+	cfg := s.config.Config()
+
+	if reason := excluded(node, cfg); reason != "" {
+		s.logger.Info("skipping excluded node", "node", nodeName, "reason", reason)
+		return 0, nil
+	}
+
+	var pol *policy.Policy
+	if s.policies != nil {
+		pol = s.policies.Match(node)
+		cfg = applyPolicy(cfg, pol)
+	}
+
+	s.logger.Info("checking node", "node", nodeName)
+	timestamp, hasAnnotation := node.Annotations[TIMESTAMP_ANNOTATION]
+	if !hasAnnotation {
+		// in dry-run mode, the schedule only lives in memory
+		timestamp, hasAnnotation = s.mutator.PlannedAnnotation(nodeName, TIMESTAMP_ANNOTATION)
+	}
+	if !hasAnnotation {
+		if _, preemptible := node.Labels[PREEMPTIBLE_LABEL]; !preemptible {
+			s.logger.Info("skipping non-preemptible", "node", nodeName)
+			return 0, nil
+		}
+
+		randTime, err := planSnipe(node, cfg, pol, s.clock.Now(), time.Time{})
+		if !s.ok(err, "failed to create allowed time", "node", nodeName) {
+			return 0, err
+		}
+
+		s.logger.Info("adding annotation to node", "node", nodeName, "timestamp", randTime.Format(time.RFC3339))
+		err = s.mutator.SetNodeAnnotation(ctx, nodeName, TIMESTAMP_ANNOTATION, randTime.Format(time.RFC3339))
+		if !s.ok(err, "failed to add annotation", "error", err, "node", nodeName) {
+			return 0, err
+		}
+		s.event(node, v1.EventTypeNormal, EVENT_REASON_SCHEDULED, "Snipe scheduled at %s", randTime.Format(time.RFC3339))
+		s.notify(node, notify.EVENT_SCHEDULED, notify.Event{Scheduled: randTime})
+		return randTime.Sub(s.clock.Now()), nil
+	}
+
+	s.logger.Info("node already has annotation", "node", nodeName)
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if !s.ok(err, "failed to parse time", "error", err, "node", nodeName, "timestamp", timestamp) {
+		return 0, err
+	}
+
+	now := s.clock.Now()
+	if now.Before(t) {
+		duration := t.Sub(now)
+		s.logger.Info("node has time to live left", "node", nodeName, "left", fmt.Sprintf("%vh%vm", int(duration.Hours()), int(duration.Minutes())%60))
+
+		if now.Add(time.Hour).After(t) {
+			stats.AddExpectedSnipe(nodeName, t)
+		}
+		if providerID, err := k8s.NodeProviderID(node); err == nil {
+			s.trackNode(node, providerID, t)
+		}
+		return duration, nil
+	}
+
+	if s.isPaused(node) {
+		s.logger.Info("sniping is paused, keeping schedule", "node", nodeName, "timestamp", timestamp)
+		return cfg.CheckInterval, nil
+	}
+
+	if until, exempt := s.exemptUntil(node); exempt && now.Before(until) {
+		s.logger.Info("node is exempt, keeping schedule", "node", nodeName, "timestamp", timestamp, "until", until.Format(time.RFC3339))
+		return until.Sub(now), nil
+	}
+
+	location, err := s.locateInstance(node, cfg)
+	if err != nil {
+		return 0, err
+	}
+
+	tracked := s.trackNode(node, location, t)
+
+	instance, err := s.verifyInstance(ctx, node, location, cfg)
+	if err != nil {
+		return 0, err
+	}
+	if instance == nil {
+		// an earlier snipe or a preemption deleted the instance already, only the node is left to clean up
+		s.logger.Info("instance is already deleted, cleaning up node", "instance", location.Instance, "zone", location.Zone, "project", location.Project, "node", nodeName)
+		cfg.Surge = false
+		cfg.DeleteMode = DELETE_MODE_INSTANCE
+	}
+
+	// the owning group is looked up before anything disruptive happens, so that a missing group aborts the snipe early
+	var groupName string
+	if cfg.DeleteMode != DELETE_MODE_INSTANCE {
+		_, groupName, err = gcloud.InstanceGroupManagerOf(instance)
+		if err != nil {
+			// the delete mode does not fit the node pool
+			err = fmt.Errorf("%w: %w", ErrConfig, err)
+		}
+		if !s.ok(err, "failed to find instance group", "error", err, "instance", location.Instance, "node", nodeName) {
+			return 0, err
+		}
+	}
+
+	pool, zone := nodePool(node), location.Zone
+	started := s.clock.Now()
+	event := notify.Event{Instance: location.Instance, Scheduled: t, Started: started}
+	if cfg.DryRun {
+		// simulated snipes are not counted, so that metrics, policies, the preemption detector and the snipe limits only see real ones
+		err = s.snipe(ctx, node, location, groupName, timestamp, cfg, event)
+		return 0, err
+	}
+
+	if !s.startSnipe(cfg, pol) {
+		s.logger.Info("snipe limit reached, postponing", "node", nodeName, "maxSnipesPerHour", cfg.MaxSnipesPerHour, "maxConcurrentSnipes", cfg.MaxConcurrentSnipes)
+		return SNIPE_LIMIT_RETRY_INTERVAL, nil
+	}
+	defer s.finishSnipe(pol)
+
+	stats.SnipesAttempted.WithLabelValues(pool, zone).Inc()
+	s.notify(node, notify.EVENT_STARTED, event)
+	err = s.snipe(ctx, node, location, groupName, timestamp, cfg, event)
+	duration := s.clock.Now().Sub(started)
+	stats.Snipes.WithLabelValues(pool, zone, stats.Result(err)).Inc()
+	stats.SnipeDuration.WithLabelValues(pool, zone, stats.Result(err)).Observe(duration.Seconds())
+	s.recordHistory(ctx, history.Entry{
+		Node:      nodeName,
+		NodePool:  pool,
+		Zone:      zone,
+		Scheduled: t,
+		Sniped:    started,
+		Duration:  duration.Seconds(),
+		Result:    stats.Result(err),
+	}, err)
+	if err != nil {
+		event.Error = err.Error()
+		s.notify(node, notify.EVENT_FAILED, event)
+		return 0, err
+	}
+
+	stats.NodeAgeAtSnipe.WithLabelValues(pool, zone).Observe(started.Sub(node.CreationTimestamp.Time).Seconds())
+	stats.AddSnipedNode(location.Instance, s.clock.Now())
+	s.detector.Sniped(tracked)
+	if pol != nil {
+		s.policies.Sniped(pol.Name, s.clock.Now())
+	}
+	return 0, nil
+}
+
+// recordHistory adds the finished snipe to the history, unless in dry-run mode. Errors are logged only, they do not fail the snipe.
+func (s *Sniper) recordHistory(ctx context.Context, entry history.Entry, err error) {
+	if s.history == nil {
+		return
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	// the snipe may have used up the context of the node
+	saveCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), HISTORY_SAVE_TIMEOUT)
+	defer cancel()
+	if err := s.history.Add(saveCtx, entry); err != nil {
+		s.logger.Error("failed to save snipe history", "node", entry.Node, "error", err)
+	}
+}
+
+// snipe replaces the node if configured, then cordons, drains and deletes it together with its instance.
+// Every step is notified with the attributes of the provided event. The pause switch is not checked again once the snipe has started,
+// so that pausing never leaves a node cordoned or half-drained.
+func (s *Sniper) snipe(ctx context.Context, node *v1.Node, location k8s.ProviderID, groupName, timestamp string, cfg Config, event notify.Event) error {
+	nodeName := node.Name
+	defer s.setPhase(nodeName, "")
+	if cfg.Surge {
+		s.setPhase(nodeName, PHASE_SURGING)
+		// waiting for the replacement can take longer than one check interval, so the rest of the snipe gets its own deadline
+		var snipeCancel context.CancelFunc
+		ctx, snipeCancel = context.WithTimeout(context.WithoutCancel(ctx), SURGE_TIMEOUT+cfg.CheckInterval)
+		defer snipeCancel()
+
+		err := s.surgeNode(ctx, node, location, groupName, cfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.setPhase(nodeName, PHASE_DRAINING)
+	s.logger.Info("cordoning", "node", nodeName)
+	err := s.mutator.CordonNode(ctx, nodeName)
+	if !s.ok(err, "failed to cordon node", "error", err, "node", nodeName) {
+		return err
+	}
+	s.event(node, v1.EventTypeNormal, EVENT_REASON_CORDONED, "Cordoned for the snipe scheduled at %s", timestamp)
+	s.notify(node, notify.EVENT_CORDONED, event)
+
+	// the drain has its own deadline, but stays part of the trace of the snipe
+	drainCtx, drainCancel := context.WithTimeout(context.WithoutCancel(ctx), cfg.NodeDrainTimeout)
+	s.logger.Info("draining", "node", nodeName)
+	s.event(node, v1.EventTypeNormal, EVENT_REASON_DRAIN_STARTED, "Evicting all pods within %s", cfg.NodeDrainTimeout)
+	drainStarted := s.clock.Now()
+	event.Pods, err = s.mutator.DrainNode(drainCtx, nodeName)
+	drainCancel()
+	if !cfg.DryRun {
+		stats.DrainDuration.WithLabelValues(nodePool(node), location.Zone, stats.Result(err)).Observe(s.clock.Now().Sub(drainStarted).Seconds())
+	}
+	if !s.ok(err, "failed to drain node", "error", err, "node", nodeName) {
+		s.event(node, v1.EventTypeWarning, EVENT_REASON_DRAIN_FAILED, "Failed to drain node: %v", err)
+		return err
+	}
+	s.notify(node, notify.EVENT_DRAINED, event)
+	if !cfg.DryRun {
+		// nothing was evicted in dry-run mode, so there is nothing to wait for
+		_, span := tracing.Start(ctx, "sniper.NodeDrainSleep")
+		s.clock.Sleep(NODE_DRAIN_SLEEP)
+		span.End()
+	}
+
+	s.setPhase(nodeName, PHASE_DELETING)
+	s.logger.Info("deleting instance", "instance", location.Instance, "zone", location.Zone, "project", location.Project, "node", nodeName)
+	err = s.mutator.DeleteNode(ctx, nodeName)
+	if !s.ok(err, "failed to delete node", "error", err, "node", nodeName) {
+		return err
+	}
+
+	err = s.deleteInstance(ctx, location, groupName, cfg)
+	if !s.ok(err, "failed to delete instance", "error", err, "instance", location.Instance, "zone", location.Zone, "project", location.Project, "group", groupName, "deleteMode", cfg.DeleteMode, "node", nodeName) {
+		return err
+	}
+	s.logger.Info("deleted instance", "instance", location.Instance, "zone", location.Zone, "project", location.Project, "node", nodeName)
+	s.event(node, v1.EventTypeNormal, EVENT_REASON_DELETED, "Deleted node and instance %s with delete mode %s", location.Instance, cfg.DeleteMode)
+	event.Message = fmt.Sprintf("deleted instance %s with delete mode %s", location.Instance, cfg.DeleteMode)
+	s.notify(node, notify.EVENT_DELETED, event)
+	return nil
+}
+
+// planSnipe plans a random snipe time for the node within the allowed times of the configuration and the window of its policy.
+// If notBefore is set, the snipe time is planned within one day after it instead.
+func planSnipe(node *v1.Node, cfg Config, pol *policy.Policy, now, notBefore time.Time) (time.Time, error) {
+	loc := time.Local
+	if pol != nil {
+		loc = pol.Location
+	}
+	switch {
+	case !notBefore.IsZero():
+		return timing.CreateAllowedTimeBetween(cfg.AllowedTimes, cfg.BlockedTimes, notBefore, notBefore.Add(24*time.Hour), loc)
+	case pol != nil:
+		earliest, latest := pol.SnipeWindow(node.CreationTimestamp.Time, now)
+		return timing.CreateAllowedTimeBetween(cfg.AllowedTimes, cfg.BlockedTimes, earliest, latest, loc)
+	default:
+		return timing.CreateAllowedTime(cfg.AllowedTimes, cfg.BlockedTimes)
+	}
+}
+
+// nodePool returns the node pool of the node for metric labels.
+func nodePool(node *v1.Node) string {
+	if pool, exists := node.Labels[NODE_POOL_LABEL]; exists {
+		return pool
+	}
+	return stats.UNKNOWN
+}
+
+// nodeZone returns the zone of the node for metric labels, taken from its provider ID or its labels.
+func nodeZone(node *v1.Node) string {
+	if providerID, err := k8s.NodeProviderID(node); err == nil {
+		return providerID.Zone
+	}
+	if zone, err := k8s.NodeZone(node); err == nil {
+		return zone
+	}
+	return stats.UNKNOWN
+}
+
+// excluded returns why the node is excluded from sniping by the configuration, or an empty string if it is not.
+func excluded(node *v1.Node, cfg Config) string {
+	pool := node.Labels[NODE_POOL_LABEL]
+	for _, excludedPool := range cfg.ExcludedNodePools {
+		if pool == excludedPool {
+			return "node pool " + pool
+		}
+	}
+	for key, value := range cfg.ExcludedNodeLabels {
+		if nodeValue, exists := node.Labels[key]; exists && nodeValue == value {
+			return "label " + key + "=" + value
+		}
+	}
+	return ""
+}
+
+// applyPolicy overrides the configuration with the settings of the policy. A nil policy keeps the configuration as it is.
+func applyPolicy(cfg Config, pol *policy.Policy) Config {
+	if pol == nil {
+		return cfg
+	}
+	if len(pol.AllowedTimes) > 0 {
+		cfg.AllowedTimes = pol.AllowedTimes
+	}
+	if len(pol.BlockedTimes) > 0 {
+		cfg.BlockedTimes = pol.BlockedTimes
+	}
+	if pol.NodeDrainTimeout > 0 {
+		cfg.NodeDrainTimeout = pol.NodeDrainTimeout
+	}
+	return cfg
+}
+
+// nextSnipe returns the planned snipe time of the node, if there is one.
+func (s *Sniper) nextSnipe(node *v1.Node) (time.Time, bool) {
+	timestamp, planned := node.Annotations[TIMESTAMP_ANNOTATION]
+	if !planned {
+		timestamp, planned = s.mutator.PlannedAnnotation(node.Name, TIMESTAMP_ANNOTATION)
+	}
+	if !planned {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, timestamp)
+	return t, err == nil
+}
+
+// snipeDue reports whether the snipe time of the node has come, so that processing it may snipe it.
+func (s *Sniper) snipeDue(nodeName string) bool {
+	node, err := s.watcher.Node(nodeName)
+	if err != nil {
+		return false
+	}
+	timestamp, hasAnnotation := node.Annotations[TIMESTAMP_ANNOTATION]
+	if !hasAnnotation {
+		timestamp, hasAnnotation = s.mutator.PlannedAnnotation(nodeName, TIMESTAMP_ANNOTATION)
+	}
+	t, err := time.Parse(time.RFC3339, timestamp)
+	return hasAnnotation && err == nil && !s.clock.Now().Before(t)
+}
+
+// startSnipeWorker counts a node which is due for a snipe, if not all snipe workers are busy.
+// Every started snipe worker has to be finished with finishSnipeWorker.
+func (s *Sniper) startSnipeWorker() bool {
+	s.snipesMu.Lock()
+	defer s.snipesMu.Unlock()
+
+	workers := SNIPE_WORKERS
+	if limit := s.config.Config().MaxConcurrentSnipes; limit > 0 {
+		workers = limit
+	}
+	if s.snipeWorkers >= workers {
+		return false
+	}
+	s.snipeWorkers++
+	return true
+}
+
+func (s *Sniper) finishSnipeWorker() {
+	s.snipesMu.Lock()
+	defer s.snipesMu.Unlock()
+	s.snipeWorkers--
+}
+
+// startSnipe checks the snipe limits of the configuration and the policy and counts a new snipe if they allow it.
+// Every started snipe has to be finished with finishSnipe.
+func (s *Sniper) startSnipe(cfg Config, pol *policy.Policy) bool {
+	s.snipesMu.Lock()
+	defer s.snipesMu.Unlock()
+
+	now := s.clock.Now()
+	i := 0
+	for i < len(s.snipesStarted) && now.Sub(s.snipesStarted[i]) >= time.Hour {
+		i++
+	}
+	s.snipesStarted = s.snipesStarted[i:]
+
+	if cfg.MaxSnipesPerHour > 0 && len(s.snipesStarted) >= cfg.MaxSnipesPerHour {
+		return false
+	}
+	if cfg.MaxConcurrentSnipes > 0 && s.snipesInProgress >= cfg.MaxConcurrentSnipes {
+		return false
+	}
+	if pol != nil && pol.MaxConcurrentSnipes > 0 && s.policySnipes[pol.Name] >= pol.MaxConcurrentSnipes {
+		return false
+	}
+	s.snipesStarted = append(s.snipesStarted, now)
+	s.snipesInProgress++
+	if pol != nil {
+		s.policySnipes[pol.Name]++
+	}
+	return true
+}
+
+func (s *Sniper) finishSnipe(pol *policy.Policy) {
+	s.snipesMu.Lock()
+	defer s.snipesMu.Unlock()
+	s.snipesInProgress--
+	if pol != nil {
+		s.policySnipes[pol.Name]--
+	}
+}
+
+// locateInstance returns the location of the Compute Engine instance backing the node.
+// The node's providerID is the primary source. If it is missing or malformed, the hostname and zone labels
+// together with the configured project are used instead.
+func (s *Sniper) locateInstance(node *v1.Node, cfg Config) (k8s.ProviderID, error) {
+	providerID, err := k8s.NodeProviderID(node)
+	if err == nil {
+		return providerID, nil
+	}
+	s.logger.Warn("failed to get provider ID, falling back to labels", "error", err, "node", node.Name)
+
+	instance := node.Labels["kubernetes.io/hostname"]
+	if instance == "" {
+		err := errors.New("instance name is empty")
+		s.ok(err, "failed to locate instance", "node", node.Name)
+		return k8s.ProviderID{}, err
+	}
+
+	zone, err := k8s.NodeZone(node)
+	if !s.ok(err, "failed to get zone", "error", err, "node", node.Name) {
+		return k8s.ProviderID{}, err
+	}
+	if zone == "" {
+		err := errors.New("zone is empty")
+		s.ok(err, "failed to locate instance", "node", node.Name)
+		return k8s.ProviderID{}, err
+	}
+
+	return k8s.ProviderID{Project: cfg.ProjectID, Zone: zone, Instance: instance}, nil
+}
+
+// trackNode hands the node over to the preemption detector, so that a preemption before its planned snipe is noticed.
+func (s *Sniper) trackNode(node *v1.Node, location k8s.ProviderID, planned time.Time) preemption.Node {
+	tracked := preemption.Node{Name: node.Name, Pool: nodePool(node), Location: location, Planned: planned}
+	s.detector.Track(tracked)
+	return tracked
+}
+
+// verifyInstance makes sure that the instance backing the node is preemptible and belongs to this cluster.
+// It is called before anything disruptive happens to the node. An instance which does not exist anymore is returned as nil without error,
+// so that a snipe which was interrupted after the instance was deleted can be run again. This is only trusted if the instance is known
+// to be the node's, i.e. it was located from the providerID or the node was already surged. A guess from the labels fails verification.
+func (s *Sniper) verifyInstance(ctx context.Context, node *v1.Node, location k8s.ProviderID, cfg Config) (*computepb.Instance, error) {
+	nodeName := node.Name
+	instance, err := s.google.GetInstance(ctx, location.Project, location.Zone, location.Instance)
+	_, providerErr := k8s.NodeProviderID(node)
+	_, surged := node.Annotations[SURGE_ANNOTATION]
+	switch {
+	case gcloud.IsNotFound(err) && (providerErr == nil || surged):
+		return nil, nil
+	case gcloud.IsNotFound(err):
+		err = &gcloud.InstanceVerificationError{InstanceName: location.Instance, Reason: gcloud.REASON_NOT_FOUND}
+	case !s.ok(err, "failed to get instance", "error", err, "instance", location.Instance, "zone", location.Zone, "project", location.Project, "node", nodeName):
+		return nil, err
+	default:
+		err = gcloud.VerifyInstance(instance, cfg.ClusterName)
+	}
+	var verificationErr *gcloud.InstanceVerificationError
+	if errors.As(err, &verificationErr) {
+		stats.VerificationFailures.WithLabelValues(verificationErr.Reason).Inc()
+	}
+	if !s.ok(err, "refusing to snipe instance", "error", err, "instance", location.Instance, "cluster", cfg.ClusterName, "node", nodeName) {
+		return nil, err
+	}
+	return instance, nil
+}
+
+// deleteInstance deletes the instance according to the configured delete mode.
+func (s *Sniper) deleteInstance(ctx context.Context, location k8s.ProviderID, groupName string, cfg Config) error {
+	switch cfg.DeleteMode {
+	case DELETE_MODE_GROUP_DELETE:
+		return s.mutator.DeleteInstanceViaGroup(ctx, location.Project, location.Zone, groupName, location.Instance)
+	case DELETE_MODE_GROUP_RECREATE:
+		return s.mutator.RecreateInstanceViaGroup(ctx, location.Project, location.Zone, groupName, location.Instance)
+	default:
+		return s.mutator.DeleteInstance(ctx, location.Project, location.Zone, location.Instance)
+	}
+}
+
+// surgeNode resizes the group of the node by one and waits until the replacement node is Ready in Kubernetes.
+// The node is annotated with the time of the resize, so that a failed snipe does not grow the group again on the next attempt.
+// The next attempt waits for the replacement again, taking the nodes of the pool created before the resize as known.
+// The group shrinks back to its original size when the node's instance is deleted through the group.
+func (s *Sniper) surgeNode(ctx context.Context, node *v1.Node, location k8s.ProviderID, groupName string, cfg Config) error {
+	nodeName := node.Name
+	pool, exists := node.Labels[NODE_POOL_LABEL]
+	if !exists {
+		err := fmt.Errorf("label %s not found on node %s", NODE_POOL_LABEL, nodeName)
+		s.ok(err, "failed to get node pool", "node", nodeName)
+		return err
+	}
+
+	surged, hasSurge := node.Annotations[SURGE_ANNOTATION]
+	if planned, exists := s.mutator.PlannedAnnotation(nodeName, SURGE_ANNOTATION); exists {
+		surged, hasSurge = planned, true
+	}
+	var knownNodes []string
+	if hasSurge {
+		surgedAt, err := time.Parse(time.RFC3339, surged)
+		if !s.ok(err, "failed to parse surge annotation", "error", err, "node", nodeName, "surged", surged) {
+			return err
+		}
+		s.logger.Info("replacement was already requested", "node", nodeName, "group", groupName, "surged", surged)
+		knownNodes = s.nodesCreatedUntil(pool, surgedAt)
+	} else {
+		var err error
+		knownNodes, err = s.kubernetes.GetNodesWithLabel(ctx, NODE_POOL_LABEL, pool)
+		if !s.ok(err, "failed to get nodes of node pool", "error", err, "node", nodeName, "pool", pool) {
+			return err
+		}
+		size, err := s.google.GetInstanceGroupTargetSize(ctx, location.Project, location.Zone, groupName)
+		if !s.ok(err, "failed to get instance group size", "error", err, "group", groupName, "node", nodeName) {
+			return err
+		}
+
+		s.logger.Info("surging", "node", nodeName, "group", groupName, "size", size+1)
+		err = s.mutator.ResizeInstanceGroup(ctx, location.Project, location.Zone, groupName, size+1)
+		if !s.ok(err, "failed to resize instance group", "error", err, "group", groupName, "node", nodeName) {
+			return err
+		}
+		err = s.mutator.SetNodeAnnotation(ctx, nodeName, SURGE_ANNOTATION, s.clock.Now().Format(time.RFC3339))
+		if !s.ok(err, "failed to add surge annotation", "error", err, "node", nodeName) {
+			return err
+		}
+	}
+
+	if cfg.DryRun {
+		s.logger.Info("dry-run: would wait for replacement node", "node", nodeName, "pool", pool)
+		return nil
+	}
+
+	waitCtx, waitCancel := context.WithTimeout(ctx, SURGE_TIMEOUT)
+	defer waitCancel()
+	replacement, err := s.kubernetes.WaitForNewReadyNode(waitCtx, NODE_POOL_LABEL, pool, knownNodes)
+	if !s.ok(err, "replacement node did not become ready", "error", err, "node", nodeName, "pool", pool) {
+		return err
+	}
+	s.logger.Info("replacement node is ready", "node", nodeName, "replacement", replacement)
+	return nil
+}
+
+// nodesCreatedUntil returns the names of the cached nodes of the pool which were created until the provided time.
+// The annotation of a surge has a precision of seconds, so nodes created within the second of the resize count as old.
+func (s *Sniper) nodesCreatedUntil(pool string, until time.Time) []string {
+	var names []string
+	for _, node := range s.watcher.Nodes() {
+		if node.Labels[NODE_POOL_LABEL] == pool && !node.CreationTimestamp.After(until) {
+			names = append(names, node.Name)
+		}
+	}
+	return names
+}
+
+// isPaused checks whether sniping is paused cluster-wide or for the node.
+func (s *Sniper) isPaused(node *v1.Node) bool {
+	return s.paused.Load() || node.Annotations[PAUSE_ANNOTATION] == "true"
+}
@@ -0,0 +1,460 @@
+// Package sniper provides the controller which schedules, cordons, drains and deletes preemptible GKE nodes.
+// All of its dependencies are interfaces, so that a full snipe can be driven against fake clients in tests.
+package sniper
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/torbendury/gke-preemptible-sniper/actuator"
+	"github.com/torbendury/gke-preemptible-sniper/budget"
+	"github.com/torbendury/gke-preemptible-sniper/cloudevent"
+	"github.com/torbendury/gke-preemptible-sniper/gcloud"
+	"github.com/torbendury/gke-preemptible-sniper/history"
+	"github.com/torbendury/gke-preemptible-sniper/k8s"
+	"github.com/torbendury/gke-preemptible-sniper/notify"
+	"github.com/torbendury/gke-preemptible-sniper/policy"
+	"github.com/torbendury/gke-preemptible-sniper/preemption"
+	"github.com/torbendury/gke-preemptible-sniper/stats"
+	"github.com/torbendury/gke-preemptible-sniper/timing"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	ERROR_BUDGET_EXCEEDED_SLEEP  = 10 * time.Second // pause between two nodes while the error budget is exhausted
+	ERROR_BUDGET_WINDOW          = 10 * time.Minute // errors older than this do not count against the budget
+	ERROR_BUDGET_TRANSIENT       = 10               // transient errors within the window before the sniper is not ready
+	ERROR_BUDGET_FATAL           = 3                // fatal errors within the window before the sniper is not healthy
+	ERROR_BUDGET_UPDATE_INTERVAL = 15 * time.Second // interval for updating the error budget metric
+
+	NODE_DRAIN_SLEEP = 10 * time.Second // sleep time after draining a node
+	NODE_WORKERS     = 4                // number of nodes processed in parallel
+	SNIPE_WORKERS    = 4                // number of snipes run in parallel beside the node workers, unless Config.MaxConcurrentSnipes is set
+
+	DELETE_MODE_INSTANCE       = "instance"     // delete the instance directly, the group recreates it on its own
+	DELETE_MODE_GROUP_DELETE   = "mig-delete"   // delete the instance through its group, shrinking the group
+	DELETE_MODE_GROUP_RECREATE = "mig-recreate" // recreate the instance through its group, keeping the target size
+
+	TIMESTAMP_ANNOTATION = "gke-preemptible-sniper/timestamp" // planned snipe time of a node
+	PREEMPTIBLE_LABEL    = "cloud.google.com/gke-preemptible"
+	NODE_POOL_LABEL      = k8s.NODE_POOL_LABEL
+	SURGE_ANNOTATION     = "gke-preemptible-sniper/surged" // set on a node once its replacement was requested
+	SURGE_TIMEOUT        = 10 * time.Minute                // maximum time to wait for a replacement node to become ready
+
+	PAUSE_ANNOTATION     = "gke-preemptible-sniper/paused"       // set to "true" on the sniper namespace or a single node to stop sniping
+	EXEMPT_ANNOTATION    = "gke-preemptible-sniper/exempt-until" // node is not sniped before this time, set by operator actions
+	PAUSE_CHECK_INTERVAL = 5 * time.Second
+
+	PREEMPTION_CHECK_INTERVAL = time.Minute
+
+	SNIPE_LIMIT_RETRY_INTERVAL = time.Minute // nodes postponed by a snipe limit are checked again after this interval
+
+	POLICY_STATUS_INTERVAL = time.Minute // interval for reporting the status of the SniperPolicies
+
+	SCHEDULED_SNIPES_INTERVAL = 30 * time.Second // interval for exporting the snipe times of all nodes
+
+	HISTORY_SAVE_TIMEOUT = 10 * time.Second // timeout for saving the history after a snipe
+
+	// reasons of the Events on sniped nodes, they are stable so that they can be alerted on
+	EVENT_REASON_SCHEDULED     = "Scheduled"
+	EVENT_REASON_CORDONED      = "Cordoned"
+	EVENT_REASON_DRAIN_STARTED = "DrainStarted"
+	EVENT_REASON_DRAIN_FAILED  = "DrainFailed"
+	EVENT_REASON_DELETED       = "Deleted"
+	EVENT_REASON_EXEMPTED      = "Exempted"
+)
+
+// ErrConfig marks errors which are caused by the configuration of the sniper and do not go away on their own.
+var ErrConfig = errors.New("configuration error")
+
+// Kubernetes is the part of the Kubernetes client used by the Sniper.
+type Kubernetes interface {
+	actuator.KubernetesAPI
+	NewNodeWatcher(resync, retryDelay time.Duration) (*k8s.NodeWatcher, error)
+	GetNodesWithLabel(ctx context.Context, key, value string) ([]string, error)
+	WaitForNewReadyNode(ctx context.Context, key, value string, knownNodes []string) (string, error)
+	GetNamespaceAnnotations(ctx context.Context, namespace string) (map[string]string, error)
+	EventRecorder() record.EventRecorder
+}
+
+var _ Kubernetes = (*k8s.Client)(nil)
+
+// Clock tells the time and waits. Tests replace it to move through snipe times without waiting.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+// RealClock is the wall clock.
+type RealClock struct{}
+
+func (RealClock) Now() time.Time        { return time.Now() }
+func (RealClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// Config is the configuration of the Sniper.
+type Config struct {
+	AllowedTimes     timing.TimeSlots // allowed times for node delete scheduling
+	BlockedTimes     timing.TimeSlots // blocked times for node delete scheduling
+	CheckInterval    time.Duration    // interval for checking all nodes again
+	NodeDrainTimeout time.Duration    // timeout for draining a node
+	ClusterName      string           // name of the GKE cluster, instances of other clusters are never deleted
+	ProjectID        string           // Google Cloud project ID, used if a node has no provider ID
+	DeleteMode       string           // how instances are deleted, one of the DELETE_MODE_* constants
+	DryRun           bool             // if set, the sniper only logs what it would do
+	Surge            bool             // if set, a replacement node is brought up before a node is drained
+	PodNamespace     string           // namespace the sniper runs in, watched for the pause annotation
+	SniperPolicies   bool             // if set, SniperPolicy resources are watched and applied to the nodes they match
+	LegacyMetrics    bool             // if set, the deprecated gauges which were replaced by counters and histograms are exposed
+	HistoryConfigMap string           // name of the ConfigMap in PodNamespace the snipe history is persisted to
+	HistoryFile      string           // path of the file the snipe history is persisted to
+	Webhooks         []notify.Webhook // webhooks which are notified about snipes
+	CloudEvents      cloudevent.Sink  // sink of the CloudEvents about snipes, none are emitted without URL
+
+	ExcludedNodePools  []string          // nodes of these node pools are never scheduled or sniped
+	ExcludedNodeLabels map[string]string // nodes with any of these labels are never scheduled or sniped
+
+	MaxSnipesPerHour    int // maximum number of snipes started within one hour, 0 for no limit
+	MaxConcurrentSnipes int // maximum number of snipes in progress at the same time, 0 for no limit
+}
+
+// Policies provides the SniperPolicies which override the configuration for the nodes they match.
+type Policies interface {
+	Match(node *v1.Node) *policy.Policy
+	Sniped(name string, t time.Time)
+	UpdateStatus(ctx context.Context, nodes []*v1.Node, nextSnipe func(*v1.Node) (time.Time, bool), now time.Time) error
+}
+
+var _ Policies = (*policy.Watcher)(nil)
+
+// History records every finished snipe.
+type History interface {
+	Add(ctx context.Context, entry history.Entry) error
+}
+
+var _ History = (*history.History)(nil)
+
+// Notifier sends events about snipes to webhooks. Notify must not block.
+type Notifier interface {
+	Notify(event notify.Event)
+}
+
+var _ Notifier = (*notify.Notifier)(nil)
+
+// ConfigProvider provides the current configuration. It is asked again for every node.
+type ConfigProvider interface {
+	Config() Config
+}
+
+// StaticConfig is a configuration which never changes.
+type StaticConfig Config
+
+func (c StaticConfig) Config() Config { return Config(c) }
+
+// Sniper watches all nodes of the cluster, schedules a snipe time for every preemptible node
+// and cordons, drains and deletes the node once its time has come.
+type Sniper struct {
+	kubernetes Kubernetes
+	google     gcloud.InstanceAPI
+	clock      Clock
+	config     ConfigProvider
+	policies   Policies // nil if SniperPolicies are not used
+	history    History  // nil if the history is not kept or in dry-run mode
+	notifier   Notifier // nil if no webhooks are notified or in dry-run mode
+	logger     *slog.Logger
+
+	mutator  actuator.Actuator    // single layer for all mutating calls, switched by Config.DryRun
+	recorder record.EventRecorder // Events on the sniped nodes, nil in dry-run mode
+	detector *preemption.Detector // detects nodes preempted by Compute Engine before they were sniped
+	watcher  *k8s.NodeWatcher     // cache and work queue of all nodes
+
+	paused      atomic.Bool    // cluster-wide pause switch, read from the namespace annotation
+	errorBudget *budget.Budget // transient errors affect readiness, fatal errors affect health
+
+	snipesMu         sync.Mutex
+	snipesStarted    []time.Time    // start times of the snipes within the last hour, for Config.MaxSnipesPerHour
+	snipesInProgress int            // number of running snipes, for Config.MaxConcurrentSnipes
+	snipeWorkers     int            // number of nodes due for a snipe which are processed beside the node workers
+	policySnipes     map[string]int // number of running snipes per policy, for policy.Policy.MaxConcurrentSnipes
+
+	phasesMu sync.Mutex
+	phases   map[string]string // current step of the running snipes by node name, for NodeStatuses
+}
+
+// New creates a new Sniper. Dry-run mode and the check interval are read from the configuration once, all other settings for every node.
+// Policies, history and notifier are optional, without policies the configuration applies to all nodes.
+func New(kubernetes Kubernetes, google gcloud.InstanceAPI, clock Clock, config ConfigProvider, policies Policies, history History, notifier Notifier, logger *slog.Logger) (*Sniper, error) {
+	cfg := config.Config()
+	s := &Sniper{
+		kubernetes:   kubernetes,
+		google:       google,
+		clock:        clock,
+		config:       config,
+		policies:     policies,
+		logger:       logger,
+		detector:     preemption.NewDetector(google, clock, logger),
+		policySnipes: make(map[string]int),
+		phases:       make(map[string]string),
+	}
+	// the pause is checked once before a snipe starts, a running snipe is finished, so that no node is left half-sniped
+	s.mutator = actuator.New(kubernetes, google, logger, cfg.DryRun)
+	if !cfg.DryRun {
+		// in dry-run mode nothing happens to the nodes, so there is nothing to tell or to remember
+		s.recorder = kubernetes.EventRecorder()
+		s.history = history
+		s.notifier = notifier
+	}
+	s.errorBudget = budget.New(ERROR_BUDGET_WINDOW, map[budget.Class]int{
+		budget.Transient: ERROR_BUDGET_TRANSIENT,
+		budget.Fatal:     ERROR_BUDGET_FATAL,
+	}, clock.Now)
+	s.updateErrorBudgetMetric()
+
+	// all nodes are checked again once per check interval, in addition to their changes and snipe times
+	watcher, err := kubernetes.NewNodeWatcher(cfg.CheckInterval, cfg.CheckInterval)
+	if err != nil {
+		return nil, err
+	}
+	s.watcher = watcher
+	return s, nil
+}
+
+// Healthy reports whether the budget for fatal errors is not exhausted. Transient errors never make the Sniper unhealthy.
+func (s *Sniper) Healthy() bool {
+	return !s.errorBudget.Exhausted(budget.Fatal)
+}
+
+// Ready reports whether the Sniper is able to process nodes, i.e. no error budget is exhausted.
+func (s *Sniper) Ready() bool {
+	return s.Healthy() && !s.errorBudget.Exhausted(budget.Transient)
+}
+
+// Paused reports whether sniping is paused cluster-wide.
+func (s *Sniper) Paused() bool {
+	return s.paused.Load()
+}
+
+// Run starts watching the nodes and processes them until the context is done.
+func (s *Sniper) Run(ctx context.Context) error {
+	if err := s.watcher.Start(ctx); err != nil {
+		return err
+	}
+	defer s.watcher.ShutDown()
+
+	// background goroutine for watching the cluster-wide pause switch
+	if namespace := s.config.Config().PodNamespace; namespace != "" {
+		go s.watchPause(ctx, namespace)
+	}
+
+	// background goroutine for detecting nodes which were preempted before they were sniped
+	go s.detector.Run(ctx, PREEMPTION_CHECK_INTERVAL)
+
+	// background goroutine for reporting the status of the SniperPolicies
+	if s.policies != nil {
+		go s.reportPolicyStatus(ctx)
+	}
+
+	// background goroutine for exporting the snipe times of all nodes
+	go s.reportScheduledSnipes(ctx)
+
+	for range NODE_WORKERS {
+		go s.processNodes(ctx)
+	}
+
+	// errors leave the window over time, so the metric is updated even if no new errors happen
+	ticker := time.NewTicker(ERROR_BUDGET_UPDATE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			s.updateErrorBudgetMetric()
+		}
+	}
+}
+
+// processNodes processes the nodes handed out by the node watcher until it is shut down.
+// Every node is queued again at its snipe time, failed nodes are retried with backoff.
+// A snipe blocks for minutes, so nodes which are due run on their own goroutine and the worker goes on scheduling other nodes.
+// Errors are not counted here, ProcessNode already counted them against the error budget where they happened.
+func (s *Sniper) processNodes(ctx context.Context) {
+	var snipes sync.WaitGroup
+	defer snipes.Wait()
+	for {
+		nodeName, more := s.watcher.Next()
+		if !more {
+			return
+		}
+		s.checkErrorBudget()
+
+		if !s.snipeDue(nodeName) {
+			s.processNode(ctx, nodeName)
+			continue
+		}
+		if !s.startSnipeWorker() {
+			s.logger.Info("all snipe workers are busy, postponing", "node", nodeName)
+			s.watcher.Done(nodeName, nil, SNIPE_LIMIT_RETRY_INTERVAL)
+			continue
+		}
+		snipes.Add(1)
+		go func() {
+			defer snipes.Done()
+			defer s.finishSnipeWorker()
+			s.processNode(ctx, nodeName)
+		}()
+	}
+}
+
+// processNode processes a single node from the queue of the node watcher and hands it back.
+func (s *Sniper) processNode(ctx context.Context, nodeName string) {
+	nodeCtx, nodeCancel := context.WithTimeout(ctx, s.config.Config().CheckInterval)
+	requeueAfter, err := s.ProcessNode(nodeCtx, nodeName)
+	nodeCancel()
+	s.watcher.Done(nodeName, err, requeueAfter)
+}
+
+// watchPause polls the pause annotation of the sniper namespace until the context is done. Errors keep the last known state.
+func (s *Sniper) watchPause(ctx context.Context, namespace string) {
+	ticker := time.NewTicker(PAUSE_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, PAUSE_CHECK_INTERVAL)
+		annotations, err := s.kubernetes.GetNamespaceAnnotations(checkCtx, namespace)
+		cancel()
+		if err != nil {
+			s.logger.Error("failed to check pause annotation", "namespace", namespace, "error", err)
+		} else {
+			s.setPaused(annotations[PAUSE_ANNOTATION] == "true", namespace)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reportPolicyStatus reports the status of the SniperPolicies until the context is done.
+func (s *Sniper) reportPolicyStatus(ctx context.Context) {
+	ticker := time.NewTicker(POLICY_STATUS_INTERVAL)
+	defer ticker.Stop()
+	for {
+		err := s.policies.UpdateStatus(ctx, s.watcher.Nodes(), s.nextSnipe, s.clock.Now())
+		if err != nil {
+			s.logger.Error("failed to report policy status", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reportScheduledSnipes exports the snipe times of all nodes until the context is done.
+func (s *Sniper) reportScheduledSnipes(ctx context.Context) {
+	ticker := time.NewTicker(SCHEDULED_SNIPES_INTERVAL)
+	defer ticker.Stop()
+	for {
+		s.updateScheduledSnipes()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// updateScheduledSnipes exports the snipe times of all cached nodes which are not excluded.
+// Nodes which disappeared from the cache are removed from the metric.
+func (s *Sniper) updateScheduledSnipes() {
+	cfg := s.config.Config()
+	var snipes []stats.ScheduledSnipe
+	for _, node := range s.watcher.Nodes() {
+		if excluded(node, cfg) != "" {
+			continue
+		}
+		if t, planned := s.nextSnipe(node); planned {
+			snipes = append(snipes, stats.ScheduledSnipe{Node: node.Name, NodePool: nodePool(node), Zone: nodeZone(node), Time: t})
+		}
+	}
+	stats.SetScheduledSnipes(snipes)
+}
+
+// event records an Event on the node, unless in dry-run mode.
+func (s *Sniper) event(node *v1.Node, eventType, reason, messageFmt string, args ...any) {
+	if s.recorder != nil {
+		s.recorder.Eventf(node, eventType, reason, messageFmt, args...)
+	}
+}
+
+// notify sends the event of the provided type about the node, unless in dry-run mode.
+func (s *Sniper) notify(node *v1.Node, eventType string, event notify.Event) {
+	if s.notifier == nil {
+		return
+	}
+	event.Type = eventType
+	event.Time = s.clock.Now()
+	event.Cluster = s.config.Config().ClusterName
+	event.Node, event.NodePool, event.Zone = node.Name, nodePool(node), nodeZone(node)
+	s.notifier.Notify(event)
+}
+
+func (s *Sniper) setPaused(value bool, namespace string) {
+	if s.paused.Swap(value) != value {
+		s.logger.Info("pause state changed", "paused", value, "namespace", namespace)
+	}
+	if value {
+		stats.Paused.Set(1)
+	} else {
+		stats.Paused.Set(0)
+	}
+}
+
+func (s *Sniper) ok(err error, message string, loginfo ...any) bool {
+	// add err to loginfo
+	loginfo = append(loginfo, "error", err)
+	if err != nil {
+		class := classify(err)
+		loginfo = append(loginfo, "class", class)
+		s.logger.Error(message, loginfo...)
+		s.errorBudget.Record(class)
+		stats.Errors.WithLabelValues(class.String()).Inc()
+		s.updateErrorBudgetMetric()
+		return false
+	}
+	return true
+}
+
+// classify decides whether an error is fatal or transient. Configuration errors and missing permissions are fatal,
+// since they need an operator to fix them. All other errors are expected to go away on their own.
+func classify(err error) budget.Class {
+	if errors.Is(err, ErrConfig) || apierrors.IsForbidden(err) || apierrors.IsUnauthorized(err) || gcloud.IsPermissionDenied(err) {
+		return budget.Fatal
+	}
+	return budget.Transient
+}
+
+// checkErrorBudget slows down processing while an error budget is exhausted, to give the APIs time to recover.
+func (s *Sniper) checkErrorBudget() {
+	if s.Ready() {
+		return
+	}
+	s.logger.Warn("error budget exceeded, trying to recover", "transient", s.errorBudget.Count(budget.Transient), "fatal", s.errorBudget.Count(budget.Fatal))
+	s.clock.Sleep(ERROR_BUDGET_EXCEEDED_SLEEP)
+}
+
+func (s *Sniper) updateErrorBudgetMetric() {
+	for _, class := range budget.Classes {
+		stats.ErrorBudgetRemaining.WithLabelValues(class.String()).Set(float64(s.errorBudget.Remaining(class)))
+	}
+}
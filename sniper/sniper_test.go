@@ -0,0 +1,1279 @@
+package sniper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	computepb "cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/torbendury/gke-preemptible-sniper/budget"
+	"github.com/torbendury/gke-preemptible-sniper/gcloud"
+	"github.com/torbendury/gke-preemptible-sniper/history"
+	"github.com/torbendury/gke-preemptible-sniper/k8s"
+	"github.com/torbendury/gke-preemptible-sniper/notify"
+	"github.com/torbendury/gke-preemptible-sniper/policy"
+	"github.com/torbendury/gke-preemptible-sniper/preemption"
+	"github.com/torbendury/gke-preemptible-sniper/stats"
+	"github.com/torbendury/gke-preemptible-sniper/timing"
+	"github.com/torbendury/gke-preemptible-sniper/tracing/tracingtest"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/protobuf/proto"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// fakeClock starts at the current time and only moves when it is advanced or slept on.
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	slept time.Duration
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now()}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.slept += d
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// testEnv is a Sniper wired to a fake clientset and a fake Compute Engine.
+type testEnv struct {
+	sniper    *Sniper
+	clientset *testclient.Clientset
+	google    *gcloud.FakeInstanceAPI
+	clock     *fakeClock
+}
+
+func testNode(name string, labels map[string]string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+		Spec:       v1.NodeSpec{ProviderID: "gce://project/zone/" + name},
+	}
+}
+
+// fakeNotifier records all events.
+type fakeNotifier struct {
+	mu     sync.Mutex
+	events []notify.Event
+}
+
+func (n *fakeNotifier) Notify(event notify.Event) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.events = append(n.events, event)
+}
+
+func (n *fakeNotifier) types() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	types := make([]string, 0, len(n.events))
+	for _, event := range n.events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+func testInstance(name, clusterName string) *computepb.Instance {
+	return &computepb.Instance{
+		Name:       proto.String(name),
+		Scheduling: &computepb.Scheduling{Preemptible: proto.Bool(true)},
+		Labels:     map[string]string{gcloud.CLUSTER_NAME_LABEL: clusterName},
+		Metadata: &computepb.Metadata{Items: []*computepb.Items{{
+			Key:   proto.String(gcloud.CREATED_BY_METADATA),
+			Value: proto.String("projects/project/zones/zone/instanceGroupManagers/group"),
+		}}},
+	}
+}
+
+func testConfig(t *testing.T) Config {
+	allowed, err := timing.ParseTimeSlots([]string{"00:00-23:59"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	return Config{
+		AllowedTimes:     allowed,
+		CheckInterval:    time.Hour,
+		NodeDrainTimeout: 10 * time.Second,
+		ClusterName:      "cluster",
+		ProjectID:        "project",
+		DeleteMode:       DELETE_MODE_INSTANCE,
+	}
+}
+
+func newTestEnv(t *testing.T, config Config, objects ...runtime.Object) *testEnv {
+	clientset := testclient.NewSimpleClientset(objects...)
+	// the fake clientset accepts evictions without removing the pod, so evicted pods are deleted here
+	clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		create := action.(k8stesting.CreateAction)
+		eviction := create.GetObject().(metav1.Object)
+		err := clientset.Tracker().Delete(v1.SchemeGroupVersion.WithResource("pods"), action.GetNamespace(), eviction.GetName())
+		return true, nil, err
+	})
+
+	google := gcloud.NewFakeInstanceAPI()
+	clock := newFakeClock()
+	s, err := New(k8s.NewClientForClientset(clientset), google, clock, StaticConfig(config), nil, nil, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := s.watcher.Start(ctx); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	return &testEnv{sniper: s, clientset: clientset, google: google, clock: clock}
+}
+
+// waitForCache waits until the cached node fulfills the condition.
+func (e *testEnv) waitForCache(t *testing.T, nodeName string, condition func(*v1.Node) bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if node, err := e.sniper.watcher.Node(nodeName); err == nil && condition(node) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("node %s did not reach the expected state in the cache", nodeName)
+}
+
+// schedule processes the node once, waits until its snipe time is in the cache and moves the clock past it.
+func (e *testEnv) schedule(t *testing.T, nodeName string) {
+	requeueAfter, err := e.sniper.ProcessNode(context.TODO(), nodeName)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if requeueAfter <= 0 {
+		t.Fatalf("expected node to be queued again at its snipe time, got %v", requeueAfter)
+	}
+	e.waitForCache(t, nodeName, func(node *v1.Node) bool {
+		_, exists := node.Annotations[TIMESTAMP_ANNOTATION]
+		return exists
+	})
+	e.clock.Advance(requeueAfter + time.Minute)
+}
+
+func (e *testEnv) nodeExists(nodeName string) bool {
+	_, err := e.clientset.CoreV1().Nodes().Get(context.TODO(), nodeName, metav1.GetOptions{})
+	return err == nil
+}
+
+func (e *testEnv) podExists(namespace, podName string) bool {
+	_, err := e.clientset.CoreV1().Pods(namespace).Get(context.TODO(), podName, metav1.GetOptions{})
+	return err == nil
+}
+
+// waitForEvents waits until the reasons of the Events on the object with the provided kind and name are the expected ones.
+func (e *testEnv) waitForEvents(t *testing.T, kind, name string, reasons ...string) {
+	t.Helper()
+	var got []string
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		events, err := e.clientset.CoreV1().Events("").List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		got = nil
+		for _, event := range events.Items {
+			if event.InvolvedObject.Kind == kind && event.InvolvedObject.Name == name {
+				got = append(got, event.Reason)
+			}
+		}
+		sort.Strings(got)
+		if slices.Equal(got, slices.Sorted(slices.Values(reasons))) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected events %v on %s %s, got %v", reasons, kind, name, got)
+}
+
+func TestProcessNodeFullCycle(t *testing.T) {
+	node := testNode("node1", map[string]string{PREEMPTIBLE_LABEL: "true", NODE_POOL_LABEL: "pool"})
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "default"},
+		Spec:       v1.PodSpec{NodeName: "node1"},
+	}
+	env := newTestEnv(t, testConfig(t), node, pod)
+	env.google.AddInstance("project", "zone", testInstance("node1", "cluster"))
+	snipeHistory := history.New(nil, env.clock.Now)
+	env.sniper.history = snipeHistory
+	notifier := &fakeNotifier{}
+	env.sniper.notifier = notifier
+	attempted := testutil.ToFloat64(stats.SnipesAttempted.WithLabelValues("pool", "zone"))
+	succeeded := testutil.ToFloat64(stats.Snipes.WithLabelValues("pool", "zone", stats.RESULT_SUCCEEDED))
+
+	// annotate
+	env.schedule(t, "node1")
+	if _, exists := env.google.Instance("project", "zone", "node1"); !exists {
+		t.Fatalf("expected instance to exist before its snipe time")
+	}
+
+	// cordon, drain, delete
+	requeueAfter, err := env.sniper.ProcessNode(context.TODO(), "node1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if requeueAfter != 0 {
+		t.Fatalf("expected sniped node not to be queued again, got %v", requeueAfter)
+	}
+
+	cordoned := false
+	for _, action := range env.clientset.Actions() {
+		if action.Matches("patch", "nodes") {
+			if strings.Contains(string(action.(k8stesting.PatchAction).GetPatch()), `"unschedulable":true`) {
+				cordoned = true
+			}
+		}
+	}
+	if !cordoned {
+		t.Fatalf("expected node to be cordoned")
+	}
+	if env.podExists("default", "pod1") {
+		t.Fatalf("expected pod to be evicted")
+	}
+	if env.clock.slept != NODE_DRAIN_SLEEP {
+		t.Fatalf("expected to sleep %v after draining, slept %v", NODE_DRAIN_SLEEP, env.clock.slept)
+	}
+	if env.nodeExists("node1") {
+		t.Fatalf("expected node to be deleted")
+	}
+	if _, exists := env.google.Instance("project", "zone", "node1"); exists {
+		t.Fatalf("expected instance to be deleted")
+	}
+
+	if got := testutil.ToFloat64(stats.SnipesAttempted.WithLabelValues("pool", "zone")) - attempted; got != 1 {
+		t.Fatalf("expected 1 attempted snipe, got %v", got)
+	}
+	if got := testutil.ToFloat64(stats.Snipes.WithLabelValues("pool", "zone", stats.RESULT_SUCCEEDED)) - succeeded; got != 1 {
+		t.Fatalf("expected 1 succeeded snipe, got %v", got)
+	}
+	if entries := snipeHistory.Entries(); len(entries) != 1 || entries[0].Node != "node1" || entries[0].NodePool != "pool" || entries[0].Result != stats.RESULT_SUCCEEDED {
+		t.Fatalf("expected snipe to be added to the history, got %+v", entries)
+	}
+	want := []string{notify.EVENT_SCHEDULED, notify.EVENT_STARTED, notify.EVENT_CORDONED, notify.EVENT_DRAINED, notify.EVENT_DELETED}
+	if got := notifier.types(); !slices.Equal(got, want) {
+		t.Fatalf("expected notifications %v, got %v", want, got)
+	}
+	if event := notifier.events[0]; event.Node != "node1" || event.NodePool != "pool" || event.Zone != "zone" || event.Cluster != "cluster" || event.Scheduled.IsZero() {
+		t.Fatalf("unexpected notification %+v", event)
+	}
+	if event := notifier.events[4]; event.Instance != "node1" || !slices.Equal(event.Pods, []string{"default/pod1"}) || event.Started.IsZero() {
+		t.Fatalf("expected the deleted notification to carry instance, start and evicted pods, got %+v", event)
+	}
+
+	env.waitForEvents(t, "Node", "node1", EVENT_REASON_SCHEDULED, EVENT_REASON_CORDONED, EVENT_REASON_DRAIN_STARTED, EVENT_REASON_DELETED)
+	env.waitForEvents(t, "Pod", "pod1", k8s.EVENT_REASON_EVICTED)
+}
+
+func TestProcessNodeDrainFailed(t *testing.T) {
+	node := testNode("node1", map[string]string{PREEMPTIBLE_LABEL: "true", NODE_POOL_LABEL: "pool"})
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "default"},
+		Spec:       v1.PodSpec{NodeName: "node1"},
+	}
+	env := newTestEnv(t, testConfig(t), node, pod)
+	env.google.AddInstance("project", "zone", testInstance("node1", "cluster"))
+	env.clientset.PrependReactor("delete", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("pod cannot be deleted")
+	})
+	env.clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return action.GetSubresource() == "eviction", nil, errors.New("pod cannot be evicted")
+	})
+	failed := testutil.ToFloat64(stats.Snipes.WithLabelValues("pool", "zone", stats.RESULT_FAILED))
+	notifier := &fakeNotifier{}
+	env.sniper.notifier = notifier
+
+	env.schedule(t, "node1")
+	exporter := tracingtest.InMemory()
+	if _, err := env.sniper.ProcessNode(context.TODO(), "node1"); err == nil {
+		t.Fatalf("expected drain to fail")
+	}
+	if spans := exporter.GetSpans(); spans[len(spans)-1].Name != "sniper.ProcessNode" || spans[len(spans)-1].Status.Code != codes.Error {
+		t.Fatalf("expected the span of the snipe to be failed, got %+v", spans[len(spans)-1])
+	}
+	if got := testutil.ToFloat64(stats.Snipes.WithLabelValues("pool", "zone", stats.RESULT_FAILED)) - failed; got != 1 {
+		t.Fatalf("expected 1 failed snipe, got %v", got)
+	}
+	if !env.nodeExists("node1") {
+		t.Fatalf("expected node to be kept")
+	}
+	want := []string{notify.EVENT_SCHEDULED, notify.EVENT_STARTED, notify.EVENT_CORDONED, notify.EVENT_FAILED}
+	if got := notifier.types(); !slices.Equal(got, want) || notifier.events[3].Error == "" || len(notifier.events[3].Pods) != 0 {
+		t.Fatalf("expected notifications %v with the error of the snipe and without the pod which was not removed, got %+v", want, notifier.events)
+	}
+	env.waitForEvents(t, "Node", "node1", EVENT_REASON_SCHEDULED, EVENT_REASON_CORDONED, EVENT_REASON_DRAIN_STARTED, EVENT_REASON_DRAIN_FAILED)
+}
+
+func TestProcessNodeTraces(t *testing.T) {
+	node := testNode("node1", map[string]string{PREEMPTIBLE_LABEL: "true", NODE_POOL_LABEL: "pool"})
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "default"},
+		Spec:       v1.PodSpec{NodeName: "node1"},
+	}
+	env := newTestEnv(t, testConfig(t), node, pod)
+	env.google.AddInstance("project", "zone", testInstance("node1", "cluster"))
+	env.schedule(t, "node1")
+	exporter := tracingtest.InMemory()
+
+	if _, err := env.sniper.ProcessNode(context.TODO(), "node1"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	process, exists := spans["sniper.ProcessNode"]
+	if !exists || process.Status.Code == codes.Error {
+		t.Fatalf("expected a successful span of the snipe, got %+v", process)
+	}
+	// the steps of the snipe are children of its span, the evictions children of the drain
+	for _, name := range []string{"k8s.DrainNode", "sniper.NodeDrainSleep", "k8s.DeleteNode"} {
+		if span, exists := spans[name]; !exists || span.Parent.SpanID() != process.SpanContext.SpanID() {
+			t.Errorf("expected span %s within the snipe", name)
+		}
+	}
+	if span, exists := spans["k8s.EvictPod"]; !exists || span.Parent.SpanID() != spans["k8s.DrainNode"].SpanContext.SpanID() {
+		t.Errorf("expected the eviction span within the drain")
+	}
+}
+
+func TestProcessNodeDeleteModes(t *testing.T) {
+	tests := []struct {
+		name       string
+		deleteMode string
+		calls      []string
+		size       int32
+	}{
+		{name: "instance", deleteMode: DELETE_MODE_INSTANCE, calls: []string{"GetInstance", "DeleteInstance"}, size: 3},
+		{name: "mig-delete", deleteMode: DELETE_MODE_GROUP_DELETE, calls: []string{"GetInstance", "DeleteInstanceViaGroup"}, size: 2},
+		{name: "mig-recreate", deleteMode: DELETE_MODE_GROUP_RECREATE, calls: []string{"GetInstance", "RecreateInstanceViaGroup"}, size: 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig(t)
+			config.DeleteMode = test.deleteMode
+			env := newTestEnv(t, config, testNode("node1", map[string]string{PREEMPTIBLE_LABEL: "true", NODE_POOL_LABEL: "pool"}))
+			env.google.AddInstance("project", "zone", testInstance("node1", "cluster"))
+			env.google.AddInstanceGroup("project", "zone", "group", 3)
+
+			env.schedule(t, "node1")
+			if _, err := env.sniper.ProcessNode(context.TODO(), "node1"); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			calls := env.google.Calls()
+			if len(calls) != len(test.calls) {
+				t.Fatalf("expected calls %v, got %v", test.calls, calls)
+			}
+			for i := range calls {
+				if calls[i] != test.calls[i] {
+					t.Fatalf("expected calls %v, got %v", test.calls, calls)
+				}
+			}
+			size, _ := env.google.GetInstanceGroupTargetSize(context.TODO(), "project", "zone", "group")
+			if size != test.size {
+				t.Fatalf("expected group size %d, got %d", test.size, size)
+			}
+		})
+	}
+}
+
+func TestProcessNodeTwice(t *testing.T) {
+	tests := []struct {
+		name       string
+		deleteMode string
+	}{
+		{name: "instance", deleteMode: DELETE_MODE_INSTANCE},
+		{name: "mig-delete", deleteMode: DELETE_MODE_GROUP_DELETE},
+		{name: "mig-recreate", deleteMode: DELETE_MODE_GROUP_RECREATE},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig(t)
+			config.DeleteMode = test.deleteMode
+			env := newTestEnv(t, config, testNode("node1", map[string]string{PREEMPTIBLE_LABEL: "true", NODE_POOL_LABEL: "pool"}))
+			env.google.AddInstance("project", "zone", testInstance("node1", "cluster"))
+			env.google.AddInstanceGroup("project", "zone", "group", 3)
+			failures := 1
+			env.clientset.PrependReactor("delete", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				if failures == 0 {
+					return false, nil, nil
+				}
+				failures--
+				return true, nil, errors.New("node cannot be deleted")
+			})
+
+			env.schedule(t, "node1")
+			if _, err := env.sniper.ProcessNode(context.TODO(), "node1"); err == nil {
+				t.Fatalf("expected first snipe to fail")
+			}
+			// the instance is gone before the snipe is run again, e.g. deleted by the group or preempted
+			if err := env.google.DeleteInstance(context.TODO(), "project", "zone", "node1"); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			failed := env.sniper.errorBudget.Count(budget.Fatal) + env.sniper.errorBudget.Count(budget.Transient)
+
+			if _, err := env.sniper.ProcessNode(context.TODO(), "node1"); err != nil {
+				t.Fatalf("expected second snipe to clean up the node, got %v", err)
+			}
+			if env.nodeExists("node1") {
+				t.Fatalf("expected node to be deleted")
+			}
+			if got := env.sniper.errorBudget.Count(budget.Fatal) + env.sniper.errorBudget.Count(budget.Transient); got != failed {
+				t.Fatalf("expected no further errors, got %d instead of %d", got, failed)
+			}
+			size, _ := env.google.GetInstanceGroupTargetSize(context.TODO(), "project", "zone", "group")
+			if size != 3 {
+				t.Fatalf("expected group size 3, got %d", size)
+			}
+		})
+	}
+}
+
+// readyNode returns a Ready node of the pool created at the provided time.
+func readyNode(name, pool string, created time.Time) *v1.Node {
+	node := testNode(name, map[string]string{PREEMPTIBLE_LABEL: "true", NODE_POOL_LABEL: pool})
+	node.CreationTimestamp = metav1.NewTime(created)
+	node.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+	return node
+}
+
+func TestProcessNodeSurge(t *testing.T) {
+	config := testConfig(t)
+	config.Surge = true
+	config.DeleteMode = DELETE_MODE_GROUP_DELETE
+	env := newTestEnv(t, config, readyNode("node1", "pool", time.Now().Add(-24*time.Hour)))
+	env.google.AddInstance("project", "zone", testInstance("node1", "cluster"))
+	env.google.AddInstanceGroup("project", "zone", "group", 3)
+	// the group brings up the replacement once it was resized, the reactor holds the lock of the clientset and uses the tracker only
+	env.clientset.PrependReactor("list", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if slices.Contains(env.google.Calls(), "ResizeInstanceGroup") {
+			if _, err := env.clientset.Tracker().Get(v1.SchemeGroupVersion.WithResource("nodes"), "", "node2"); err != nil {
+				env.clientset.Tracker().Add(readyNode("node2", "pool", env.clock.Now()))
+			}
+		}
+		return false, nil, nil
+	})
+
+	env.schedule(t, "node1")
+	if _, err := env.sniper.ProcessNode(context.TODO(), "node1"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	want := []string{"GetInstance", "GetInstanceGroupTargetSize", "ResizeInstanceGroup", "DeleteInstanceViaGroup"}
+	if calls := env.google.Calls(); !slices.Equal(calls, want) {
+		t.Fatalf("expected calls %v, got %v", want, calls)
+	}
+	if env.nodeExists("node1") || !env.nodeExists("node2") {
+		t.Fatalf("expected node1 to be replaced by node2")
+	}
+	if size, _ := env.google.GetInstanceGroupTargetSize(context.TODO(), "project", "zone", "group"); size != 3 {
+		t.Fatalf("expected the group to shrink back to 3, got %d", size)
+	}
+}
+
+func TestProcessNodeSurgeAgain(t *testing.T) {
+	config := testConfig(t)
+	config.Surge = true
+	config.DeleteMode = DELETE_MODE_GROUP_DELETE
+	// an earlier attempt resized the group, but the replacement was not Ready in time
+	surgedAt := time.Now().Truncate(time.Second)
+	node := readyNode("node1", "pool", surgedAt.Add(-24*time.Hour))
+	node.Annotations = map[string]string{SURGE_ANNOTATION: surgedAt.Format(time.RFC3339)}
+	env := newTestEnv(t, config, node, readyNode("node2", "pool", surgedAt.Add(-time.Hour)))
+	env.google.AddInstance("project", "zone", testInstance("node1", "cluster"))
+	env.google.AddInstanceGroup("project", "zone", "group", 4)
+	// the replacement only comes up while the snipe waits for it
+	var waiting atomic.Bool
+	env.clientset.PrependReactor("list", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if waiting.Load() {
+			if _, err := env.clientset.Tracker().Get(v1.SchemeGroupVersion.WithResource("nodes"), "", "node3"); err != nil {
+				env.clientset.Tracker().Add(readyNode("node3", "pool", surgedAt.Add(time.Minute)))
+			}
+		}
+		return false, nil, nil
+	})
+
+	env.schedule(t, "node1")
+	env.waitForCache(t, "node2", func(*v1.Node) bool { return true })
+	known := env.sniper.nodesCreatedUntil("pool", surgedAt)
+	slices.Sort(known)
+	if !slices.Equal(known, []string{"node1", "node2"}) {
+		t.Fatalf("expected the nodes from before the resize to be known, got %v", known)
+	}
+	waiting.Store(true)
+	if _, err := env.sniper.ProcessNode(context.TODO(), "node1"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// the group is not resized again, but the snipe still waits for the replacement
+	want := []string{"GetInstance", "DeleteInstanceViaGroup"}
+	if calls := env.google.Calls(); !slices.Equal(calls, want) {
+		t.Fatalf("expected calls %v, got %v", want, calls)
+	}
+	if env.nodeExists("node1") || !env.nodeExists("node3") {
+		t.Fatalf("expected node1 to be replaced by node3")
+	}
+	if size, _ := env.google.GetInstanceGroupTargetSize(context.TODO(), "project", "zone", "group"); size != 3 {
+		t.Fatalf("expected the group to shrink back to 3, got %d", size)
+	}
+}
+
+func TestPreemptedNodeWithoutPool(t *testing.T) {
+	env := newTestEnv(t, testConfig(t), testNode("node1", map[string]string{PREEMPTIBLE_LABEL: "true"}))
+	preempted := testutil.ToFloat64(stats.NodeTerminations.WithLabelValues(stats.UNKNOWN, preemption.CAUSE_PREEMPTED))
+
+	// the node is tracked once it is checked before its snipe time
+	if _, err := env.sniper.ProcessNode(context.TODO(), "node1"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	env.waitForCache(t, "node1", func(node *v1.Node) bool {
+		_, exists := node.Annotations[TIMESTAMP_ANNOTATION]
+		return exists
+	})
+	if _, err := env.sniper.ProcessNode(context.TODO(), "node1"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	env.google.Preempt("project", "zone", "node1", env.clock.Now().Add(time.Minute))
+	if err := env.sniper.detector.Check(context.TODO()); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if got := testutil.ToFloat64(stats.NodeTerminations.WithLabelValues(stats.UNKNOWN, preemption.CAUSE_PREEMPTED)) - preempted; got != 1 {
+		t.Fatalf("expected 1 preempted node of an unknown pool, got %v", got)
+	}
+}
+
+func TestProcessNodeSkipsNonPreemptible(t *testing.T) {
+	env := newTestEnv(t, testConfig(t), testNode("node1", nil))
+
+	requeueAfter, err := env.sniper.ProcessNode(context.TODO(), "node1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if requeueAfter != 0 {
+		t.Fatalf("expected non-preemptible node not to be queued again, got %v", requeueAfter)
+	}
+	node, _ := env.clientset.CoreV1().Nodes().Get(context.TODO(), "node1", metav1.GetOptions{})
+	if _, exists := node.Annotations[TIMESTAMP_ANNOTATION]; exists {
+		t.Fatalf("expected non-preemptible node not to be annotated")
+	}
+}
+
+func TestProcessNodeSkipsExcludedNode(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+	}{
+		{name: "node pool", labels: map[string]string{PREEMPTIBLE_LABEL: "true", NODE_POOL_LABEL: "critical"}},
+		{name: "label", labels: map[string]string{PREEMPTIBLE_LABEL: "true", NODE_POOL_LABEL: "pool", "example.com/no-snipe": "true"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig(t)
+			config.ExcludedNodePools = []string{"critical"}
+			config.ExcludedNodeLabels = map[string]string{"example.com/no-snipe": "true"}
+			env := newTestEnv(t, config, testNode("node1", test.labels))
+
+			requeueAfter, err := env.sniper.ProcessNode(context.TODO(), "node1")
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if requeueAfter != 0 {
+				t.Fatalf("expected excluded node not to be queued again, got %v", requeueAfter)
+			}
+			node, _ := env.clientset.CoreV1().Nodes().Get(context.TODO(), "node1", metav1.GetOptions{})
+			if _, exists := node.Annotations[TIMESTAMP_ANNOTATION]; exists {
+				t.Fatalf("expected excluded node not to be annotated")
+			}
+		})
+	}
+}
+
+func TestProcessNodeSnipesPerHour(t *testing.T) {
+	config := testConfig(t)
+	config.MaxSnipesPerHour = 1
+	labels := map[string]string{PREEMPTIBLE_LABEL: "true", NODE_POOL_LABEL: "pool"}
+	nodes := []runtime.Object{}
+	for _, name := range []string{"node1", "node2"} {
+		// both nodes are past their snipe time already
+		node := testNode(name, labels)
+		node.Annotations = map[string]string{TIMESTAMP_ANNOTATION: time.Now().Add(-time.Minute).Format(time.RFC3339)}
+		nodes = append(nodes, node)
+	}
+	env := newTestEnv(t, config, nodes...)
+	env.google.AddInstance("project", "zone", testInstance("node1", "cluster"))
+	env.google.AddInstance("project", "zone", testInstance("node2", "cluster"))
+
+	if _, err := env.sniper.ProcessNode(context.TODO(), "node1"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	requeueAfter, err := env.sniper.ProcessNode(context.TODO(), "node2")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if requeueAfter != SNIPE_LIMIT_RETRY_INTERVAL || !env.nodeExists("node2") {
+		t.Fatalf("expected second snipe to be postponed, got %v", requeueAfter)
+	}
+
+	env.clock.Advance(time.Hour)
+	if _, err := env.sniper.ProcessNode(context.TODO(), "node2"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if env.nodeExists("node2") {
+		t.Fatalf("expected node to be sniped once the hour has passed")
+	}
+}
+
+func TestStartSnipeConcurrent(t *testing.T) {
+	s := &Sniper{clock: newFakeClock(), policySnipes: make(map[string]int)}
+	config := Config{MaxConcurrentSnipes: 2}
+
+	if !s.startSnipe(config, nil) || !s.startSnipe(config, nil) {
+		t.Fatalf("expected two concurrent snipes to be allowed")
+	}
+	if s.startSnipe(config, nil) {
+		t.Fatalf("expected third concurrent snipe to be refused")
+	}
+	s.finishSnipe(nil)
+	if !s.startSnipe(config, nil) {
+		t.Fatalf("expected snipe to be allowed once another one finished")
+	}
+}
+
+// fakePolicies applies the same policy to every node.
+type fakePolicies struct {
+	policy *policy.Policy
+	sniped []string
+}
+
+func (p *fakePolicies) Match(node *v1.Node) *policy.Policy { return p.policy }
+func (p *fakePolicies) Sniped(name string, t time.Time)    { p.sniped = append(p.sniped, name) }
+func (p *fakePolicies) UpdateStatus(ctx context.Context, nodes []*v1.Node, nextSnipe func(*v1.Node) (time.Time, bool), now time.Time) error {
+	return nil
+}
+
+func TestProcessNodeAppliesPolicy(t *testing.T) {
+	allowed, err := timing.ParseTimeSlots([]string{"02:00-03:00"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	policies := &fakePolicies{policy: &policy.Policy{
+		Name:                "batch",
+		AllowedTimes:        allowed,
+		Location:            time.UTC,
+		MaxLifetime:         48 * time.Hour,
+		MaxConcurrentSnipes: 1,
+	}}
+
+	node := testNode("node1", map[string]string{PREEMPTIBLE_LABEL: "true", NODE_POOL_LABEL: "pool"})
+	node.CreationTimestamp = metav1.NewTime(time.Now())
+	env := newTestEnv(t, testConfig(t), node)
+	env.sniper.policies = policies
+	env.google.AddInstance("project", "zone", testInstance("node1", "cluster"))
+
+	requeueAfter, err := env.sniper.ProcessNode(context.TODO(), "node1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	planned := env.clock.Now().Add(requeueAfter).UTC()
+	if planned.Hour() != 2 || requeueAfter > 48*time.Hour {
+		t.Fatalf("expected snipe within the window of the policy, got %v", planned)
+	}
+
+	// a running snipe of the same policy postpones the next one
+	if !env.sniper.startSnipe(testConfig(t), policies.policy) {
+		t.Fatalf("expected first snipe of the policy to be allowed")
+	}
+	env.waitForCache(t, "node1", func(node *v1.Node) bool {
+		_, exists := node.Annotations[TIMESTAMP_ANNOTATION]
+		return exists
+	})
+	env.clock.Advance(requeueAfter + time.Minute)
+	requeueAfter, err = env.sniper.ProcessNode(context.TODO(), "node1")
+	if err != nil || requeueAfter != SNIPE_LIMIT_RETRY_INTERVAL {
+		t.Fatalf("expected snipe to be postponed by the policy limit, got %v and %v", requeueAfter, err)
+	}
+
+	env.sniper.finishSnipe(policies.policy)
+	if _, err := env.sniper.ProcessNode(context.TODO(), "node1"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if env.nodeExists("node1") || len(policies.sniped) != 1 {
+		t.Fatalf("expected node to be sniped and reported to its policy, got %v", policies.sniped)
+	}
+}
+
+func TestProcessNodeRefusesForeignInstance(t *testing.T) {
+	env := newTestEnv(t, testConfig(t), testNode("node1", map[string]string{PREEMPTIBLE_LABEL: "true"}))
+	env.google.AddInstance("project", "zone", testInstance("node1", "other-cluster"))
+
+	env.schedule(t, "node1")
+	if _, err := env.sniper.ProcessNode(context.TODO(), "node1"); err == nil {
+		t.Fatalf("expected error, got none")
+	}
+	if !env.nodeExists("node1") {
+		t.Fatalf("expected node to be kept")
+	}
+	if _, exists := env.google.Instance("project", "zone", "node1"); !exists {
+		t.Fatalf("expected instance to be kept")
+	}
+}
+
+func TestProcessNodeRefusesMissingInstanceLocatedFromLabels(t *testing.T) {
+	node := testNode("node1", map[string]string{PREEMPTIBLE_LABEL: "true", "kubernetes.io/hostname": "node1", "topology.kubernetes.io/zone": "zone"})
+	node.Spec.ProviderID = ""
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "default"},
+		Spec:       v1.PodSpec{NodeName: "node1"},
+	}
+	env := newTestEnv(t, testConfig(t), node, pod)
+	failures := testutil.ToFloat64(stats.VerificationFailures.WithLabelValues(gcloud.REASON_NOT_FOUND))
+
+	env.schedule(t, "node1")
+	_, err := env.sniper.ProcessNode(context.TODO(), "node1")
+	var verificationErr *gcloud.InstanceVerificationError
+	if !errors.As(err, &verificationErr) || verificationErr.Reason != gcloud.REASON_NOT_FOUND {
+		t.Fatalf("expected the instance to fail verification, got %v", err)
+	}
+	if got := testutil.ToFloat64(stats.VerificationFailures.WithLabelValues(gcloud.REASON_NOT_FOUND)) - failures; got != 1 {
+		t.Fatalf("expected 1 verification failure, got %v", got)
+	}
+	kept, err := env.clientset.CoreV1().Nodes().Get(context.TODO(), "node1", metav1.GetOptions{})
+	if err != nil || kept.Spec.Unschedulable {
+		t.Fatalf("expected node to be kept and not cordoned, got %v, %v", kept, err)
+	}
+	if !env.podExists("default", "pod1") {
+		t.Fatalf("expected pod not to be evicted")
+	}
+}
+
+func TestProcessNodeKeepsPausedNode(t *testing.T) {
+	node := testNode("node1", map[string]string{PREEMPTIBLE_LABEL: "true"})
+	node.Annotations = map[string]string{PAUSE_ANNOTATION: "true"}
+	config := testConfig(t)
+	env := newTestEnv(t, config, node)
+	env.google.AddInstance("project", "zone", testInstance("node1", "cluster"))
+
+	env.schedule(t, "node1")
+	requeueAfter, err := env.sniper.ProcessNode(context.TODO(), "node1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if requeueAfter != config.CheckInterval {
+		t.Fatalf("expected paused node to be checked again after %v, got %v", config.CheckInterval, requeueAfter)
+	}
+	if !env.nodeExists("node1") {
+		t.Fatalf("expected paused node to be kept")
+	}
+}
+
+func TestProcessNodeFinishesSnipeWhenPausedMidway(t *testing.T) {
+	node := testNode("node1", map[string]string{PREEMPTIBLE_LABEL: "true", NODE_POOL_LABEL: "pool"})
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "default"},
+		Spec:       v1.PodSpec{NodeName: "node1"},
+	}
+	env := newTestEnv(t, testConfig(t), node, pod)
+	env.google.AddInstance("project", "zone", testInstance("node1", "cluster"))
+	// sniping is paused cluster-wide while the node is drained
+	env.clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() == "eviction" {
+			env.sniper.setPaused(true, "sniper")
+		}
+		return false, nil, nil
+	})
+	env.schedule(t, "node1")
+
+	if _, err := env.sniper.ProcessNode(context.TODO(), "node1"); err != nil {
+		t.Fatalf("expected the running snipe to finish, got %v", err)
+	}
+	if env.nodeExists("node1") {
+		t.Fatalf("expected node to be deleted")
+	}
+	if _, exists := env.google.Instance("project", "zone", "node1"); exists {
+		t.Fatalf("expected instance to be deleted")
+	}
+	if got := env.sniper.errorBudget.Count(budget.Transient) + env.sniper.errorBudget.Count(budget.Fatal); got != 0 {
+		t.Fatalf("expected the pause not to count as error, got %d errors", got)
+	}
+}
+
+func TestProcessNodeDryRun(t *testing.T) {
+	config := testConfig(t)
+	config.DryRun = true
+	config.MaxSnipesPerHour = 1
+	env := newTestEnv(t, config,
+		testNode("node1", map[string]string{PREEMPTIBLE_LABEL: "true", NODE_POOL_LABEL: "dry-run-pool"}),
+		testNode("node2", map[string]string{PREEMPTIBLE_LABEL: "true", NODE_POOL_LABEL: "dry-run-pool"}))
+	env.google.AddInstance("project", "zone", testInstance("node1", "cluster"))
+	env.google.AddInstance("project", "zone", testInstance("node2", "cluster"))
+	attempted := testutil.ToFloat64(stats.SnipesAttempted.WithLabelValues("dry-run-pool", "zone"))
+	succeeded := testutil.ToFloat64(stats.Snipes.WithLabelValues("dry-run-pool", "zone", stats.RESULT_SUCCEEDED))
+	terminated := testutil.ToFloat64(stats.NodeTerminations.WithLabelValues("dry-run-pool", preemption.CAUSE_SNIPED))
+
+	// the schedule only lives in memory, so there is nothing to wait for in the cache
+	var latest time.Duration
+	for _, nodeName := range []string{"node1", "node2"} {
+		requeueAfter, err := env.sniper.ProcessNode(context.TODO(), nodeName)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		latest = max(latest, requeueAfter)
+	}
+	env.clock.Advance(latest + time.Minute)
+	// simulated snipes do not use up the snipe limits, the second node is not postponed
+	for _, nodeName := range []string{"node1", "node2"} {
+		if requeueAfter, err := env.sniper.ProcessNode(context.TODO(), nodeName); err != nil || requeueAfter != 0 {
+			t.Fatalf("expected %s to be sniped, got %v, %v", nodeName, requeueAfter, err)
+		}
+	}
+	if env.clock.slept != 0 {
+		t.Fatalf("expected no sleep after a simulated drain, got %v", env.clock.slept)
+	}
+
+	for _, action := range env.clientset.Actions() {
+		if action.GetVerb() != "get" && action.GetVerb() != "list" && action.GetVerb() != "watch" {
+			t.Fatalf("expected no mutating action in dry-run mode, got %s %s", action.GetVerb(), action.GetResource().Resource)
+		}
+	}
+	if _, exists := env.google.Instance("project", "zone", "node1"); !exists {
+		t.Fatalf("expected instance to be kept in dry-run mode")
+	}
+
+	// simulated snipes are not counted as real ones
+	if got := testutil.ToFloat64(stats.SnipesAttempted.WithLabelValues("dry-run-pool", "zone")) - attempted; got != 0 {
+		t.Fatalf("expected no attempted snipe in dry-run mode, got %v", got)
+	}
+	if got := testutil.ToFloat64(stats.Snipes.WithLabelValues("dry-run-pool", "zone", stats.RESULT_SUCCEEDED)) - succeeded; got != 0 {
+		t.Fatalf("expected no succeeded snipe in dry-run mode, got %v", got)
+	}
+	// the ratio of sniped to preempted nodes only compares real terminations
+	if got := testutil.ToFloat64(stats.NodeTerminations.WithLabelValues("dry-run-pool", preemption.CAUSE_SNIPED)) - terminated; got != 0 {
+		t.Fatalf("expected no sniped termination in dry-run mode, got %v", got)
+	}
+}
+
+func TestProcessNodeIgnoresUnknownNode(t *testing.T) {
+	env := newTestEnv(t, testConfig(t))
+
+	requeueAfter, err := env.sniper.ProcessNode(context.TODO(), "missing")
+	if err != nil || requeueAfter != 0 {
+		t.Fatalf("expected unknown node to be ignored, got %v, %v", requeueAfter, err)
+	}
+}
+
+func TestUpdateScheduledSnipes(t *testing.T) {
+	planned := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	scheduled := testNode("node1", map[string]string{PREEMPTIBLE_LABEL: "true", NODE_POOL_LABEL: "pool"})
+	scheduled.Annotations = map[string]string{TIMESTAMP_ANNOTATION: planned.Format(time.RFC3339)}
+	excludedNode := testNode("node2", map[string]string{PREEMPTIBLE_LABEL: "true", NODE_POOL_LABEL: "critical"})
+	excludedNode.Annotations = map[string]string{TIMESTAMP_ANNOTATION: planned.Format(time.RFC3339)}
+	config := testConfig(t)
+	config.ExcludedNodePools = []string{"critical"}
+	env := newTestEnv(t, config, scheduled, excludedNode, testNode("node3", map[string]string{PREEMPTIBLE_LABEL: "true"}))
+
+	env.sniper.updateScheduledSnipes()
+	if got := testutil.CollectAndCount(stats.ScheduledSnipeTimestamp); got != 1 {
+		t.Fatalf("expected 1 scheduled snipe, got %d", got)
+	}
+	if got := testutil.ToFloat64(stats.ScheduledSnipeTimestamp.WithLabelValues("node1", "pool", "zone")); got != float64(planned.Unix()) {
+		t.Fatalf("expected snipe time %d, got %v", planned.Unix(), got)
+	}
+
+	if err := env.clientset.CoreV1().Nodes().Delete(context.TODO(), "node1", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(env.sniper.watcher.Nodes()) != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	env.sniper.updateScheduledSnipes()
+	if got := testutil.CollectAndCount(stats.ScheduledSnipeTimestamp); got != 0 {
+		t.Fatalf("expected series of the deleted node to be removed, got %d", got)
+	}
+}
+
+func TestNodeStatuses(t *testing.T) {
+	scheduled := testNode("node1", map[string]string{PREEMPTIBLE_LABEL: "true", NODE_POOL_LABEL: "pool"})
+	excludedNode := testNode("node2", map[string]string{PREEMPTIBLE_LABEL: "true", NODE_POOL_LABEL: "critical"})
+	config := testConfig(t)
+	config.ExcludedNodePools = []string{"critical"}
+	env := newTestEnv(t, config, scheduled, excludedNode, testNode("node3", nil), testNode("node4", map[string]string{PREEMPTIBLE_LABEL: "true"}))
+	env.schedule(t, "node1")
+	env.sniper.setPhase("node4", PHASE_DRAINING)
+
+	tests := []struct {
+		name           string
+		pool           string
+		eligible       bool
+		excludedReason string
+		scheduled      bool
+		phase          string
+	}{
+		{name: "node1", pool: "pool", eligible: true, scheduled: true, phase: PHASE_DUE},
+		{name: "node2", pool: "critical", excludedReason: "node pool critical", phase: PHASE_INELIGIBLE},
+		{name: "node3", pool: stats.UNKNOWN, excludedReason: "not preemptible", phase: PHASE_INELIGIBLE},
+		{name: "node4", pool: stats.UNKNOWN, eligible: true, phase: PHASE_DRAINING},
+	}
+
+	statuses := env.sniper.NodeStatuses()
+	if len(statuses) != len(tests) {
+		t.Fatalf("expected %d nodes, got %+v", len(tests), statuses)
+	}
+	for i, test := range tests {
+		status := statuses[i]
+		if status.Name != test.name || status.NodePool != test.pool || status.Zone != "zone" {
+			t.Errorf("%s: unexpected node %+v", test.name, status)
+		}
+		if status.Eligible != test.eligible || status.ExcludedReason != test.excludedReason {
+			t.Errorf("%s: expected eligible %v with reason %q, got %v with %q", test.name, test.eligible, test.excludedReason, status.Eligible, status.ExcludedReason)
+		}
+		if (status.Scheduled != nil) != test.scheduled || status.Phase != test.phase {
+			t.Errorf("%s: expected scheduled %v in phase %s, got %v in %s", test.name, test.scheduled, test.phase, status.Scheduled, status.Phase)
+		}
+	}
+}
+
+func TestSnipeNow(t *testing.T) {
+	env := newTestEnv(t, testConfig(t), testNode("node1", map[string]string{PREEMPTIBLE_LABEL: "true"}), testNode("node2", nil))
+	env.google.AddInstance("project", "zone", testInstance("node1", "cluster"))
+
+	if _, err := env.sniper.SnipeNow(context.TODO(), "node2"); !errors.Is(err, ErrNotEligible) {
+		t.Fatalf("expected non-preemptible node not to be eligible, got %v", err)
+	}
+	if _, err := env.sniper.SnipeNow(context.TODO(), "node9"); !errors.Is(err, ErrNodeNotFound) {
+		t.Fatalf("expected unknown node not to be found, got %v", err)
+	}
+
+	scheduled, err := env.sniper.SnipeNow(context.TODO(), "node1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	env.waitForCache(t, "node1", func(node *v1.Node) bool {
+		return node.Annotations[TIMESTAMP_ANNOTATION] == scheduled.Format(time.RFC3339)
+	})
+	if _, err := env.sniper.ProcessNode(context.TODO(), "node1"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if env.nodeExists("node1") {
+		t.Fatalf("expected node to be sniped right away")
+	}
+}
+
+func TestReschedule(t *testing.T) {
+	nodes := []runtime.Object{}
+	for _, name := range []string{"node1", "node2"} {
+		node := testNode(name, map[string]string{PREEMPTIBLE_LABEL: "true"})
+		node.Annotations = map[string]string{TIMESTAMP_ANNOTATION: time.Now().Add(time.Hour).Format(time.RFC3339)}
+		nodes = append(nodes, node)
+	}
+	env := newTestEnv(t, testConfig(t), nodes...)
+
+	// noon is within the allowed times of the test configuration
+	now := env.clock.Now()
+	at := time.Date(now.Year(), now.Month(), now.Day()+2, 12, 0, 0, 0, time.Local)
+	if _, err := env.sniper.Reschedule(context.TODO(), "node1", at); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	env.waitForCache(t, "node1", func(node *v1.Node) bool {
+		return node.Annotations[TIMESTAMP_ANNOTATION] == at.Format(time.RFC3339)
+	})
+
+	// node1 is not due anymore, node2 is moved as well
+	notBefore := env.clock.Now().Add(24 * time.Hour)
+	rescheduled, err := env.sniper.RescheduleAll(context.TODO(), notBefore)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, moved := rescheduled["node1"]; moved || len(rescheduled) != 1 || rescheduled["node2"].Before(notBefore) {
+		t.Fatalf("expected only node2 to be moved after %v, got %v", notBefore, rescheduled)
+	}
+}
+
+func TestRescheduleRejectsInvalidTimes(t *testing.T) {
+	blocked, err := timing.ParseTimeSlots([]string{"11:00-13:00"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	config := testConfig(t)
+	config.BlockedTimes = blocked
+	node := testNode("node1", map[string]string{PREEMPTIBLE_LABEL: "true"})
+	env := newTestEnv(t, config, node)
+	now := env.clock.Now()
+	day := func(days, hour int) time.Time {
+		return time.Date(now.Year(), now.Month(), now.Day()+days, hour, 30, 0, 0, time.Local)
+	}
+	node.CreationTimestamp = metav1.NewTime(now)
+
+	tests := []struct {
+		name   string
+		t      time.Time
+		policy *policy.Policy
+		valid  bool
+	}{
+		{name: "future", t: day(2, 9), valid: true},
+		{name: "past", t: now.Add(-time.Hour)},
+		{name: "now", t: now},
+		{name: "blocked", t: day(2, 12)},
+		{name: "outside the allowed times of the policy", t: day(2, 9), policy: &policy.Policy{Name: "batch", AllowedTimes: mustParseTimeSlots(t, "02:00-03:00"), Location: time.Local}},
+		{name: "before the minimum lifetime", t: day(2, 9), policy: &policy.Policy{Name: "batch", AllowedTimes: config.AllowedTimes, Location: time.Local, MinLifetime: 7 * 24 * time.Hour}},
+		{name: "after the maximum lifetime", t: day(2, 9), policy: &policy.Policy{Name: "batch", AllowedTimes: config.AllowedTimes, Location: time.Local, MaxLifetime: 24 * time.Hour}},
+		{name: "within the lifetime", t: day(2, 9), policy: &policy.Policy{Name: "batch", AllowedTimes: config.AllowedTimes, Location: time.Local, MaxLifetime: 72 * time.Hour}, valid: true},
+	}
+
+	for _, test := range tests {
+		cfg := applyPolicy(config, test.policy)
+		err := checkSnipeTime(node, cfg, test.policy, test.t, now)
+		if (err == nil) != test.valid || (err != nil && !errors.Is(err, ErrInvalidTime)) {
+			t.Errorf("%s: expected valid %v, got %v", test.name, test.valid, err)
+		}
+	}
+
+	// rejected times do not change the schedule
+	if _, err := env.sniper.Reschedule(context.TODO(), "node1", now.Add(-time.Minute)); !errors.Is(err, ErrInvalidTime) {
+		t.Fatalf("expected ErrInvalidTime, got %v", err)
+	}
+	for _, action := range env.clientset.Actions() {
+		if action.Matches("patch", "nodes") {
+			t.Fatalf("expected the schedule to be kept, got a patch of the node")
+		}
+	}
+}
+
+func mustParseTimeSlots(t *testing.T, slots ...string) timing.TimeSlots {
+	ts, err := timing.ParseTimeSlots(slots)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	return ts
+}
+
+func TestExempt(t *testing.T) {
+	env := newTestEnv(t, testConfig(t), testNode("node1", map[string]string{PREEMPTIBLE_LABEL: "true"}))
+	env.google.AddInstance("project", "zone", testInstance("node1", "cluster"))
+	env.schedule(t, "node1")
+
+	// the fake clock is far from the wall clock, so that an exemption ending on the wall clock would be noticed
+	env.clock.Advance(24 * time.Hour)
+	until, err := env.sniper.Exempt(context.TODO(), "node1", time.Hour)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	env.waitForCache(t, "node1", func(node *v1.Node) bool {
+		_, exists := node.Annotations[EXEMPT_ANNOTATION]
+		return exists
+	})
+	if statuses := env.sniper.NodeStatuses(); statuses[0].Phase != PHASE_EXEMPT {
+		t.Fatalf("expected node to be exempt, got %+v", statuses[0])
+	}
+
+	if want := env.clock.Now().Add(time.Hour).Truncate(time.Second); !until.Equal(want) {
+		t.Fatalf("expected exemption until %v, got %v", want, until)
+	}
+
+	requeueAfter, err := env.sniper.ProcessNode(context.TODO(), "node1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !env.nodeExists("node1") || requeueAfter != until.Sub(env.clock.Now()) {
+		t.Fatalf("expected exempt node to be kept until %v, requeued after %v", until, requeueAfter)
+	}
+
+	// once the exemption ends, the overdue node is sniped
+	env.clock.Advance(requeueAfter)
+	if _, err := env.sniper.ProcessNode(context.TODO(), "node1"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if env.nodeExists("node1") {
+		t.Fatalf("expected node to be sniped after its exemption")
+	}
+}
+
+func TestErrorBudget(t *testing.T) {
+	env := newTestEnv(t, testConfig(t))
+	s := env.sniper
+
+	// transient errors only affect readiness
+	for range ERROR_BUDGET_TRANSIENT {
+		s.ok(&googleapi.Error{Code: http.StatusServiceUnavailable}, "transient")
+	}
+	if !s.Healthy() || s.Ready() {
+		t.Fatalf("expected exhausted transient budget to make the sniper not ready, but healthy")
+	}
+	s.checkErrorBudget()
+	if env.clock.slept != ERROR_BUDGET_EXCEEDED_SLEEP {
+		t.Fatalf("expected to sleep %v, slept %v", ERROR_BUDGET_EXCEEDED_SLEEP, env.clock.slept)
+	}
+
+	// errors leave the window
+	env.clock.Advance(ERROR_BUDGET_WINDOW)
+	if !s.Healthy() || !s.Ready() {
+		t.Fatalf("expected sniper to recover once the errors left the window")
+	}
+
+	// fatal errors affect health
+	for range ERROR_BUDGET_FATAL {
+		s.ok(fmt.Errorf("%w: no group", ErrConfig), "fatal")
+	}
+	if s.Healthy() || s.Ready() {
+		t.Fatalf("expected exhausted fatal budget to make the sniper unhealthy and not ready")
+	}
+}
+
+func TestErrorBudgetCountsEveryFailureOnce(t *testing.T) {
+	node := testNode("node1", map[string]string{PREEMPTIBLE_LABEL: "true", NODE_POOL_LABEL: "pool"})
+	env := newTestEnv(t, testConfig(t), node)
+	env.google.AddInstance("project", "zone", testInstance("node1", "cluster"))
+	env.schedule(t, "node1")
+	env.google.SetError("GetInstance", &googleapi.Error{Code: http.StatusForbidden})
+	s := env.sniper
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		if _, err := s.ProcessNode(context.TODO(), "node1"); err == nil {
+			t.Fatalf("expected attempt %d to fail", attempt)
+		}
+		if got := s.errorBudget.Count(budget.Fatal); got != attempt {
+			t.Fatalf("expected %d fatal errors after attempt %d, got %d", attempt, attempt, got)
+		}
+	}
+
+	// the queue of the node watcher does not count the failure again
+	done := make(chan struct{})
+	go func() {
+		s.processNodes(context.TODO())
+		close(done)
+	}()
+	s.watcher.Enqueue("node1")
+	deadline := time.Now().Add(5 * time.Second)
+	for s.watcher.Retries("node1") == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the node to be processed from the queue")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.watcher.ShutDown()
+	<-done
+	// informer events may have queued the node more than once, every failed attempt is one retry
+	attempts := 2 + s.watcher.Retries("node1")
+	if got := s.errorBudget.Count(budget.Fatal); got != attempts {
+		t.Fatalf("expected %d fatal errors after %d attempts, got %d", attempts, attempts, got)
+	}
+}
+
+func TestProcessNodesSchedulesWhileSniping(t *testing.T) {
+	node := testNode("node1", map[string]string{PREEMPTIBLE_LABEL: "true", NODE_POOL_LABEL: "pool"})
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "default"},
+		Spec:       v1.PodSpec{NodeName: "node1"},
+	}
+	env := newTestEnv(t, testConfig(t), node, pod)
+	env.google.AddInstance("project", "zone", testInstance("node1", "cluster"))
+	// the eviction is accepted, but the pod stays until the test removes it, so that the drain blocks
+	var draining atomic.Bool
+	env.clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		draining.Store(true)
+		return true, nil, nil
+	})
+	env.schedule(t, "node1")
+
+	// a single worker, which would be blocked by the snipe if it ran the snipe itself
+	done := make(chan struct{})
+	go func() {
+		env.sniper.processNodes(context.TODO())
+		close(done)
+	}()
+	env.sniper.watcher.Enqueue("node1")
+	deadline := time.Now().Add(5 * time.Second)
+	for !draining.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected node1 to be drained")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, err := env.clientset.CoreV1().Nodes().Create(context.TODO(), testNode("node2", map[string]string{PREEMPTIBLE_LABEL: "true", NODE_POOL_LABEL: "pool"}), metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	env.waitForCache(t, "node2", func(node *v1.Node) bool {
+		_, exists := node.Annotations[TIMESTAMP_ANNOTATION]
+		return exists
+	})
+	if !env.podExists("default", "pod1") {
+		t.Fatal("expected node1 to be still draining while node2 was scheduled")
+	}
+
+	if err := env.clientset.Tracker().Delete(v1.SchemeGroupVersion.WithResource("pods"), "default", "pod1"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	env.sniper.watcher.ShutDown()
+	<-done
+	if env.nodeExists("node1") {
+		t.Fatal("expected the snipe of node1 to finish")
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		class budget.Class
+	}{
+		{name: "unavailable", err: &googleapi.Error{Code: http.StatusServiceUnavailable}, class: budget.Transient},
+		{name: "google forbidden", err: fmt.Errorf("failed: %w", &googleapi.Error{Code: http.StatusForbidden}), class: budget.Fatal},
+		{name: "kubernetes forbidden", err: apierrors.NewForbidden(v1.Resource("nodes"), "node1", errors.New("denied")), class: budget.Fatal},
+		{name: "kubernetes conflict", err: apierrors.NewConflict(v1.Resource("nodes"), "node1", errors.New("conflict")), class: budget.Transient},
+		{name: "config", err: fmt.Errorf("%w: no group", ErrConfig), class: budget.Fatal},
+		{name: "other", err: errors.New("connection reset"), class: budget.Transient},
+	}
+
+	for _, test := range tests {
+		if class := classify(test.err); class != test.class {
+			t.Errorf("%s: expected %v, got %v", test.name, test.class, class)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package sniper
+
+import (
+	"sort"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// phases of a node as reported by NodeStatuses
+const (
+	PHASE_INELIGIBLE  = "Ineligible"  // node is not preemptible or excluded by the configuration
+	PHASE_UNSCHEDULED = "Unscheduled" // no snipe time was planned yet
+	PHASE_SCHEDULED   = "Scheduled"   // snipe time is planned and has not come yet
+	PHASE_DUE         = "Due"         // snipe time has come, the snipe starts once the node is processed
+	PHASE_PAUSED      = "Paused"      // snipe time has come, but sniping is paused
+	PHASE_EXEMPT      = "Exempt"      // snipe time has come, but an operator exempted the node
+	PHASE_SURGING     = "Surging"     // waiting for the replacement node
+	PHASE_DRAINING    = "Draining"    // node is cordoned and its pods are evicted
+	PHASE_DELETING    = "Deleting"    // node and instance are deleted
+)
+
+// NodeStatus is the state of a node from the point of view of the sniper.
+type NodeStatus struct {
+	Name           string     `json:"name"`
+	NodePool       string     `json:"nodePool"`
+	Zone           string     `json:"zone"`
+	Created        time.Time  `json:"created"`
+	AgeSeconds     float64    `json:"ageSeconds"`
+	Eligible       bool       `json:"eligible"`                 // whether the node is sniped at all
+	ExcludedReason string     `json:"excludedReason,omitempty"` // why the node is not eligible
+	Scheduled      *time.Time `json:"scheduled,omitempty"`      // planned snipe time
+	ExemptUntil    *time.Time `json:"exemptUntil,omitempty"`    // end of an exemption by an operator
+	Phase          string     `json:"phase"`                    // one of the PHASE_* constants
+	Retries        int        `json:"retries"`                  // number of failed attempts to process the node since it last succeeded
+}
+
+// NodeStatuses returns the state of all cached nodes, sorted by name.
+func (s *Sniper) NodeStatuses() []NodeStatus {
+	cfg := s.config.Config()
+	now := s.clock.Now()
+
+	nodes := s.watcher.Nodes()
+	statuses := make([]NodeStatus, 0, len(nodes))
+	for _, node := range nodes {
+		status := NodeStatus{
+			Name:       node.Name,
+			NodePool:   nodePool(node),
+			Zone:       nodeZone(node),
+			Created:    node.CreationTimestamp.Time,
+			AgeSeconds: now.Sub(node.CreationTimestamp.Time).Seconds(),
+			Retries:    s.watcher.Retries(node.Name),
+		}
+		if t, planned := s.nextSnipe(node); planned {
+			status.Scheduled = &t
+		}
+		if until, exempt := s.exemptUntil(node); exempt && now.Before(until) {
+			status.ExemptUntil = &until
+		}
+		status.ExcludedReason = excluded(node, cfg)
+		if _, preemptible := node.Labels[PREEMPTIBLE_LABEL]; !preemptible && status.Scheduled == nil && status.ExcludedReason == "" {
+			status.ExcludedReason = "not preemptible"
+		}
+		status.Eligible = status.ExcludedReason == ""
+		status.Phase = s.phase(node, status, now)
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// phase returns the phase of the node. Running snipes report their current step.
+func (s *Sniper) phase(node *v1.Node, status NodeStatus, now time.Time) string {
+	s.phasesMu.Lock()
+	phase, sniping := s.phases[node.Name]
+	s.phasesMu.Unlock()
+
+	switch {
+	case sniping:
+		return phase
+	case !status.Eligible:
+		return PHASE_INELIGIBLE
+	case status.Scheduled == nil:
+		return PHASE_UNSCHEDULED
+	case now.Before(*status.Scheduled):
+		return PHASE_SCHEDULED
+	case s.isPaused(node):
+		return PHASE_PAUSED
+	case status.ExemptUntil != nil:
+		return PHASE_EXEMPT
+	default:
+		return PHASE_DUE
+	}
+}
+
+// setPhase sets the phase of a running snipe. An empty phase marks the snipe as finished.
+func (s *Sniper) setPhase(nodeName, phase string) {
+	s.phasesMu.Lock()
+	defer s.phasesMu.Unlock()
+	if phase == "" {
+		delete(s.phases, nodeName)
+		return
+	}
+	s.phases[nodeName] = phase
+}
@@ -0,0 +1,69 @@
+package stats
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// MAX_RECORDED_NODES is the maximum number of nodes kept by the recorders of the legacy gauges.
+const MAX_RECORDED_NODES = 1000
+
+// Recorder records one time per node. It is safe for concurrent use.
+// Recording a node again replaces its time, so that nodes which are processed repeatedly are kept only once.
+type Recorder struct {
+	mu      sync.Mutex
+	times   map[string]time.Time
+	maxSize int
+}
+
+// NewRecorder creates a Recorder which keeps at most maxSize nodes.
+func NewRecorder(maxSize int) *Recorder {
+	return &Recorder{times: make(map[string]time.Time), maxSize: maxSize}
+}
+
+// Record records the time of the node. If the recorder is full, the node with the earliest time is dropped to make room.
+func (r *Recorder) Record(nodeName string, t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.times[nodeName]; !exists && len(r.times) >= r.maxSize {
+		var earliest string
+		for name, recorded := range r.times {
+			if earliest == "" || recorded.Before(r.times[earliest]) {
+				earliest = name
+			}
+		}
+		delete(r.times, earliest)
+	}
+	r.times[nodeName] = t
+}
+
+// Prune removes all nodes whose time is not between from and to and returns the remaining nodes, sorted by time.
+func (r *Recorder) Prune(from, to time.Time) SnipedNodes {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	nodes := make(SnipedNodes, 0, len(r.times))
+	for name, t := range r.times {
+		if !t.After(from) || !t.Before(to) {
+			delete(r.times, name)
+			continue
+		}
+		nodes = append(nodes, SnipedNode{NodeName: name, Time: t})
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Time.Equal(nodes[j].Time) {
+			return nodes[i].NodeName < nodes[j].NodeName
+		}
+		return nodes[i].Time.Before(nodes[j].Time)
+	})
+	return nodes
+}
+
+// Len returns the number of recorded nodes.
+func (r *Recorder) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.times)
+}
@@ -0,0 +1,130 @@
+package stats
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRecorder(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		maxSize int
+		record  []SnipedNode
+		want    SnipedNodes
+	}{
+		{
+			name:    "sorted by time",
+			maxSize: 10,
+			record:  []SnipedNode{{"node2", now.Add(2 * time.Minute)}, {"node1", now.Add(time.Minute)}},
+			want:    SnipedNodes{{"node1", now.Add(time.Minute)}, {"node2", now.Add(2 * time.Minute)}},
+		},
+		{
+			name:    "recording a node again keeps the latest time",
+			maxSize: 10,
+			record:  []SnipedNode{{"node1", now.Add(time.Minute)}, {"node1", now.Add(time.Minute)}, {"node1", now.Add(3 * time.Minute)}},
+			want:    SnipedNodes{{"node1", now.Add(3 * time.Minute)}},
+		},
+		{
+			name:    "earliest node is dropped if full",
+			maxSize: 2,
+			record:  []SnipedNode{{"node1", now.Add(time.Minute)}, {"node2", now.Add(2 * time.Minute)}, {"node3", now.Add(3 * time.Minute)}},
+			want:    SnipedNodes{{"node2", now.Add(2 * time.Minute)}, {"node3", now.Add(3 * time.Minute)}},
+		},
+		{
+			name:    "known node is updated if full",
+			maxSize: 2,
+			record:  []SnipedNode{{"node1", now.Add(time.Minute)}, {"node2", now.Add(2 * time.Minute)}, {"node1", now.Add(3 * time.Minute)}},
+			want:    SnipedNodes{{"node2", now.Add(2 * time.Minute)}, {"node1", now.Add(3 * time.Minute)}},
+		},
+		{
+			name:    "nodes outside of the window are removed",
+			maxSize: 10,
+			record:  []SnipedNode{{"node1", now.Add(-time.Minute)}, {"node2", now}, {"node3", now.Add(time.Minute)}, {"node4", now.Add(time.Hour)}},
+			want:    SnipedNodes{{"node3", now.Add(time.Minute)}},
+		},
+	}
+
+	for _, test := range tests {
+		r := NewRecorder(test.maxSize)
+		for _, node := range test.record {
+			r.Record(node.NodeName, node.Time)
+		}
+		got := r.Prune(now, now.Add(time.Hour))
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want, got)
+		}
+		if r.Len() != len(test.want) {
+			t.Errorf("%s: expected pruned nodes to be removed, %d nodes left", test.name, r.Len())
+		}
+	}
+}
+
+func TestRecorderConcurrent(t *testing.T) {
+	const workers, nodes = 20, 100
+	r := NewRecorder(nodes / 2)
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := range nodes {
+				r.Record(fmt.Sprintf("node%d", i), now.Add(time.Duration(w+i)*time.Second))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range nodes {
+				r.Prune(now.Add(-time.Hour), now.Add(time.Hour))
+				r.Len()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if r.Len() > nodes/2 {
+		t.Fatalf("expected at most %d nodes, got %d", nodes/2, r.Len())
+	}
+}
+
+func TestLegacyMetricsConcurrent(t *testing.T) {
+	EnableLegacyMetrics()
+	const workers, nodes = 10, 50
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := range nodes {
+				// the same nodes are recorded by every worker, like the node workers of the sniper do
+				AddSnipedNode(fmt.Sprintf("node%d", i), now.Add(-time.Minute))
+				AddExpectedSnipe(fmt.Sprintf("node%d", i), now.Add(30*time.Minute))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range nodes {
+				UpdateSnipedInLastHour()
+				UpdateSnipesExpectedInNextHour()
+			}
+		}()
+	}
+	wg.Wait()
+
+	UpdateSnipedInLastHour()
+	UpdateSnipesExpectedInNextHour()
+	if got := testutil.CollectAndCount(SnipedInLastHour); got != nodes {
+		t.Errorf("expected %d sniped nodes, got %d", nodes, got)
+	}
+	if got := testutil.CollectAndCount(SnipesExpectedInNextHour); got != nodes {
+		t.Errorf("expected %d expected snipes, got %d", nodes, got)
+	}
+}
@@ -2,17 +2,40 @@
 package stats
 
 import (
+	"maps"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+const (
+	RESULT_SUCCEEDED = "succeeded"
+	RESULT_FAILED    = "failed"
+
+	REMOVAL_EVICTED = "evicted" // pod was evicted through the Eviction API, respecting its disruption budget
+	REMOVAL_DELETED = "deleted" // pod was deleted after its eviction failed
+
+	NOTIFICATION_DROPPED = "dropped" // notification was not queued because the queue of the webhook was full
+
+	UNKNOWN = "unknown" // label value if the node pool or zone of a node is unknown
+)
+
 type SnipedNode struct {
 	NodeName string
 	Time     time.Time
 }
 
+// ScheduledSnipe is the planned snipe of a node.
+type ScheduledSnipe struct {
+	Node     string
+	NodePool string
+	Zone     string
+	Time     time.Time
+}
+
 // SnipedNodes is a list of sniped nodes.
 type SnipedNodes []SnipedNode
 
@@ -27,66 +50,171 @@ var (
 		Help: "Number of nodes expected to be sniped in the next hour",
 	}, []string{"node", "time"})
 
+	DryRun = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "gke_preemptible_sniper_dry_run",
+		Help: "Whether the sniper runs in dry-run mode (1) or mutates the cluster (0)",
+	})
+
+	DryRunActions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gke_preemptible_sniper_dry_run_actions_total",
+		Help: "Number of mutating actions the sniper skipped because of dry-run mode",
+	}, []string{"action"})
+
+	Paused = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "gke_preemptible_sniper_paused",
+		Help: "Whether sniping is paused cluster-wide (1) or not (0)",
+	})
+
+	VerificationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gke_preemptible_sniper_verification_failures_total",
+		Help: "Number of snipes aborted because the instance is not preemptible, belongs to another cluster or was not found",
+	}, []string{"reason"})
+
+	NodeTerminations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gke_preemptible_sniper_node_terminations_total",
+		Help: "Number of terminated nodes by node pool and cause, either sniped by the sniper or preempted by Compute Engine first",
+	}, []string{"nodepool", "cause"})
+
+	Errors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gke_preemptible_sniper_errors_total",
+		Help: "Number of errors by class, either transient or fatal",
+	}, []string{"class"})
+
+	ErrorBudgetRemaining = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gke_preemptible_sniper_error_budget_remaining",
+		Help: "Number of errors by class which still fit into the error budget of the sliding window",
+	}, []string{"class"})
+
+	SnipesAttempted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gke_preemptible_sniper_snipes_attempted_total",
+		Help: "Number of snipes started by node pool and zone",
+	}, []string{"nodepool", "zone"})
+
+	Snipes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gke_preemptible_sniper_snipes_total",
+		Help: "Number of finished snipes by node pool, zone and result, either succeeded or failed",
+	}, []string{"nodepool", "zone", "result"})
+
+	SnipeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gke_preemptible_sniper_snipe_duration_seconds",
+		Help:    "Duration of snipes from surge or cordon until the instance is deleted, by node pool, zone and result",
+		Buckets: []float64{15, 30, 60, 120, 180, 300, 600, 900, 1200},
+	}, []string{"nodepool", "zone", "result"})
+
+	DrainDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gke_preemptible_sniper_drain_duration_seconds",
+		Help:    "Duration of draining nodes by node pool, zone and result",
+		Buckets: []float64{1, 5, 10, 30, 45, 60, 120, 180, 300, 600},
+	}, []string{"nodepool", "zone", "result"})
+
+	PodRemovals = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gke_preemptible_sniper_pod_removals_total",
+		Help: "Number of pods removed from drained nodes by node pool, zone and method, either evicted or deleted",
+	}, []string{"nodepool", "zone", "method"})
+
+	NodeAgeAtSnipe = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gke_preemptible_sniper_node_age_at_snipe_seconds",
+		Help:    "Age of nodes when they were sniped by node pool and zone",
+		Buckets: prometheus.LinearBuckets(float64(2*time.Hour/time.Second), float64(2*time.Hour/time.Second), 12),
+	}, []string{"nodepool", "zone"})
+
+	ScheduledSnipeTimestamp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gke_preemptible_sniper_scheduled_snipe_timestamp_seconds",
+		Help: "Planned snipe time of every managed node as Unix time",
+	}, []string{"node", "nodepool", "zone"})
+
+	Notifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gke_preemptible_sniper_notifications_total",
+		Help: "Number of webhook notifications by webhook and result, either succeeded, failed or dropped",
+	}, []string{"webhook", "result"})
+
 	Reg = prometheus.NewRegistry()
 
-	snipedInLastHour         SnipedNodes
-	snipesExpectedInNextHour SnipedNodes
+	legacyMetrics atomic.Bool // whether the gauges labelled by node name and time are recorded
+
+	snipedInLastHour         = NewRecorder(MAX_RECORDED_NODES)
+	snipesExpectedInNextHour = NewRecorder(MAX_RECORDED_NODES)
+	legacyGaugesMu           sync.Mutex // serializes the updates of the legacy gauges, which are reset and set again
+
+	scheduledSnipesMu sync.Mutex
+	scheduledSnipes   = make(map[string]prometheus.Labels) // labels of the ScheduledSnipeTimestamp series by node name
 )
 
 func init() {
-	Reg.MustRegister(SnipedInLastHour, SnipesExpectedInNextHour)
-
-	snipedInLastHour = make(SnipedNodes, 0)
+	Reg.MustRegister(DryRun, DryRunActions, Paused, VerificationFailures, NodeTerminations, Errors, ErrorBudgetRemaining,
+		SnipesAttempted, Snipes, SnipeDuration, DrainDuration, PodRemovals, NodeAgeAtSnipe, ScheduledSnipeTimestamp, Notifications)
 }
 
-// AddSnipedNode adds a sniped node to the list of sniped nodes.
-func AddSnipedNode(nodeName string, time time.Time) {
-	snipedInLastHour = append(snipedInLastHour, SnipedNode{NodeName: nodeName, Time: time})
+// EnableLegacyMetrics registers the gauges labelled by node name and time. Their cardinality is unbounded, so they are deprecated.
+func EnableLegacyMetrics() {
+	if !legacyMetrics.Swap(true) {
+		Reg.MustRegister(SnipedInLastHour, SnipesExpectedInNextHour)
+	}
 }
 
-// UpdateSnipedInLastHour updates the number of sniped nodes in the last hour. It removes nodes that are older than an hour.
-func UpdateSnipedInLastHour() {
-	var snipedNodes SnipedNodes
-	now := time.Now()
-	oneHourAgo := now.Add(-time.Hour)
-
-	SnipedInLastHour.Reset()
+// SetScheduledSnipes replaces all scheduled snipes. The series of nodes which are not part of snipes anymore are removed.
+func SetScheduledSnipes(snipes []ScheduledSnipe) {
+	scheduledSnipesMu.Lock()
+	defer scheduledSnipesMu.Unlock()
 
-	for _, snipedNode := range snipedInLastHour {
-		if snipedNode.Time.After(oneHourAgo) && snipedNode.Time.Before(now) {
-			snipedNodes = append(snipedNodes, snipedNode)
+	current := make(map[string]prometheus.Labels, len(snipes))
+	for _, snipe := range snipes {
+		labels := prometheus.Labels{"node": snipe.Node, "nodepool": snipe.NodePool, "zone": snipe.Zone}
+		current[snipe.Node] = labels
+		ScheduledSnipeTimestamp.With(labels).Set(float64(snipe.Time.Unix()))
+	}
+	for node, labels := range scheduledSnipes {
+		// the labels of a node may have changed as well
+		if newLabels, exists := current[node]; !exists || !maps.Equal(newLabels, labels) {
+			ScheduledSnipeTimestamp.Delete(labels)
 		}
 	}
+	scheduledSnipes = current
+}
 
-	snipedInLastHour = snipedNodes
+// Result returns the result label value for the provided error.
+func Result(err error) string {
+	if err != nil {
+		return RESULT_FAILED
+	}
+	return RESULT_SUCCEEDED
+}
 
-	for _, snipedNode := range snipedInLastHour {
-		SnipedInLastHour.WithLabelValues(snipedNode.NodeName, snipedNode.Time.Format(time.RFC3339)).Set(1)
+// AddSnipedNode records a sniped node. A node which is recorded again keeps only its latest time.
+func AddSnipedNode(nodeName string, time time.Time) {
+	if !legacyMetrics.Load() {
+		return
 	}
+	snipedInLastHour.Record(nodeName, time)
 }
 
-// AddExpectedSnipe adds an expected snipe to the list of expected snipes.
+// UpdateSnipedInLastHour updates the number of sniped nodes in the last hour. It removes nodes that are older than an hour.
+func UpdateSnipedInLastHour() {
+	now := time.Now()
+	setLegacyGauge(SnipedInLastHour, snipedInLastHour.Prune(now.Add(-time.Hour), now))
+}
+
+// AddExpectedSnipe records an expected snipe. A node which is recorded again keeps only its latest time.
 func AddExpectedSnipe(nodeName string, time time.Time) {
-	snipesExpectedInNextHour = append(snipesExpectedInNextHour, SnipedNode{NodeName: nodeName, Time: time})
+	if !legacyMetrics.Load() {
+		return
+	}
+	snipesExpectedInNextHour.Record(nodeName, time)
 }
 
 // UpdateSnipesExpectedInNextHour updates the number of expected snipes in the next hour. It removes nodes which timestamp has already passed or is further than an hour away.
 func UpdateSnipesExpectedInNextHour() {
-	var snipedNodes SnipedNodes
 	now := time.Now()
-	oneHourLater := now.Add(time.Hour)
-
-	SnipesExpectedInNextHour.Reset()
-
-	for _, snipedNode := range snipesExpectedInNextHour {
-		if snipedNode.Time.After(now) && snipedNode.Time.Before(oneHourLater) {
-			snipedNodes = append(snipedNodes, snipedNode)
-		}
-	}
+	setLegacyGauge(SnipesExpectedInNextHour, snipesExpectedInNextHour.Prune(now, now.Add(time.Hour)))
+}
 
-	snipesExpectedInNextHour = snipedNodes
+// setLegacyGauge replaces all series of the gauge with one series per node.
+func setLegacyGauge(gauge *prometheus.GaugeVec, nodes SnipedNodes) {
+	legacyGaugesMu.Lock()
+	defer legacyGaugesMu.Unlock()
 
-	for _, snipedNode := range snipesExpectedInNextHour {
-		SnipesExpectedInNextHour.WithLabelValues(snipedNode.NodeName, snipedNode.Time.Format(time.RFC3339)).Set(1)
+	gauge.Reset()
+	for _, node := range nodes {
+		gauge.WithLabelValues(node.NodeName, node.Time.Format(time.RFC3339)).Set(1)
 	}
 }
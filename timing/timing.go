@@ -4,6 +4,8 @@
 package timing
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
 	"math/rand"
@@ -15,6 +17,11 @@ type TimeSlot struct {
 	End   time.Time
 }
 
+// String returns the timeslot in the format "HH:MM-HH:MM"
+func (slot TimeSlot) String() string {
+	return slot.Start.Format("15:04") + "-" + slot.End.Format("15:04")
+}
+
 // TimeSlots represents a list of timeslots
 type TimeSlots []TimeSlot
 
@@ -62,12 +69,15 @@ func (ts TimeSlots) IsTimeBlocked(t time.Time) bool {
 // ParseTimeSlot parses a string in the format "HH:MM-HH:MM" to a TimeSlot
 func ParseTimeSlot(s string) (TimeSlot, error) {
 	var slot TimeSlot
-	var err error
-	startTime, err := time.Parse("15:04", s[:5])
+	start, end, found := strings.Cut(s, "-")
+	if !found {
+		return slot, fmt.Errorf("time slot %q is not in the format HH:MM-HH:MM", s)
+	}
+	startTime, err := time.Parse("15:04", start)
 	if err != nil {
 		return slot, err
 	}
-	endTime, err := time.Parse("15:04", s[6:])
+	endTime, err := time.Parse("15:04", end)
 	if err != nil {
 		return slot, err
 	}
@@ -118,3 +128,22 @@ func CreateAllowedTime(allowed TimeSlots, blocked TimeSlots) (time.Time, error)
 		res = res.Add(10 * time.Minute) // search in 10 minute intervals
 	}
 }
+
+// CreateAllowedTimeBetween creates a random time between earliest and latest which is in an allowed TimeSlot and outside a blocklisted TimeSlot.
+// The TimeSlots are compared with the clock in the provided location. It fails if there is no such time.
+func CreateAllowedTimeBetween(allowed TimeSlots, blocked TimeSlots, earliest, latest time.Time, loc *time.Location) (time.Time, error) {
+	if latest.Before(earliest) {
+		return time.Time{}, fmt.Errorf("latest time %s is before earliest time %s", latest.Format(time.RFC3339), earliest.Format(time.RFC3339))
+	}
+	span := latest.Sub(earliest) + 1
+	offset := time.Duration(rand.Int63n(int64(span)))
+	// search in 10 minute intervals from a random start, wrapping around to earliest once latest is passed
+	for i := time.Duration(0); i <= span/(10*time.Minute)+1; i++ {
+		res := earliest.Add((offset + i*10*time.Minute) % span)
+		local := res.In(loc)
+		if allowed.IsTimeAllowed(local) && !blocked.IsTimeBlocked(local) {
+			return res, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("no allowed time between %s and %s", earliest.Format(time.RFC3339), latest.Format(time.RFC3339))
+}
@@ -34,6 +34,11 @@ func TestParseTimeSlot(t *testing.T) {
 			expected: TimeSlot{},
 			hasError: true,
 		},
+		{
+			input:    "8-16",
+			expected: TimeSlot{},
+			hasError: true,
+		},
 	}
 
 	for _, test := range tests {
@@ -47,6 +52,18 @@ func TestParseTimeSlot(t *testing.T) {
 	}
 }
 
+func TestTimeSlotString(t *testing.T) {
+	for _, input := range []string{"09:00-10:00", "00:00-23:59", "22:30-06:15"} {
+		slot, err := ParseTimeSlot(input)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if slot.String() != input {
+			t.Errorf("expected %q, got %q", input, slot.String())
+		}
+	}
+}
+
 func TestParseTimeSlots(t *testing.T) {
 	tests := []struct {
 		input    []string
@@ -380,3 +397,42 @@ func TestCreateAllowedTime(t *testing.T) {
 		}
 	}
 }
+
+func TestCreateAllowedTimeBetween(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("time zone database not available: %v", err)
+	}
+	earliest := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	allowed := TimeSlots{{Start: helperTime("09:00"), End: helperTime("10:00")}}
+
+	tests := []struct {
+		name     string
+		latest   time.Time
+		loc      *time.Location
+		hasError bool
+	}{
+		{name: "utc", latest: earliest.Add(24 * time.Hour), loc: time.UTC},
+		{name: "time zone", latest: earliest.Add(24 * time.Hour), loc: berlin},
+		{name: "no allowed time in range", latest: earliest.Add(6 * time.Hour), loc: time.UTC, hasError: true},
+		{name: "latest before earliest", latest: earliest.Add(-time.Hour), loc: time.UTC, hasError: true},
+	}
+
+	for _, test := range tests {
+		for range 20 {
+			result, err := CreateAllowedTimeBetween(allowed, nil, earliest, test.latest, test.loc)
+			if (err != nil) != test.hasError {
+				t.Fatalf("%s: error = %v, expected error = %v", test.name, err, test.hasError)
+			}
+			if test.hasError {
+				break
+			}
+			if result.Before(earliest) || result.After(test.latest) {
+				t.Fatalf("%s: %v is not between %v and %v", test.name, result, earliest, test.latest)
+			}
+			if !allowed.IsTimeAllowed(result.In(test.loc)) {
+				t.Fatalf("%s: %v is not allowed in %v", test.name, result, test.loc)
+			}
+		}
+	}
+}
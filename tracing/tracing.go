@@ -0,0 +1,109 @@
+// Package tracing traces snipes with OpenTelemetry, e.g. to see whether a slow snipe waits on evictions, NODE_DRAIN_SLEEP or the delete operation of Compute Engine.
+// Spans are exported via OTLP, configured by the standard OTEL_* environment variables. Without them, tracing is a no-op.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	TRACER_NAME  = "github.com/torbendury/gke-preemptible-sniper"
+	SERVICE_NAME = "gke-preemptible-sniper" // unless overridden by OTEL_SERVICE_NAME
+
+	PROTOCOL_GRPC = "grpc"
+	PROTOCOL_HTTP = "http/protobuf"
+)
+
+// Tracer returns the tracer of the sniper. It is a no-op until Setup, or tracingtest.InMemory in tests, installed a tracer provider.
+func Tracer() trace.Tracer {
+	return otel.Tracer(TRACER_NAME)
+}
+
+// Start starts a span as child of the span in the context.
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, opts...)
+}
+
+// End records the error, if any, on the span and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Enabled reports whether the environment asks for traces to be exported via OTLP.
+func Enabled(getenv func(string) string) bool {
+	if strings.EqualFold(getenv("OTEL_SDK_DISABLED"), "true") {
+		return false
+	}
+	switch getenv("OTEL_TRACES_EXPORTER") {
+	case "otlp":
+		return true
+	case "":
+		return getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+	default:
+		// "none" and exporters which are not supported
+		return false
+	}
+}
+
+// Protocol returns the OTLP protocol configured in the environment, http/protobuf by default.
+func Protocol(getenv func(string) string) string {
+	protocol := getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL")
+	if protocol == "" {
+		protocol = getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+	if protocol == PROTOCOL_GRPC {
+		return PROTOCOL_GRPC
+	}
+	return PROTOCOL_HTTP
+}
+
+// Setup installs a tracer provider which exports spans via OTLP, if the environment enables it.
+// The exporter itself reads endpoint, headers, timeout and TLS settings from the environment.
+// The returned function flushes the remaining spans and must be called before exiting.
+func Setup(ctx context.Context, getenv func(string) string) (func(context.Context) error, error) {
+	if !Enabled(getenv) {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	if Protocol(getenv) == PROTOCOL_GRPC {
+		exporter, err = otlptracegrpc.New(ctx)
+	} else {
+		exporter, err = otlptracehttp.New(ctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(SERVICE_NAME)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tracing resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
@@ -0,0 +1,87 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/torbendury/gke-preemptible-sniper/tracing/tracingtest"
+	"go.opentelemetry.io/otel/codes"
+)
+
+func env(values map[string]string) func(string) string {
+	return func(key string) string { return values[key] }
+}
+
+func TestEnabled(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want bool
+	}{
+		{name: "no configuration", env: map[string]string{}, want: false},
+		{name: "endpoint", env: map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318"}, want: true},
+		{name: "traces endpoint", env: map[string]string{"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": "http://collector:4318/v1/traces"}, want: true},
+		{name: "otlp exporter with default endpoint", env: map[string]string{"OTEL_TRACES_EXPORTER": "otlp"}, want: true},
+		{name: "none exporter", env: map[string]string{"OTEL_TRACES_EXPORTER": "none", "OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318"}, want: false},
+		{name: "unsupported exporter", env: map[string]string{"OTEL_TRACES_EXPORTER": "zipkin"}, want: false},
+		{name: "disabled SDK", env: map[string]string{"OTEL_SDK_DISABLED": "TRUE", "OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318"}, want: false},
+	}
+
+	for _, test := range tests {
+		if got := Enabled(env(test.env)); got != test.want {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestProtocol(t *testing.T) {
+	tests := []struct {
+		env  map[string]string
+		want string
+	}{
+		{env: map[string]string{}, want: PROTOCOL_HTTP},
+		{env: map[string]string{"OTEL_EXPORTER_OTLP_PROTOCOL": "grpc"}, want: PROTOCOL_GRPC},
+		{env: map[string]string{"OTEL_EXPORTER_OTLP_PROTOCOL": "grpc", "OTEL_EXPORTER_OTLP_TRACES_PROTOCOL": "http/protobuf"}, want: PROTOCOL_HTTP},
+		{env: map[string]string{"OTEL_EXPORTER_OTLP_TRACES_PROTOCOL": "grpc"}, want: PROTOCOL_GRPC},
+	}
+
+	for _, test := range tests {
+		if got := Protocol(env(test.env)); got != test.want {
+			t.Errorf("%v: expected %s, got %s", test.env, test.want, got)
+		}
+	}
+}
+
+func TestSetupWithoutConfiguration(t *testing.T) {
+	shutdown, err := Setup(context.TODO(), env(map[string]string{}))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := shutdown(context.TODO()); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}
+
+func TestStartAndEnd(t *testing.T) {
+	exporter := tracingtest.InMemory()
+
+	ctx, parent := Start(context.TODO(), "parent")
+	_, child := Start(ctx, "child")
+	End(child, errors.New("failed"))
+	End(parent, nil)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	if spans[0].Name != "child" || spans[0].Status.Code != codes.Error || len(spans[0].Events) != 1 {
+		t.Errorf("expected failed child span, got %+v", spans[0])
+	}
+	if spans[0].Parent.SpanID() != spans[1].SpanContext.SpanID() {
+		t.Error("expected child span to be a child of the parent span")
+	}
+	if spans[1].Name != "parent" || spans[1].Status.Code != codes.Unset {
+		t.Errorf("expected parent span, got %+v", spans[1])
+	}
+}
@@ -0,0 +1,16 @@
+// Package tracingtest records the spans of the sniper in memory, for tests.
+package tracingtest
+
+import (
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// InMemory installs a tracer provider which keeps all spans in memory and returns them.
+// Spans are recorded synchronously, they are available as soon as they ended.
+func InMemory() *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	return exporter
+}